@@ -0,0 +1,365 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/busthorne/simp/config"
+)
+
+const (
+	// how long the keys are kept before they're fetched again
+	jwksTTL = time.Hour
+	// how often the keys may be fetched for the key id that is not there
+	jwksCooldown = time.Minute
+	// how much the clocks may disagree
+	leeway = time.Minute
+)
+
+var (
+	ErrToken   = errors.New("invalid token")
+	ErrExpired = errors.New("token has expired")
+)
+
+// Claims are the claims of the verified token.
+type Claims map[string]any
+
+// String is the claim, if it's a string.
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Strings is the claim, if it's either a string, or a list of them.
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var list []string
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func (c Claims) time(name string) (time.Time, bool) {
+	n, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(n), 0), true
+}
+
+// JWT verifies the bearer tokens against the JWKS of an auth block, be it
+// `jwt`, or `cloudflare`, in which case the JWKS, issuer, and the header
+// are those of Cloudflare Access.
+type JWT struct {
+	Auth   config.Auth
+	Header string
+
+	jwks    string
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// NewJWT makes the verifier; the keys are fetched once the first token
+// comes along.
+func NewJWT(a config.Auth) *JWT {
+	j := &JWT{Auth: a, Header: "Authorization", jwks: a.JWKS}
+	if a.Type == "cloudflare" {
+		team := a.Team
+		if !strings.Contains(team, ".") {
+			team += ".cloudflareaccess.com"
+		}
+		if j.jwks == "" {
+			j.jwks = "https://" + team + "/cdn-cgi/access/certs"
+		}
+		if j.Auth.Issuer == "" {
+			j.Auth.Issuer = "https://" + team
+		}
+		j.Header = "Cf-Access-Jwt-Assertion"
+	}
+	return j
+}
+
+// Verify the token, and its claims.
+func (j *JWT) Verify(ctx context.Context, token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", ErrToken, err)
+	}
+	key, err := j.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verify(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if exp, ok := claims.time("exp"); !ok || now.After(exp.Add(leeway)) {
+		return nil, ErrExpired
+	}
+	if nbf, ok := claims.time("nbf"); ok && now.Before(nbf.Add(-leeway)) {
+		return nil, fmt.Errorf("%w: not valid yet", ErrToken)
+	}
+	if iss := j.Auth.Issuer; iss != "" && claims.String("iss") != iss {
+		return nil, fmt.Errorf("%w: issuer %q", ErrToken, claims.String("iss"))
+	}
+	if aud := j.Auth.Audience; aud != "" {
+		ok := false
+		for _, a := range claims.Strings("aud") {
+			ok = ok || a == aud
+		}
+		if !ok {
+			return nil, fmt.Errorf("%w: audience", ErrToken)
+		}
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrToken, err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrToken, err)
+	}
+	return nil
+}
+
+// key is the public key by its id; the keys are fetched again if they're
+// stale, or the id is not there, which is what happens when they rotate.
+func (j *JWT) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	since := time.Since(j.fetched)
+	_, ok := j.keys[kid]
+	if j.keys == nil || since > jwksTTL || !ok && since > jwksCooldown {
+		keys, err := fetchJWKS(ctx, j.jwks)
+		switch {
+		case err == nil:
+			j.keys, j.fetched = keys, time.Now()
+		case j.keys == nil:
+			return nil, err
+		}
+	}
+	key, ok := j.keys[kid]
+	if !ok && kid == "" && len(j.keys) == 1 {
+		for _, k := range j.keys {
+			return k, nil
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrToken, kid)
+	}
+	return key, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchJWKS reads the key set from the URL, or the file.
+func fetchJWKS(ctx context.Context, src string) (map[string]crypto.PublicKey, error) {
+	var r io.ReadCloser
+	if strings.HasPrefix(src, "https://") || strings.HasPrefix(src, "http://") {
+		req, err := http.NewRequestWithContext(ctx, "GET", src, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("fetch jwks: %w", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("fetch jwks: %s", resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(src)
+		if err != nil {
+			return nil, fmt.Errorf("read jwks: %w", err)
+		}
+		r = f
+	}
+	defer r.Close()
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(r).Decode(&set); err != nil {
+		return nil, fmt.Errorf("decode jwks: %w", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		key, err := k.public()
+		if err != nil {
+			// the keys that we don't understand are not going to be used
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("jwks has no usable keys")
+	}
+	return keys, nil
+}
+
+func (k jwk) public() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, err := b64.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// verify the signature by the algorithm; the algorithm has to match the
+// key, so that no token can pick a weaker one.
+func verify(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var hash crypto.Hash
+	switch alg[min(2, len(alg)):] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	bad := fmt.Errorf("%w: bad signature", ErrToken)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if hash == 0 {
+			break
+		}
+		h := hash.New()
+		h.Write(signed)
+		switch alg[:2] {
+		case "RS":
+			if rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), sig) != nil {
+				return bad
+			}
+			return nil
+		case "PS":
+			if rsa.VerifyPSS(key, hash, h.Sum(nil), sig, nil) != nil {
+				return bad
+			}
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		if hash == 0 || alg[:2] != "ES" {
+			break
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return bad
+		}
+		h := hash.New()
+		h.Write(signed)
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, h.Sum(nil), r, s) {
+			return bad
+		}
+		return nil
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			break
+		}
+		if !ed25519.Verify(key, signed, sig) {
+			return bad
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: algorithm %q", ErrToken, alg)
+}
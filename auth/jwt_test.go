@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/busthorne/simp/config"
+)
+
+func sign(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	b64 := base64.RawURLEncoding
+	h, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	c, _ := json.Marshal(claims)
+	signed := b64.EncodeToString(h) + "." + b64.EncodeToString(c)
+	sum := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + b64.EncodeToString(sig)
+}
+
+func TestJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding
+	jwks, _ := json.Marshal(map[string]any{"keys": []map[string]string{
+		{
+			"kty": "RSA", "kid": "r1",
+			"n": b64.EncodeToString(rsaKey.N.Bytes()),
+			"e": b64.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+		},
+		{
+			"kty": "EC", "kid": "e1", "crv": "P-256",
+			"x": b64.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))),
+			"y": b64.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32))),
+		},
+	}})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+	j := NewJWT(config.Auth{
+		Type:     "jwt",
+		JWKS:     path,
+		Issuer:   "https://sso.example.com",
+		Audience: "simp",
+	})
+	ctx := context.Background()
+	claims := func(edit func(map[string]any)) map[string]any {
+		c := map[string]any{
+			"iss":   "https://sso.example.com",
+			"aud":   []string{"simp", "other"},
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"email": "alice@example.com",
+		}
+		if edit != nil {
+			edit(c)
+		}
+		return c
+	}
+
+	for _, tt := range []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"rsa", sign(t, "RS256", "r1", rsaKey, claims(nil)), nil},
+		{"ec", sign(t, "ES256", "e1", ecKey, claims(nil)), nil},
+		{"expired", sign(t, "RS256", "r1", rsaKey, claims(func(c map[string]any) {
+			c["exp"] = time.Now().Add(-time.Hour).Unix()
+		})), ErrExpired},
+		{"issuer", sign(t, "RS256", "r1", rsaKey, claims(func(c map[string]any) {
+			c["iss"] = "https://evil.example.com"
+		})), ErrToken},
+		{"audience", sign(t, "RS256", "r1", rsaKey, claims(func(c map[string]any) {
+			c["aud"] = "other"
+		})), ErrToken},
+		// the algorithm has to match the key
+		{"confusion", sign(t, "ES256", "r1", ecKey, claims(nil)), ErrToken},
+		{"unknown key", sign(t, "RS256", "r2", rsaKey, claims(nil)), ErrToken},
+		{"garbage", "not.a.token", ErrToken},
+	} {
+		c, err := j.Verify(ctx, tt.token)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && c.String("email") != "alice@example.com" {
+			t.Errorf("%s: claims %v", tt.name, c)
+		}
+	}
+
+	// the signature is over the header and the claims as they were
+	token := sign(t, "RS256", "r1", rsaKey, claims(nil))
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(claims(func(c map[string]any) { c["email"] = "mallory@example.com" }))
+	parts[1] = b64.EncodeToString(forged)
+	if _, err := j.Verify(ctx, strings.Join(parts, ".")); !errors.Is(err, ErrToken) {
+		t.Errorf("forged: %v", err)
+	}
+}
+
+func TestCloudflare(t *testing.T) {
+	j := NewJWT(config.Auth{Type: "cloudflare", Team: "acme", Audience: "tag"})
+	if j.jwks != "https://acme.cloudflareaccess.com/cdn-cgi/access/certs" {
+		t.Error(j.jwks)
+	}
+	if j.Auth.Issuer != "https://acme.cloudflareaccess.com" || j.Header != "Cf-Access-Jwt-Assertion" {
+		t.Error(j.Auth.Issuer, j.Header)
+	}
+}
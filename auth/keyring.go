@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/cipher"
 	"crypto/rand"
+	"database/sql"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -54,6 +55,17 @@ func NewKeyring(auth config.Auth, provider *config.Provider) (keyring.Keyring, e
 	if err != nil {
 		return nil, fmt.Errorf("failed to open keyring %s: %w", auth.Name, err)
 	}
+	if err := Mount(auth.Name, ring); err != nil {
+		return nil, err
+	}
+	k := rings[auth.Name]
+	k.namespace = namespace
+	return &k, nil
+}
+
+// Mount the backend as the keyring by the name, that the master key is
+// kept in; the tests would mount the in-memory keyrings this way.
+func Mount(name string, ring keyring.Keyring) error {
 	const masterKey = "master_key"
 	secretItem, err := ring.Get(masterKey)
 	secret := make([]byte, 32)
@@ -61,30 +73,29 @@ func NewKeyring(auth config.Auth, provider *config.Provider) (keyring.Keyring, e
 	case nil:
 		b, _ := base64.StdEncoding.DecodeString(string(secretItem.Data))
 		if len(b) != 32 {
-			return nil, fmt.Errorf("invalid master key for keyring %q", auth.Name)
+			return fmt.Errorf("invalid master key for keyring %q", name)
 		}
 		secret = b
 	case keyring.ErrKeyNotFound:
 		if _, err := rand.Read(secret); err != nil {
-			return nil, err
+			return err
 		}
 		secretItem = keyring.Item{
 			Key:  masterKey,
 			Data: []byte(base64.StdEncoding.EncodeToString(secret)),
 		}
 		if err := ring.Set(secretItem); err != nil {
-			return nil, err
+			return err
 		}
 	default:
-		return nil, fmt.Errorf("failed read master key from %q keyring: %w", auth.Name, err)
+		return fmt.Errorf("failed read master key from %q keyring: %w", name, err)
 	}
 	aead, err := xaes256gcm.NewWithManualNonces(secret)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	k := Keyring{auth.Name, namespace, aead}
-	rings[auth.Name] = k
-	return &k, nil
+	rings[name] = Keyring{ring: name, aead: aead}
+	return nil
 }
 
 // Keyring provides a per-provider view of a keyring.
@@ -103,7 +114,11 @@ func (k *Keyring) Get(key string) (item keyring.Item, err error) {
 		Ns:   k.namespace,
 		Key:  key,
 	})
-	if err != nil {
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return item, keyring.ErrKeyNotFound
+	default:
 		return item, err
 	}
 	item.Key = key
@@ -0,0 +1,72 @@
+package simp
+
+import (
+	"iter"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// BatchInputs is a one-pass iterator over the batch inputs, so that the
+// batches wouldn't have to be held in memory all at once.
+//
+// The iteration stops on the first error.
+type BatchInputs iter.Seq2[openai.BatchInput, error]
+
+// SliceInputs iterates over the inputs already in memory.
+func SliceInputs(inputs []openai.BatchInput) BatchInputs {
+	return func(yield func(openai.BatchInput, error) bool) {
+		for _, input := range inputs {
+			if !yield(input, nil) {
+				return
+			}
+		}
+	}
+}
+
+// BatchLimits are the constraints that the provider imposes on a single
+// batch; zero means there's no such limit.
+type BatchLimits struct {
+	// Requests is the maximum number of requests in a batch.
+	Requests int
+	// Bytes is the maximum size of the batch file, in JSONL.
+	Bytes int64
+	// Tokens is the maximum number of input tokens in a batch.
+	Tokens int64
+}
+
+// Exceeds tells whether a batch of this many requests, bytes, and tokens
+// would not fit the limits.
+func (l BatchLimits) Exceeds(requests int, bytes, tokens int64) bool {
+	return (l.Requests > 0 && requests > l.Requests) ||
+		(l.Bytes > 0 && bytes > l.Bytes) ||
+		(l.Tokens > 0 && tokens > l.Tokens)
+}
+
+// EstimateTokens is a rough estimate of the input tokens in the request,
+// short of running the actual tokenizer: a token is about four characters
+// of text, and an image is about as much as a high-detail tile.
+func EstimateTokens(input openai.BatchInput) int64 {
+	const image = 765
+
+	var chars, tokens int64
+	switch {
+	case input.ChatCompletion != nil:
+		for _, m := range input.ChatCompletion.Messages {
+			chars += int64(len(m.Content))
+			for _, part := range m.MultiContent {
+				chars += int64(len(part.Text))
+				if part.ImageURL != nil {
+					tokens += image
+				}
+			}
+		}
+	case input.Embedding != nil:
+		for _, in := range input.Embedding.Input {
+			chars += int64(len(in.Text))
+			if in.Image != "" {
+				tokens += image
+			}
+		}
+	}
+	return tokens + (chars+3)/4
+}
@@ -17,9 +17,17 @@ func BatchUpdates(batch openai.Batch) (upd UpdateBatchParams) {
 		t := time.Unix(batch.CancelledAt, 0)
 		upd.CanceledAt = &t
 	}
+	if batch.ExpiredAt != 0 {
+		t := time.Unix(batch.ExpiredAt, 0)
+		upd.CanceledAt = &t
+	}
 	if batch.CompletedAt != 0 {
 		t := time.Unix(batch.CompletedAt, 0)
 		upd.CompletedAt = &t
 	}
+	if batch.ExpiresAt != 0 {
+		t := time.Unix(batch.ExpiresAt, 0)
+		upd.ExpiresAt = &t
+	}
 	return
 }
@@ -13,7 +13,7 @@ import (
 )
 
 const batchById = `-- name: BatchById :one
-select id, super, model, body, created_at, updated_at, completed_at, canceled_at
+select id, super, model, body, created_at, updated_at, completed_at, canceled_at, received_at, expires_at, retry_of, provider, cost
 from batch
 	where id = ?
 `
@@ -30,6 +30,11 @@ func (q *Queries) BatchById(ctx context.Context, id string) (Batch, error) {
 		&i.UpdatedAt,
 		&i.CompletedAt,
 		&i.CanceledAt,
+		&i.ReceivedAt,
+		&i.ExpiresAt,
+		&i.RetryOf,
+		&i.Provider,
+		&i.Cost,
 	)
 	return i, err
 }
@@ -62,31 +67,325 @@ func (q *Queries) BatchOps(ctx context.Context, batch string) ([]openai.BatchInp
 }
 
 const batchOpsCompleted = `-- name: BatchOpsCompleted :many
-select response
+select seq, response
 from batch_op
-where batch = ? and completed_at is not null
-limit ? offset ?
+where batch in (select id from batch where id = ?1 or super = ?1)
+	and completed_at is not null
+	and retried_at is null
+	and (json_extract(response, '$.error') is not null or coalesce(json_extract(response, '$.response.status_code'), 200) != 200) = ?2
+	and seq > cast(?3 as integer)
+	and seq <= cast(?4 as integer)
+order by seq
+limit ?5
 `
 
 type BatchOpsCompletedParams struct {
 	Batch  string `db:"batch" json:"batch"`
+	Failed bool   `db:"failed" json:"failed"`
+	After  int64  `db:"after" json:"after"`
+	Until  int64  `db:"until" json:"until"`
 	Limit  int64  `db:"limit" json:"limit"`
-	Offset int64  `db:"offset" json:"offset"`
 }
 
-func (q *Queries) BatchOpsCompleted(ctx context.Context, arg BatchOpsCompletedParams) ([]openai.BatchOutput, error) {
-	rows, err := q.db.QueryContext(ctx, batchOpsCompleted, arg.Batch, arg.Limit, arg.Offset)
+type BatchOpsCompletedRow struct {
+	Seq      *int64             `db:"seq" json:"seq"`
+	Response openai.BatchOutput `db:"response" json:"response"`
+}
+
+func (q *Queries) BatchOpsCompleted(ctx context.Context, arg BatchOpsCompletedParams) ([]BatchOpsCompletedRow, error) {
+	rows, err := q.db.QueryContext(ctx, batchOpsCompleted,
+		arg.Batch,
+		arg.Failed,
+		arg.After,
+		arg.Until,
+		arg.Limit,
+	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []openai.BatchOutput
+	var items []BatchOpsCompletedRow
 	for rows.Next() {
-		var response openai.BatchOutput
-		if err := rows.Scan(&response); err != nil {
+		var i BatchOpsCompletedRow
+		if err := rows.Scan(&i.Seq, &i.Response); err != nil {
 			return nil, err
 		}
-		items = append(items, response)
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const batchSeq = `-- name: BatchSeq :one
+select cast(coalesce(max(seq), 0) as integer) as seq
+from batch_op
+where batch in (select id from batch where id = ?1 or super = ?1)
+`
+
+func (q *Queries) BatchSeq(ctx context.Context, batch string) (int64, error) {
+	row := q.db.QueryRowContext(ctx, batchSeq, batch)
+	var seq int64
+	err := row.Scan(&seq)
+	return seq, err
+}
+
+const batchOpsPending = `-- name: BatchOpsPending :many
+select batch, custom_id, request, response, implicit, deferred, created_at, updated_at, completed_at, canceled_at, retried_at, seq, started_at
+from (
+	select batch_op.batch, batch_op.custom_id, batch_op.request, batch_op.response, batch_op.implicit, batch_op.deferred, batch_op.created_at, batch_op.updated_at, batch_op.completed_at, batch_op.canceled_at, batch_op.retried_at, batch_op.seq, batch_op.started_at, row_number() over (
+			partition by json_extract(batch_op.request, '$.body.model')
+			order by batch_op.created_at
+		) as lane
+	from batch_op
+		join batch on batch.id = batch_op.batch
+	where batch_op.implicit
+		and batch_op.started_at is null
+		and batch_op.completed_at is null
+		and batch_op.canceled_at is null
+		and json_extract(batch.body, '$.status') = 'in_progress'
+)
+where lane <= ?
+order by created_at
+`
+
+// the oldest pending ops of every model, up to the limit each
+func (q *Queries) BatchOpsPending(ctx context.Context, limit int64) ([]BatchOp, error) {
+	rows, err := q.db.QueryContext(ctx, batchOpsPending, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []BatchOp
+	for rows.Next() {
+		var i BatchOp
+		if err := rows.Scan(
+			&i.Batch,
+			&i.CustomID,
+			&i.Request,
+			&i.Response,
+			&i.Implicit,
+			&i.Deferred,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.CompletedAt,
+			&i.CanceledAt,
+			&i.RetriedAt,
+			&i.Seq,
+			&i.StartedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const batchOpsRetryable = `-- name: BatchOpsRetryable :many
+select request
+from batch_op
+where batch = ?
+	and not implicit
+	and retried_at is null
+	and (completed_at is null or (json_extract(response, '$.error') is not null or coalesce(json_extract(response, '$.response.status_code'), 200) != 200))
+`
+
+func (q *Queries) BatchOpsRetryable(ctx context.Context, batch string) ([]openai.BatchInput, error) {
+	rows, err := q.db.QueryContext(ctx, batchOpsRetryable, batch)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []openai.BatchInput
+	for rows.Next() {
+		var request openai.BatchInput
+		if err := rows.Scan(&request); err != nil {
+			return nil, err
+		}
+		items = append(items, request)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const batchOpsSucceeded = `-- name: BatchOpsSucceeded :many
+select custom_id
+from batch_op
+where batch = ?
+	and completed_at is not null
+	and not (json_extract(response, '$.error') is not null or coalesce(json_extract(response, '$.response.status_code'), 200) != 200)
+`
+
+func (q *Queries) BatchOpsSucceeded(ctx context.Context, batch string) ([]string, error) {
+	rows, err := q.db.QueryContext(ctx, batchOpsSucceeded, batch)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var custom_id string
+		if err := rows.Scan(&custom_id); err != nil {
+			return nil, err
+		}
+		items = append(items, custom_id)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const batchesExpired = `-- name: BatchesExpired :many
+select id, super, model, body, created_at, updated_at, completed_at, canceled_at, received_at, expires_at, retry_of, provider, cost
+from batch
+	where super is null
+		and completed_at is null
+		and canceled_at is null
+		and datetime(expires_at) < current_timestamp
+`
+
+func (q *Queries) BatchesExpired(ctx context.Context) ([]Batch, error) {
+	rows, err := q.db.QueryContext(ctx, batchesExpired)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Batch
+	for rows.Next() {
+		var i Batch
+		if err := rows.Scan(
+			&i.ID,
+			&i.Super,
+			&i.Model,
+			&i.Body,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.CompletedAt,
+			&i.CanceledAt,
+			&i.ReceivedAt,
+			&i.ExpiresAt,
+			&i.RetryOf,
+			&i.Provider,
+			&i.Cost,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const batchesInProgress = `-- name: BatchesInProgress :many
+select id, super, model, body, created_at, updated_at, completed_at, canceled_at, received_at, expires_at, retry_of, provider, cost
+from batch
+	where super is null
+		and completed_at is null
+		and canceled_at is null
+		and json_extract(body, '$.status') = 'in_progress'
+`
+
+func (q *Queries) BatchesInProgress(ctx context.Context) ([]Batch, error) {
+	rows, err := q.db.QueryContext(ctx, batchesInProgress)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Batch
+	for rows.Next() {
+		var i Batch
+		if err := rows.Scan(
+			&i.ID,
+			&i.Super,
+			&i.Model,
+			&i.Body,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.CompletedAt,
+			&i.CanceledAt,
+			&i.ReceivedAt,
+			&i.ExpiresAt,
+			&i.RetryOf,
+			&i.Provider,
+			&i.Cost,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const batchesInterrupted = `-- name: BatchesInterrupted :many
+select id, super, model, body, created_at, updated_at, completed_at, canceled_at, received_at, expires_at, retry_of, provider, cost
+from batch
+	where super is null
+		and completed_at is null
+		and canceled_at is null
+		and coalesce(json_extract(body, '$.status'), '') = ''
+		and exists (
+			select 1 from batch sub
+			where sub.super = batch.id
+				and coalesce(json_extract(sub.body, '$.status'), '') != '')
+`
+
+func (q *Queries) BatchesInterrupted(ctx context.Context) ([]Batch, error) {
+	rows, err := q.db.QueryContext(ctx, batchesInterrupted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Batch
+	for rows.Next() {
+		var i Batch
+		if err := rows.Scan(
+			&i.ID,
+			&i.Super,
+			&i.Model,
+			&i.Body,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.CompletedAt,
+			&i.CanceledAt,
+			&i.ReceivedAt,
+			&i.ExpiresAt,
+			&i.RetryOf,
+			&i.Provider,
+			&i.Cost,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
 	}
 	if err := rows.Close(); err != nil {
 		return nil, err
@@ -119,6 +418,26 @@ func (q *Queries) CancelBatchOps(ctx context.Context, id string) error {
 	return err
 }
 
+const completeBatchOp = `-- name: CompleteBatchOp :exec
+update batch_op
+set response = ?,
+	updated_at = current_timestamp,
+	completed_at = current_timestamp,
+	seq = (select coalesce(max(seq), 0) + 1 from batch_op)
+where batch = ? and custom_id = ? and completed_at is null and canceled_at is null
+`
+
+type CompleteBatchOpParams struct {
+	Response openai.BatchOutput `db:"response" json:"response"`
+	Batch    string             `db:"batch" json:"batch"`
+	CustomID string             `db:"custom_id" json:"custom_id"`
+}
+
+func (q *Queries) CompleteBatchOp(ctx context.Context, arg CompleteBatchOpParams) error {
+	_, err := q.db.ExecContext(ctx, completeBatchOp, arg.Response, arg.Batch, arg.CustomID)
+	return err
+}
+
 const countBatchOps = `-- name: CountBatchOps :one
 select
 	count(*) as total,
@@ -141,6 +460,28 @@ func (q *Queries) CountBatchOps(ctx context.Context, batch string) (CountBatchOp
 	return i, err
 }
 
+const countBatchOutputs = `-- name: CountBatchOutputs :one
+select
+	count(*) filter (where not (json_extract(response, '$.error') is not null or coalesce(json_extract(response, '$.response.status_code'), 200) != 200)) as completed,
+	count(*) filter (where (json_extract(response, '$.error') is not null or coalesce(json_extract(response, '$.response.status_code'), 200) != 200)) as failed
+from batch_op
+where batch in (select id from batch where id = ?1 or super = ?1)
+	and completed_at is not null
+	and retried_at is null
+`
+
+type CountBatchOutputsRow struct {
+	Completed int64 `db:"completed" json:"completed"`
+	Failed    int64 `db:"failed" json:"failed"`
+}
+
+func (q *Queries) CountBatchOutputs(ctx context.Context, batch string) (CountBatchOutputsRow, error) {
+	row := q.db.QueryRowContext(ctx, countBatchOutputs, batch)
+	var i CountBatchOutputsRow
+	err := row.Scan(&i.Completed, &i.Failed)
+	return i, err
+}
+
 const deleteBatchOps = `-- name: DeleteBatchOps :exec
 delete from batch_op where batch = ?
 `
@@ -162,15 +503,18 @@ func (q *Queries) Epoch(ctx context.Context) (int64, error) {
 }
 
 const insertBatch = `-- name: InsertBatch :exec
-insert into batch (id, super, model, body)
-	values (?, ?, ?, ?)
+insert into batch (id, super, model, body, retry_of, provider, cost)
+	values (?, ?, ?, ?, ?, ?, ?)
 `
 
 type InsertBatchParams struct {
-	ID    string       `db:"id" json:"id"`
-	Super *string      `db:"super" json:"super"`
-	Model string       `db:"model" json:"model"`
-	Body  openai.Batch `db:"body" json:"body"`
+	ID       string       `db:"id" json:"id"`
+	Super    *string      `db:"super" json:"super"`
+	Model    string       `db:"model" json:"model"`
+	Body     openai.Batch `db:"body" json:"body"`
+	RetryOf  *string      `db:"retry_of" json:"retry_of"`
+	Provider *string      `db:"provider" json:"provider"`
+	Cost     *float64     `db:"cost" json:"cost"`
 }
 
 func (q *Queries) InsertBatch(ctx context.Context, arg InsertBatchParams) error {
@@ -179,6 +523,9 @@ func (q *Queries) InsertBatch(ctx context.Context, arg InsertBatchParams) error
 		arg.Super,
 		arg.Model,
 		arg.Body,
+		arg.RetryOf,
+		arg.Provider,
+		arg.Cost,
 	)
 	return err
 }
@@ -207,8 +554,249 @@ func (q *Queries) InsertBatchOp(ctx context.Context, arg InsertBatchOpParams) er
 	return err
 }
 
+const insertBatchOutput = `-- name: InsertBatchOutput :exec
+insert into batch_op (batch, custom_id, request, response, implicit, deferred, completed_at, seq)
+	values (?, ?, ?, ?, false, false, current_timestamp, (select coalesce(max(seq), 0) + 1 from batch_op))
+	on conflict (batch, custom_id)
+		do update set
+			response = excluded.response,
+			updated_at = current_timestamp,
+			completed_at = current_timestamp,
+			seq = excluded.seq
+`
+
+type InsertBatchOutputParams struct {
+	Batch    string             `db:"batch" json:"batch"`
+	CustomID string             `db:"custom_id" json:"custom_id"`
+	Request  openai.BatchInput  `db:"request" json:"request"`
+	Response openai.BatchOutput `db:"response" json:"response"`
+}
+
+func (q *Queries) InsertBatchOutput(ctx context.Context, arg InsertBatchOutputParams) error {
+	_, err := q.db.ExecContext(ctx, insertBatchOutput,
+		arg.Batch,
+		arg.CustomID,
+		arg.Request,
+		arg.Response,
+	)
+	return err
+}
+
+const latestBatchErrors = `-- name: LatestBatchErrors :many
+select response
+from batch_op
+where batch in (select id from batch where id = ?1 or super = ?1)
+	and completed_at is not null
+	and retried_at is null
+	and (json_extract(response, '$.error') is not null or coalesce(json_extract(response, '$.response.status_code'), 200) != 200)
+order by completed_at desc
+limit ?2
+`
+
+type LatestBatchErrorsParams struct {
+	Batch string `db:"batch" json:"batch"`
+	Limit int64  `db:"limit" json:"limit"`
+}
+
+func (q *Queries) LatestBatchErrors(ctx context.Context, arg LatestBatchErrorsParams) ([]openai.BatchOutput, error) {
+	rows, err := q.db.QueryContext(ctx, latestBatchErrors, arg.Batch, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []openai.BatchOutput
+	for rows.Next() {
+		var response openai.BatchOutput
+		if err := rows.Scan(&response); err != nil {
+			return nil, err
+		}
+		items = append(items, response)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listBatches = `-- name: ListBatches :many
+select id, super, model, body, created_at, updated_at, completed_at, canceled_at, received_at, expires_at, retry_of, provider, cost
+from batch
+where super is null
+	and (?1 = '' or rowid < (select rowid from batch where id = ?1))
+	and (?2 = '' or json_extract(body, '$.status') = ?2)
+	and (?3 = ''
+		or exists (select 1 from batch sub where sub.super = batch.id
+			and sub.model in (select value from json_each(?3)))
+		or exists (select 1 from batch_op op where op.batch = batch.id
+			and json_extract(op.request, '$.body.model') in (select value from json_each(?3))))
+	and not exists (
+		select 1 from json_each(coalesce(nullif(?4, ''), '{}')) m
+		where cast(json_extract(body, '$.metadata."' || m.key || '"') as text) is not m.value)
+order by rowid desc
+limit ?5
+`
+
+type ListBatchesParams struct {
+	After    string `db:"after" json:"after"`
+	Status   string `db:"status" json:"status"`
+	Models   string `db:"models" json:"models"`
+	Metadata string `db:"metadata" json:"metadata"`
+	Limit    int64  `db:"limit" json:"limit"`
+}
+
+func (q *Queries) ListBatches(ctx context.Context, arg ListBatchesParams) ([]Batch, error) {
+	rows, err := q.db.QueryContext(ctx, listBatches,
+		arg.After,
+		arg.Status,
+		arg.Models,
+		arg.Metadata,
+		arg.Limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Batch
+	for rows.Next() {
+		var i Batch
+		if err := rows.Scan(
+			&i.ID,
+			&i.Super,
+			&i.Model,
+			&i.Body,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.CompletedAt,
+			&i.CanceledAt,
+			&i.ReceivedAt,
+			&i.ExpiresAt,
+			&i.RetryOf,
+			&i.Provider,
+			&i.Cost,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const receiveBatch = `-- name: ReceiveBatch :execrows
+update batch
+	set received_at = current_timestamp
+	where id = ? and received_at is null
+`
+
+func (q *Queries) ReceiveBatch(ctx context.Context, id string) (int64, error) {
+	result, err := q.db.ExecContext(ctx, receiveBatch, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const resetBatchOps = `-- name: ResetBatchOps :execrows
+update batch_op
+	set started_at = null
+	where started_at is not null
+		and completed_at is null
+`
+
+func (q *Queries) ResetBatchOps(ctx context.Context) (int64, error) {
+	result, err := q.db.ExecContext(ctx, resetBatchOps)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const retireBatchOps = `-- name: RetireBatchOps :exec
+update batch_op
+	set retried_at = current_timestamp
+	where batch = ?
+		and not implicit
+		and retried_at is null
+		and (completed_at is null or (json_extract(response, '$.error') is not null or coalesce(json_extract(response, '$.response.status_code'), 200) != 200))
+`
+
+func (q *Queries) RetireBatchOps(ctx context.Context, batch string) error {
+	_, err := q.db.ExecContext(ctx, retireBatchOps, batch)
+	return err
+}
+
+const retryBatchOps = `-- name: RetryBatchOps :execrows
+update batch_op
+	set response = null,
+		updated_at = current_timestamp,
+		completed_at = null,
+		started_at = null,
+		seq = null
+	where batch = ?
+		and implicit
+		and completed_at is not null
+		and (json_extract(response, '$.error') is not null or coalesce(json_extract(response, '$.response.status_code'), 200) != 200)
+`
+
+func (q *Queries) RetryBatchOps(ctx context.Context, batch string) (int64, error) {
+	result, err := q.db.ExecContext(ctx, retryBatchOps, batch)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const startBatchOp = `-- name: StartBatchOp :execrows
+update batch_op
+	set started_at = current_timestamp
+	where batch = ?
+		and custom_id = ?
+		and started_at is null
+		and completed_at is null
+		and canceled_at is null
+`
+
+type StartBatchOpParams struct {
+	Batch    string `db:"batch" json:"batch"`
+	CustomID string `db:"custom_id" json:"custom_id"`
+}
+
+func (q *Queries) StartBatchOp(ctx context.Context, arg StartBatchOpParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, startBatchOp, arg.Batch, arg.CustomID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const unstartBatchOp = `-- name: UnstartBatchOp :exec
+update batch_op
+	set started_at = null
+	where batch = ?
+		and custom_id = ?
+		and completed_at is null
+`
+
+type UnstartBatchOpParams struct {
+	Batch    string `db:"batch" json:"batch"`
+	CustomID string `db:"custom_id" json:"custom_id"`
+}
+
+func (q *Queries) UnstartBatchOp(ctx context.Context, arg UnstartBatchOpParams) error {
+	_, err := q.db.ExecContext(ctx, unstartBatchOp, arg.Batch, arg.CustomID)
+	return err
+}
+
 const subBatches = `-- name: SubBatches :many
-select id, super, model, body, created_at, updated_at, completed_at, canceled_at
+select id, super, model, body, created_at, updated_at, completed_at, canceled_at, received_at, expires_at, retry_of, provider, cost
 from batch
 	where super = ?
 `
@@ -231,6 +819,11 @@ func (q *Queries) SubBatches(ctx context.Context, super *string) ([]Batch, error
 			&i.UpdatedAt,
 			&i.CompletedAt,
 			&i.CanceledAt,
+			&i.ReceivedAt,
+			&i.ExpiresAt,
+			&i.RetryOf,
+			&i.Provider,
+			&i.Cost,
 		); err != nil {
 			return nil, err
 		}
@@ -246,7 +839,7 @@ func (q *Queries) SubBatches(ctx context.Context, super *string) ([]Batch, error
 }
 
 const subBatchesCompleted = `-- name: SubBatchesCompleted :many
-select id, super, model, body, created_at, updated_at, completed_at, canceled_at
+select id, super, model, body, created_at, updated_at, completed_at, canceled_at, received_at, expires_at, retry_of, provider, cost
 from batch
 	where super = ?
 		and completed_at is not null
@@ -270,6 +863,11 @@ func (q *Queries) SubBatchesCompleted(ctx context.Context, super *string) ([]Bat
 			&i.UpdatedAt,
 			&i.CompletedAt,
 			&i.CanceledAt,
+			&i.ReceivedAt,
+			&i.ExpiresAt,
+			&i.RetryOf,
+			&i.Provider,
+			&i.Cost,
 		); err != nil {
 			return nil, err
 		}
@@ -285,7 +883,7 @@ func (q *Queries) SubBatchesCompleted(ctx context.Context, super *string) ([]Bat
 }
 
 const subBatchesPending = `-- name: SubBatchesPending :many
-select id, super, model, body, created_at, updated_at, completed_at, canceled_at
+select id, super, model, body, created_at, updated_at, completed_at, canceled_at, received_at, expires_at, retry_of, provider, cost
 from batch
 	where super = ?
 		and completed_at is null
@@ -310,6 +908,57 @@ func (q *Queries) SubBatchesPending(ctx context.Context, super *string) ([]Batch
 			&i.UpdatedAt,
 			&i.CompletedAt,
 			&i.CanceledAt,
+			&i.ReceivedAt,
+			&i.ExpiresAt,
+			&i.RetryOf,
+			&i.Provider,
+			&i.Cost,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const subBatchesSending = `-- name: SubBatchesSending :many
+select id, super, model, body, created_at, updated_at, completed_at, canceled_at, received_at, expires_at, retry_of, provider, cost
+from batch
+	where super is not null
+		and completed_at is null
+		and canceled_at is null
+		and json_extract(body, '$.status') = 'validating'
+`
+
+func (q *Queries) SubBatchesSending(ctx context.Context) ([]Batch, error) {
+	rows, err := q.db.QueryContext(ctx, subBatchesSending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Batch
+	for rows.Next() {
+		var i Batch
+		if err := rows.Scan(
+			&i.ID,
+			&i.Super,
+			&i.Model,
+			&i.Body,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.CompletedAt,
+			&i.CanceledAt,
+			&i.ReceivedAt,
+			&i.ExpiresAt,
+			&i.RetryOf,
+			&i.Provider,
+			&i.Cost,
 		); err != nil {
 			return nil, err
 		}
@@ -329,7 +978,8 @@ update batch
 set body = ?,
 	updated_at = current_timestamp,
 	canceled_at = ?,
-	completed_at = ?
+	completed_at = ?,
+	expires_at = ?
 where id = ?
 `
 
@@ -337,6 +987,7 @@ type UpdateBatchParams struct {
 	Body        openai.Batch `db:"body" json:"body"`
 	CanceledAt  *time.Time   `db:"canceled_at" json:"canceled_at"`
 	CompletedAt *time.Time   `db:"completed_at" json:"completed_at"`
+	ExpiresAt   *time.Time   `db:"expires_at" json:"expires_at"`
 	ID          string       `db:"id" json:"id"`
 }
 
@@ -345,6 +996,7 @@ func (q *Queries) UpdateBatch(ctx context.Context, arg UpdateBatchParams) error
 		arg.Body,
 		arg.CanceledAt,
 		arg.CompletedAt,
+		arg.ExpiresAt,
 		arg.ID,
 	)
 	return err
@@ -2,10 +2,14 @@ package books
 
 import (
 	"bytes"
+	"context"
 	_ "embed"
 	"encoding/json"
+	"fmt"
 	"io"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	openai "github.com/sashabaranov/go-openai"
@@ -70,3 +74,479 @@ eof:
 		t.Fatal(diff)
 	}
 }
+
+func open(t *testing.T) *Queries {
+	if err := Open(filepath.Join(t.TempDir(), "books.db3")); err != nil {
+		t.Fatal(err)
+	}
+	return Session()
+}
+
+func TestBatchOpsPending(t *testing.T) {
+	ctx := context.Background()
+	book := open(t)
+
+	for _, b := range []openai.Batch{
+		{ID: "sent", Status: openai.BatchStatusInProgress},
+		{ID: "unsent"},
+	} {
+		if err := book.InsertBatch(ctx, InsertBatchParams{ID: b.ID, Body: b}); err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range []string{"a", "b"} {
+			err := book.InsertBatchOp(ctx, InsertBatchOpParams{
+				Batch:    b.ID,
+				CustomID: id,
+				Request:  openai.BatchInput{CustomID: id},
+				Implicit: true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	err := book.CompleteBatchOp(ctx, CompleteBatchOpParams{
+		Response: openai.BatchOutput{CustomID: "a"},
+		Batch:    "sent",
+		CustomID: "a",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops, err := book.BatchOpsPending(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 1 || ops[0].Batch != "sent" || ops[0].CustomID != "b" {
+		t.Fatalf("unexpected pending ops: %+v", ops)
+	}
+	// the op that was started, and let go of, is pending again
+	op := StartBatchOpParams{Batch: "sent", CustomID: "b"}
+	if n, err := book.StartBatchOp(ctx, op); err != nil || n != 1 {
+		t.Fatalf("start: %d %v", n, err)
+	}
+	if ops, _ := book.BatchOpsPending(ctx, 10); len(ops) != 0 {
+		t.Fatalf("started ops are pending: %+v", ops)
+	}
+	if err := book.UnstartBatchOp(ctx, UnstartBatchOpParams(op)); err != nil {
+		t.Fatal(err)
+	}
+	if ops, _ := book.BatchOpsPending(ctx, 10); len(ops) != 1 {
+		t.Fatalf("unstarted ops are not pending: %+v", ops)
+	}
+	counts, err := book.CountBatchOps(ctx, "sent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts.Total != 2 || counts.Completed != 1 {
+		t.Fatalf("unexpected counts: %+v", counts)
+	}
+	// the backlog of one model would not crowd out the other
+	for i, model := range []string{"slow", "slow", "slow", "fast"} {
+		id := fmt.Sprintf("%s-%d", model, i)
+		err := book.InsertBatchOp(ctx, InsertBatchOpParams{
+			Batch:    "sent",
+			CustomID: id,
+			Request: openai.BatchInput{
+				CustomID:       id,
+				URL:            openai.BatchEndpointChatCompletions,
+				ChatCompletion: &openai.ChatCompletionRequest{Model: model},
+			},
+			Implicit: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ops, err = book.BatchOpsPending(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lanes := map[string]int{}
+	for _, op := range ops {
+		lanes[op.Request.Model()]++
+	}
+	if lanes["slow"] != 2 || lanes["fast"] != 1 {
+		t.Fatalf("unexpected lanes: %v", lanes)
+	}
+}
+
+func TestListBatches(t *testing.T) {
+	ctx := context.Background()
+	book := open(t)
+
+	for _, b := range []openai.Batch{
+		{ID: "1", Status: openai.BatchStatusCompleted, Metadata: map[string]any{"job": "x"}},
+		{ID: "2", Status: openai.BatchStatusInProgress},
+		{ID: "3", Status: openai.BatchStatusInProgress, Metadata: map[string]any{"job": "x", "set": "y"}},
+	} {
+		if err := book.InsertBatch(ctx, InsertBatchParams{ID: b.ID, Body: b}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	super := "2"
+	err := book.InsertBatch(ctx, InsertBatchParams{
+		ID:    "2a",
+		Super: &super,
+		Model: "gpt-4o",
+		Body:  openai.Batch{ID: "2a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := func(rows []Batch) (ids []string) {
+		for _, row := range rows {
+			ids = append(ids, row.ID)
+		}
+		return
+	}
+	tests := []struct {
+		params ListBatchesParams
+		want   []string
+	}{
+		{ListBatchesParams{Limit: 10}, []string{"3", "2", "1"}},
+		{ListBatchesParams{Limit: 1}, []string{"3"}},
+		{ListBatchesParams{After: "3", Limit: 10}, []string{"2", "1"}},
+		{ListBatchesParams{Status: "in_progress", Limit: 10}, []string{"3", "2"}},
+		{ListBatchesParams{Models: `["4o","gpt-4o"]`, Limit: 10}, []string{"2"}},
+		{ListBatchesParams{Models: `["4o"]`, Limit: 10}, nil},
+		{ListBatchesParams{Metadata: `{"job":"x"}`, Limit: 10}, []string{"3", "1"}},
+		{ListBatchesParams{Metadata: `{"job":"x","set":"y"}`, Limit: 10}, []string{"3"}},
+		{ListBatchesParams{Metadata: `{"job":"z"}`, Limit: 10}, nil},
+	}
+	for _, test := range tests {
+		rows, err := book.ListBatches(ctx, test.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(test.want, ids(rows)); diff != "" {
+			t.Errorf("%+v: %s", test.params, diff)
+		}
+	}
+}
+
+func TestBatchOutputs(t *testing.T) {
+	ctx := context.Background()
+	book := open(t)
+
+	super := "super"
+	for _, id := range []string{super, "sub"} {
+		p := InsertBatchParams{ID: id, Body: openai.Batch{ID: id}}
+		if id != super {
+			p.Super = &super
+		}
+		if err := book.InsertBatch(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	outputs := []InsertBatchOutputParams{
+		{Batch: "sub", CustomID: "a"},
+		{Batch: "sub", CustomID: "b", Response: openai.BatchOutput{
+			Error: &openai.APIError{Message: "bad"},
+		}},
+		{Batch: super, CustomID: "c"},
+	}
+	for _, output := range outputs {
+		output.Request = openai.BatchInput{CustomID: output.CustomID}
+		output.Response.CustomID = output.CustomID
+		if err := book.InsertBatchOutput(ctx, output); err != nil {
+			t.Fatal(err)
+		}
+	}
+	counts, err := book.CountBatchOutputs(ctx, super)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts.Completed != 2 || counts.Failed != 1 {
+		t.Fatalf("unexpected counts: %+v", counts)
+	}
+	until, err := book.BatchSeq(ctx, super)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if until != 3 {
+		t.Fatalf("cursor is %d, want 3", until)
+	}
+	for _, failed := range []bool{false, true} {
+		got, err := book.BatchOpsCompleted(ctx, BatchOpsCompletedParams{
+			Batch:  super,
+			Failed: failed,
+			Until:  until,
+			Limit:  10,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, output := range got {
+			if (output.Response.Error != nil) != failed {
+				t.Errorf("failed=%v: unexpected output %+v", failed, output)
+			}
+		}
+		if want := map[bool]int{false: 2, true: 1}[failed]; len(got) != want {
+			t.Errorf("failed=%v: got %d outputs, want %d", failed, len(got), want)
+		}
+	}
+	// the partial download picks up where it left off
+	err = book.InsertBatchOutput(ctx, InsertBatchOutputParams{
+		Batch:    super,
+		CustomID: "d",
+		Request:  openai.BatchInput{CustomID: "d"},
+		Response: openai.BatchOutput{CustomID: "d"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := book.BatchSeq(ctx, super)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := book.BatchOpsCompleted(ctx, BatchOpsCompletedParams{
+		Batch: super,
+		After: until,
+		Until: next,
+		Limit: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Response.CustomID != "d" {
+		t.Fatalf("unexpected outputs after the cursor: %+v", got)
+	}
+	// the lines of the error file may have no error, but the status code
+	err = book.InsertBatchOutput(ctx, InsertBatchOutputParams{
+		Batch:    "sub",
+		CustomID: "e",
+		Request:  openai.BatchInput{CustomID: "e"},
+		Response: openai.BatchOutput{CustomID: "e"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = DB.ExecContext(ctx, `update batch_op
+		set response = json_set(response, '$.response', json('{"status_code":400}'))
+		where custom_id = 'e'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts, err = book.CountBatchOutputs(ctx, super)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts.Completed != 3 || counts.Failed != 2 {
+		t.Fatalf("unexpected counts with the status code: %+v", counts)
+	}
+	got, err = book.BatchOpsCompleted(ctx, BatchOpsCompletedParams{
+		Batch:  super,
+		Failed: true,
+		Until:  next + 1,
+		Limit:  10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d failed outputs, want 2", len(got))
+	}
+}
+
+func TestBatchesExpired(t *testing.T) {
+	ctx := context.Background()
+	book := open(t)
+
+	now := time.Now()
+	for _, b := range []openai.Batch{
+		{ID: "overdue", ExpiresAt: now.Add(-time.Minute).Unix()},
+		{ID: "due", ExpiresAt: now.Add(time.Hour).Unix()},
+		{ID: "unsent"},
+		{ID: "done", ExpiresAt: now.Add(-time.Minute).Unix(), CompletedAt: now.Unix()},
+	} {
+		if err := book.InsertBatch(ctx, InsertBatchParams{ID: b.ID, Body: b}); err != nil {
+			t.Fatal(err)
+		}
+		if err := book.UpdateBatch(ctx, BatchUpdates(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows, err := book.BatchesExpired(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].ID != "overdue" || rows[0].ExpiresAt == nil {
+		t.Fatalf("unexpected expired batches: %+v", rows)
+	}
+}
+
+func TestReceiveBatch(t *testing.T) {
+	ctx := context.Background()
+	book := open(t)
+
+	if err := book.InsertBatch(ctx, InsertBatchParams{ID: "sub"}); err != nil {
+		t.Fatal(err)
+	}
+	// only the first receive is the one to count
+	for i, want := range []int64{1, 0} {
+		n, err := book.ReceiveBatch(ctx, "sub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("receive/%d: %d rows, want %d", i, n, want)
+		}
+	}
+}
+
+func TestBatchOpsRetry(t *testing.T) {
+	ctx := context.Background()
+	book := open(t)
+
+	super, sub := "super", "sub"
+	for _, p := range []InsertBatchParams{
+		{ID: super, Body: openai.Batch{ID: super}},
+		{ID: sub, Super: &super, Body: openai.Batch{ID: sub}},
+	} {
+		if err := book.InsertBatch(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, op := range []InsertBatchOpParams{
+		{Batch: sub, CustomID: "ok"},
+		{Batch: sub, CustomID: "bad"},
+		{Batch: sub, CustomID: "lost"},
+		{Batch: super, CustomID: "implicit", Implicit: true},
+	} {
+		op.Request = openai.BatchInput{CustomID: op.CustomID}
+		if err := book.InsertBatchOp(ctx, op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bad := openai.BatchOutput{Error: &openai.APIError{Message: "bad"}}
+	for _, output := range []InsertBatchOutputParams{
+		{Batch: sub, CustomID: "ok"},
+		{Batch: sub, CustomID: "bad", Response: bad},
+	} {
+		output.Request = openai.BatchInput{CustomID: output.CustomID}
+		output.Response.CustomID = output.CustomID
+		if err := book.InsertBatchOutput(ctx, output); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := book.CompleteBatchOp(ctx, CompleteBatchOpParams{
+		Response: bad,
+		Batch:    super,
+		CustomID: "implicit",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inputs, err := book.BatchOpsRetryable(ctx, sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, input := range inputs {
+		ids = append(ids, input.CustomID)
+	}
+	if diff := cmp.Diff([]string{"bad", "lost"}, ids); diff != "" {
+		t.Fatal(diff)
+	}
+	if err := book.RetireBatchOps(ctx, sub); err != nil {
+		t.Fatal(err)
+	}
+	if inputs, _ := book.BatchOpsRetryable(ctx, sub); len(inputs) != 0 {
+		t.Fatalf("retired ops are still retryable: %+v", inputs)
+	}
+	n, err := book.RetryBatchOps(ctx, super)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("retried %d implicit ops, want 1", n)
+	}
+	counts, err := book.CountBatchOutputs(ctx, super)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts.Completed != 1 || counts.Failed != 0 {
+		t.Fatalf("unexpected counts: %+v", counts)
+	}
+}
+
+func TestBatchesInterrupted(t *testing.T) {
+	ctx := context.Background()
+	book := open(t)
+
+	super := "super"
+	for _, p := range []InsertBatchParams{
+		{ID: super, Body: openai.Batch{ID: super}},
+		{ID: "sent", Super: &super, Body: openai.Batch{ID: "sent", Status: openai.BatchStatusInProgress}},
+		{ID: "sending", Super: &super, Body: openai.Batch{ID: "sending", Status: openai.BatchStatusValidating}},
+		{ID: "unsent", Super: &super, Body: openai.Batch{ID: "unsent"}},
+		{ID: "idle", Body: openai.Batch{ID: "idle"}},
+	} {
+		if err := book.InsertBatch(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows, err := book.BatchesInterrupted(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].ID != super {
+		t.Fatalf("unexpected interrupted batches: %+v", rows)
+	}
+	rows, err = book.SubBatchesSending(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].ID != "sending" {
+		t.Fatalf("unexpected sub-batches sending: %+v", rows)
+	}
+
+	for _, id := range []string{"a", "b"} {
+		err := book.InsertBatchOp(ctx, InsertBatchOpParams{
+			Batch:    super,
+			CustomID: id,
+			Request:  openai.BatchInput{CustomID: id},
+			Implicit: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := func(id string) int64 {
+		n, err := book.StartBatchOp(ctx, StartBatchOpParams{Batch: super, CustomID: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if start("a") != 1 || start("a") != 0 {
+		t.Fatal("the op was started twice")
+	}
+	if ops, _ := book.BatchOpsPending(ctx, 10); len(ops) != 0 {
+		t.Fatalf("started op is still pending: %+v", ops)
+	}
+	// the daemon dies here
+	if n, err := book.ResetBatchOps(ctx); err != nil || n != 1 {
+		t.Fatalf("reset %d ops: %v", n, err)
+	}
+	if start("a") != 1 {
+		t.Fatal("the reset op could not be started")
+	}
+	err = book.CompleteBatchOp(ctx, CompleteBatchOpParams{
+		Response: openai.BatchOutput{CustomID: "a"},
+		Batch:    super,
+		CustomID: "a",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := book.ResetBatchOps(ctx); n != 0 {
+		t.Fatalf("reset %d completed ops", n)
+	}
+	if start("a") != 0 {
+		t.Fatal("the completed op was started again")
+	}
+}
@@ -14,7 +14,7 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
-const Epoch = 2
+const Epoch = 13
 
 var DB *sql.DB
 
@@ -10,6 +10,20 @@ import (
 	openai "github.com/sashabaranov/go-openai"
 )
 
+type ApiKey struct {
+	ID        string     `db:"id" json:"id"`
+	Name      string     `db:"name" json:"name"`
+	Hash      []byte     `db:"hash" json:"hash"`
+	Scope     string     `db:"scope" json:"scope"`
+	Rpm       int64      `db:"rpm" json:"rpm"`
+	Tpm       int64      `db:"tpm" json:"tpm"`
+	Budget    *float64   `db:"budget" json:"budget"`
+	Spent     float64    `db:"spent" json:"spent"`
+	CreatedAt time.Time  `db:"created_at" json:"created_at"`
+	UsedAt    *time.Time `db:"used_at" json:"used_at"`
+	RevokedAt *time.Time `db:"revoked_at" json:"revoked_at"`
+}
+
 type Batch struct {
 	ID          string       `db:"id" json:"id"`
 	Super       *string      `db:"super" json:"super"`
@@ -19,6 +33,11 @@ type Batch struct {
 	UpdatedAt   *time.Time   `db:"updated_at" json:"updated_at"`
 	CompletedAt *time.Time   `db:"completed_at" json:"completed_at"`
 	CanceledAt  *time.Time   `db:"canceled_at" json:"canceled_at"`
+	ReceivedAt  *time.Time   `db:"received_at" json:"received_at"`
+	ExpiresAt   *time.Time   `db:"expires_at" json:"expires_at"`
+	RetryOf     *string      `db:"retry_of" json:"retry_of"`
+	Provider    *string      `db:"provider" json:"provider"`
+	Cost        *float64     `db:"cost" json:"cost"`
 }
 
 type BatchOp struct {
@@ -32,6 +51,22 @@ type BatchOp struct {
 	UpdatedAt   *time.Time         `db:"updated_at" json:"updated_at"`
 	CompletedAt *time.Time         `db:"completed_at" json:"completed_at"`
 	CanceledAt  *time.Time         `db:"canceled_at" json:"canceled_at"`
+	RetriedAt   *time.Time         `db:"retried_at" json:"retried_at"`
+	Seq         *int64             `db:"seq" json:"seq"`
+	StartedAt   *time.Time         `db:"started_at" json:"started_at"`
+}
+
+type BatchGrant struct {
+	Batch     string  `db:"batch" json:"batch"`
+	ApiKey    *string `db:"api_key" json:"api_key"`
+	Principal string  `db:"principal" json:"principal"`
+}
+
+type BatchSpool struct {
+	Batch string `db:"batch" json:"batch"`
+	Path  string `db:"path" json:"path"`
+	Off   int64  `db:"off" json:"off"`
+	Size  int64  `db:"size" json:"size"`
 }
 
 type Keyring struct {
@@ -42,6 +77,21 @@ type Keyring struct {
 	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
 }
 
+type Ledger struct {
+	ID               int64     `db:"id" json:"id"`
+	At               time.Time `db:"at" json:"at"`
+	Kind             string    `db:"kind" json:"kind"`
+	Model            string    `db:"model" json:"model"`
+	Provider         string    `db:"provider" json:"provider"`
+	Principal        string    `db:"principal" json:"principal"`
+	PromptTokens     int64     `db:"prompt_tokens" json:"prompt_tokens"`
+	CachedTokens     int64     `db:"cached_tokens" json:"cached_tokens"`
+	CompletionTokens int64     `db:"completion_tokens" json:"completion_tokens"`
+	ReasoningTokens  int64     `db:"reasoning_tokens" json:"reasoning_tokens"`
+	LatencyMs        int64     `db:"latency_ms" json:"latency_ms"`
+	Status           int64     `db:"status" json:"status"`
+}
+
 type Migration struct {
 	Epoch int64 `db:"epoch" json:"epoch"`
 }
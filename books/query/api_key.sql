@@ -0,0 +1,24 @@
+-- name: InsertAPIKey :exec
+insert into api_key (id, name, hash, scope, rpm, tpm, budget)
+	values (?, ?, ?, ?, ?, ?, ?);
+
+-- name: APIKeyByHash :one
+select *
+	from api_key
+	where hash = ? and revoked_at is null;
+
+-- name: APIKeys :many
+select *
+	from api_key
+	order by created_at;
+
+-- name: RevokeAPIKey :execrows
+update api_key
+	set revoked_at = current_timestamp
+	where (id = @key or name = @key) and revoked_at is null;
+
+-- name: SpendAPIKey :exec
+update api_key
+	set spent = spent + ?,
+		used_at = current_timestamp
+	where id = ?;
@@ -14,20 +14,87 @@ select *
 from batch
 	where super = ?
 		and completed_at is not null;
+-- name: SubBatchesSending :many
+select *
+from batch
+	where super is not null
+		and completed_at is null
+		and canceled_at is null
+		and json_extract(body, '$.status') = 'validating';
 -- name: SubBatchesPending :many
 select *
 from batch
 	where super = ?
 		and completed_at is null
 		and canceled_at is null;
+-- name: BatchesExpired :many
+select *
+from batch
+	where super is null
+		and completed_at is null
+		and canceled_at is null
+		and datetime(expires_at) < current_timestamp;
+-- name: BatchesInterrupted :many
+select *
+from batch
+	where super is null
+		and completed_at is null
+		and canceled_at is null
+		and coalesce(json_extract(body, '$.status'), '') = ''
+		and exists (
+			select 1 from batch sub
+			where sub.super = batch.id
+				and coalesce(json_extract(sub.body, '$.status'), '') != '');
+-- name: BatchesInProgress :many
+select *
+from batch
+	where super is null
+		and completed_at is null
+		and canceled_at is null
+		and json_extract(body, '$.status') = 'in_progress';
+
+-- name: ListBatches :many
+select *
+from batch
+where super is null
+	and (@after = '' or rowid < (select rowid from batch where id = @after))
+	and (@status = '' or json_extract(body, '$.status') = @status)
+	and (@models = ''
+		or exists (select 1 from batch sub where sub.super = batch.id
+			and sub.model in (select value from json_each(@models)))
+		or exists (select 1 from batch_op op where op.batch = batch.id
+			and json_extract(op.request, '$.body.model') in (select value from json_each(@models))))
+	and not exists (
+		select 1 from json_each(coalesce(nullif(@metadata, ''), '{}')) m
+		where cast(json_extract(body, '$.metadata."' || m.key || '"') as text) is not m.value)
+order by rowid desc
+limit @limit;
 
 -- name: InsertBatch :exec
-insert into batch (id, super, model, body)
-	values (?, ?, ?, ?);
+insert into batch (id, super, model, body, retry_of, provider, cost)
+	values (?, ?, ?, ?, ?, ?, ?);
 -- name: InsertBatchOp :exec
 insert into batch_op (batch, custom_id, request, implicit, deferred)
 	values (?, ?, ?, ?, ?);
+-- name: InsertBatchOutput :exec
+insert into batch_op (batch, custom_id, request, response, implicit, deferred, completed_at, seq)
+	values (?, ?, ?, ?, false, false, current_timestamp, (select coalesce(max(seq), 0) + 1 from batch_op))
+	on conflict (batch, custom_id)
+		do update set
+			response = excluded.response,
+			updated_at = current_timestamp,
+			completed_at = current_timestamp,
+			seq = excluded.seq;
 
+-- name: LatestBatchErrors :many
+select response
+from batch_op
+where batch in (select id from batch where id = @batch or super = @batch)
+	and completed_at is not null
+	and retried_at is null
+	and (json_extract(response, '$.error') is not null or coalesce(json_extract(response, '$.response.status_code'), 200) != 200)
+order by completed_at desc
+limit @limit;
 -- name: BatchOps :many
 select request from batch_op where batch = ?;
 -- name: CountBatchOps :one
@@ -37,26 +104,124 @@ select
 	count(*) filter (where canceled_at is not null) as canceled
 from batch_op
 	where batch = ?;
+-- name: CountBatchOutputs :one
+select
+	count(*) filter (where not (json_extract(response, '$.error') is not null or coalesce(json_extract(response, '$.response.status_code'), 200) != 200)) as completed,
+	count(*) filter (where (json_extract(response, '$.error') is not null or coalesce(json_extract(response, '$.response.status_code'), 200) != 200)) as failed
+from batch_op
+where batch in (select id from batch where id = @batch or super = @batch)
+	and completed_at is not null
+	and retried_at is null;
 -- name: DeleteBatchOps :exec
 delete from batch_op where batch = ?;
 -- name: BatchOpsCompleted :many
-select response
+select seq, response
+from batch_op
+where batch in (select id from batch where id = @batch or super = @batch)
+	and completed_at is not null
+	and retried_at is null
+	and (json_extract(response, '$.error') is not null or coalesce(json_extract(response, '$.response.status_code'), 200) != 200) = @failed
+	and seq > cast(@after as integer)
+	and seq <= cast(@until as integer)
+order by seq
+limit @limit;
+-- name: BatchSeq :one
+select cast(coalesce(max(seq), 0) as integer) as seq
 from batch_op
-where batch = ? and completed_at is not null
-limit @limit offset @offset;
+where batch in (select id from batch where id = @batch or super = @batch);
+-- name: BatchOpsPending :many
+-- the oldest pending ops of every model, up to the limit each
+select batch, custom_id, request, response, implicit, deferred, created_at, updated_at, completed_at, canceled_at, retried_at, seq, started_at
+from (
+	select batch_op.*, row_number() over (
+			partition by json_extract(batch_op.request, '$.body.model')
+			order by batch_op.created_at
+		) as lane
+	from batch_op
+		join batch on batch.id = batch_op.batch
+	where batch_op.implicit
+		and batch_op.started_at is null
+		and batch_op.completed_at is null
+		and batch_op.canceled_at is null
+		and json_extract(batch.body, '$.status') = 'in_progress'
+)
+where lane <= ?
+order by created_at;
+-- name: BatchOpsRetryable :many
+select request
+from batch_op
+where batch = ?
+	and not implicit
+	and retried_at is null
+	and (completed_at is null or (json_extract(response, '$.error') is not null or coalesce(json_extract(response, '$.response.status_code'), 200) != 200));
+-- name: BatchOpsSucceeded :many
+select custom_id
+from batch_op
+where batch = ?
+	and completed_at is not null
+	and not (json_extract(response, '$.error') is not null or coalesce(json_extract(response, '$.response.status_code'), 200) != 200);
+-- name: CompleteBatchOp :exec
+update batch_op
+set response = ?,
+	updated_at = current_timestamp,
+	completed_at = current_timestamp,
+	seq = (select coalesce(max(seq), 0) + 1 from batch_op)
+where batch = ? and custom_id = ? and completed_at is null and canceled_at is null;
 
 -- name: UpdateBatch :exec
 update batch
 set body = ?,
 	updated_at = current_timestamp,
 	canceled_at = ?,
-	completed_at = ?
+	completed_at = ?,
+	expires_at = ?
 where id = ?;
 -- name: CancelBatch :exec
 update batch
 	set canceled_at = current_timestamp
 	where (id = @id or super = @id) and completed_at is null;
+-- name: ReceiveBatch :execrows
+update batch
+	set received_at = current_timestamp
+	where id = ? and received_at is null;
 -- name: CancelBatchOps :exec
 update batch_op
 	set canceled_at = current_timestamp
 	where batch = @id and completed_at is null;
+-- name: RetireBatchOps :exec
+update batch_op
+	set retried_at = current_timestamp
+	where batch = ?
+		and not implicit
+		and retried_at is null
+		and (completed_at is null or (json_extract(response, '$.error') is not null or coalesce(json_extract(response, '$.response.status_code'), 200) != 200));
+-- name: RetryBatchOps :execrows
+update batch_op
+	set response = null,
+		updated_at = current_timestamp,
+		completed_at = null,
+		started_at = null,
+		seq = null
+	where batch = ?
+		and implicit
+		and completed_at is not null
+		and (json_extract(response, '$.error') is not null or coalesce(json_extract(response, '$.response.status_code'), 200) != 200);
+-- name: StartBatchOp :execrows
+update batch_op
+	set started_at = current_timestamp
+	where batch = ?
+		and custom_id = ?
+		and started_at is null
+		and completed_at is null
+		and canceled_at is null;
+-- name: UnstartBatchOp :exec
+update batch_op
+	set started_at = null
+	where batch = ?
+		and custom_id = ?
+		and completed_at is null;
+-- name: ResetBatchOps :execrows
+update batch_op
+	set started_at = null
+	where started_at is not null
+		and completed_at is null;
@@ -0,0 +1,5 @@
+-- name: InsertBatchGrant :exec
+insert into batch_grant (batch, api_key, principal)
+	values (?, ?, ?);
+-- name: BatchGrant :one
+select * from batch_grant where batch = ?;
@@ -0,0 +1,36 @@
+-- name: InsertLedger :exec
+insert into ledger (
+	at, kind, model, provider, principal,
+	prompt_tokens, cached_tokens, completion_tokens, reasoning_tokens,
+	latency_ms, status
+) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+
+-- name: LedgerUsage :many
+-- the ledger, as added up by the bucket, and the groups; the columns not
+-- grouped by are left empty
+select
+	case @bucket
+		when 'hour' then strftime('%Y-%m-%dT%H:00:00Z', at)
+		when 'day' then strftime('%Y-%m-%dT00:00:00Z', at)
+		-- the weeks start on Monday
+		when 'week' then strftime('%Y-%m-%dT00:00:00Z', at, '-6 days', 'weekday 1')
+		when 'month' then strftime('%Y-%m-01T00:00:00Z', at)
+		else ''
+	end as bucket,
+	iif(@by_kind, kind, '') as kind,
+	iif(@by_model, model, '') as model,
+	iif(@by_provider, provider, '') as provider,
+	iif(@by_principal, principal, '') as principal,
+	iif(@by_status, status, 0) as status,
+	count(*) as requests,
+	sum(status >= 400) as errors,
+	sum(prompt_tokens) as prompt_tokens,
+	sum(cached_tokens) as cached_tokens,
+	sum(completion_tokens) as completion_tokens,
+	sum(reasoning_tokens) as reasoning_tokens,
+	sum(latency_ms) / count(*) as latency_ms
+	from ledger
+	where at >= @since and at < @until
+		and (@principal_of = '' or principal = @principal_of)
+	group by 1, 2, 3, 4, 5, 6
+	order by 1, sum(prompt_tokens) + sum(completion_tokens) desc, min(id);
@@ -0,0 +1,12 @@
+-- name: InsertBatchSpool :exec
+insert into batch_spool (batch, path, off, size)
+	values (?, ?, ?, ?);
+-- name: BatchSpool :one
+select * from batch_spool where batch = ?;
+-- name: SuperBatchSpools :many
+select * from batch_spool
+	where batch in (select id from batch where super = ?);
+-- name: DeleteBatchSpool :exec
+delete from batch_spool where batch = ?;
+-- name: SpoolRefs :one
+select count(*) from batch_spool where path = ?;
@@ -0,0 +1,2 @@
+-- set once the sub-batch outputs have been downloaded to batch_op
+alter table batch add column received_at timestamp;
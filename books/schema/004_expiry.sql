@@ -0,0 +1,2 @@
+-- the end of the completion window, set once the batch is sent
+alter table batch add column expires_at timestamp;
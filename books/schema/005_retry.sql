@@ -0,0 +1,4 @@
+-- the sub-batch that was retried by this one
+alter table batch add column retry_of text;
+-- set once the op has been superseded by its retry
+alter table batch_op add column retried_at timestamp;
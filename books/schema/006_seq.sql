@@ -0,0 +1,4 @@
+-- the order in which the outputs came in, for partial downloads
+alter table batch_op add column seq integer;
+update batch_op set seq = rowid where completed_at is not null;
+create index batch_op_seq on batch_op (seq);
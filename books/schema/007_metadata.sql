@@ -0,0 +1,19 @@
+-- the driver-internal metadata keys of the sub-batches are namespaced
+update batch
+	set body = json_remove(json_set(body, '$.metadata."simp:real_id"', json_extract(body, '$.metadata.real_id')), '$.metadata.real_id')
+	where super is not null and json_type(body, '$.metadata.real_id') is not null;
+update batch
+	set body = json_remove(json_set(body, '$.metadata."simp:job"', json_extract(body, '$.metadata.job')), '$.metadata.job')
+	where super is not null and json_type(body, '$.metadata.job') is not null;
+update batch
+	set body = json_remove(json_set(body, '$.metadata."simp:state"', json_extract(body, '$.metadata.state')), '$.metadata.state')
+	where super is not null and json_type(body, '$.metadata.state') is not null;
+update batch
+	set body = json_remove(json_set(body, '$.metadata."simp:results"', json_extract(body, '$.metadata.results')), '$.metadata.results')
+	where super is not null and json_type(body, '$.metadata.results') is not null;
+update batch
+	set body = json_remove(json_set(body, '$.metadata."simp:table"', json_extract(body, '$.metadata.table')), '$.metadata.table')
+	where super is not null and json_type(body, '$.metadata.table') is not null;
+update batch
+	set body = json_remove(json_set(body, '$.metadata."simp:deferred"', json_extract(body, '$.metadata.deferred')), '$.metadata.deferred')
+	where super is not null and json_type(body, '$.metadata.deferred') is not null;
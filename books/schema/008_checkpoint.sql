@@ -0,0 +1,2 @@
+-- set once the implicit op is picked up by the worker
+alter table batch_op add column started_at timestamp;
@@ -0,0 +1,4 @@
+-- the provider that the sub-batch was routed to, as driver:name
+alter table batch add column provider text;
+-- the estimated cost of the sub-batch at the time of routing
+alter table batch add column cost real;
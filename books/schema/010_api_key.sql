@@ -0,0 +1,17 @@
+-- the keys issued to the daemon clients; only the hash of the key is kept
+create table api_key (
+	id text primary key,
+	name text not null,
+	hash blob not null unique,
+	-- the models, aliases, or tags that the key may use, comma-separated;
+	-- empty means any
+	scope text not null default '',
+	rpm integer not null default 0,
+	tpm integer not null default 0,
+	-- the spend budget, if any, in the currency of the model prices
+	budget real,
+	spent real not null default 0,
+	created_at timestamp not null default current_timestamp,
+	used_at timestamp,
+	revoked_at timestamp
+);
@@ -0,0 +1,20 @@
+-- the usage of every request, be it the daemon's, the cli's, or a batch's
+create table ledger (
+	id integer primary key,
+	at timestamp not null,
+	-- chat, embedding, or batch
+	kind text not null,
+	model text not null,
+	provider text not null default '',
+	-- the key, the identity of the token, or the certificate; the address
+	-- of the client otherwise
+	principal text not null default '',
+	prompt_tokens integer not null default 0,
+	cached_tokens integer not null default 0,
+	completion_tokens integer not null default 0,
+	reasoning_tokens integer not null default 0,
+	latency_ms integer not null default 0,
+	status integer not null default 200
+);
+
+create index ledger_at on ledger (at);
@@ -0,0 +1,10 @@
+-- the section of the spool that the native sub-batch was uploaded from; the
+-- inputs are read back from it when retried, rather than kept in batch_op
+create table batch_spool (
+	batch text primary key,
+	path text not null,
+	off integer not null,
+	size integer not null
+);
+
+create index batch_spool_path on batch_spool (path);
@@ -0,0 +1,6 @@
+-- whoever has uploaded the batch; the outputs are charged to their key
+create table batch_grant (
+	batch text primary key,
+	api_key text,
+	principal text not null default ''
+);
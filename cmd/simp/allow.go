@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/busthorne/simp"
+	"github.com/busthorne/simp/config"
+	"github.com/gofiber/fiber/v2"
+	"github.com/sashabaranov/go-openai"
+)
+
+// the client address, once it's been worked out
+const localIP = "simp.ip"
+
+// clientIP is the address of the client; if the request came through the
+// trusted proxies, X-Forwarded-For is walked back to the first hop that is
+// not one of them.
+func clientIP(c *fiber.Ctx) netip.Addr {
+	if ip, ok := c.Locals(localIP).(netip.Addr); ok {
+		return ip
+	}
+	ip, _ := netip.AddrFromSlice(c.Context().RemoteIP())
+	ip = ip.Unmap()
+	if trusted(ip) {
+		hops := strings.Split(c.Get(fiber.HeaderXForwardedFor), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			ip = hop.Unmap()
+			if !trusted(ip) {
+				break
+			}
+		}
+	}
+	c.Locals(localIP, ip)
+	return ip
+}
+
+// trusted tells whether the address is one of the trusted proxies.
+func trusted(ip netip.Addr) bool {
+	d := cfg.Daemon
+	return d != nil && len(d.TrustedProxies) > 0 && within(d.TrustedProxies, ip)
+}
+
+// within tells whether the address is within any of the CIDRs; the empty
+// list is everyone.
+func within(cidrs []string, ip netip.Addr) bool {
+	if len(cidrs) == 0 {
+		return true
+	}
+	for _, s := range cidrs {
+		if p, err := config.ParsePrefix(s); err == nil && p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowIPs turns away the clients that the daemon does not allow.
+func allowIPs(c *fiber.Ctx) error {
+	if d := cfg.Daemon; d != nil && !within(d.AllowedIPs, clientIP(c)) {
+		return forbidden(c, "daemon")
+	}
+	return c.Next()
+}
+
+// mayUse tells whether the client may use the model of the provider, as
+// both of them would have to allow it, and the client's grant cover it.
+func mayUse(c *fiber.Ctx, m config.Model, p config.Provider) bool {
+	ip := clientIP(c)
+	return within(p.AllowedIPs, ip) && within(m.AllowedIPs, ip) && grantOf(c).covers(m)
+}
+
+// permit the client to use the model, if it's configured at all, and any of
+// its claims would allow it; the model that is not would be not found down
+// the line anyway. The claims that it may not use are dropped, see usable.
+func permit(c *fiber.Ctx, alias string) error {
+	claims := cfg.LookupClaims(alias)
+	if len(claims) == 0 {
+		return nil
+	}
+	for _, cl := range claims {
+		if mayUse(c, cl.Model, cl.Provider) {
+			return nil
+		}
+	}
+	m, p := claims[0].Model, claims[0].Provider
+	if !within(p.AllowedIPs, clientIP(c)) || !within(m.AllowedIPs, clientIP(c)) {
+		return forbidden(c, fmt.Sprintf("model %s", alias))
+	}
+	c.Status(fiber.StatusForbidden)
+	return &openai.APIError{
+		Type:           "permission_error",
+		Message:        fmt.Sprintf("model %s is out of scope of key %s", alias, grantOf(c).name),
+		HTTPStatusCode: fiber.StatusForbidden,
+	}
+}
+
+// usable narrows the driver down to the claims that the client may use; the
+// balancer members, and the fallback links that it may not are left out, and
+// it's nil if there's nothing left.
+func usable(c *fiber.Ctx, d simp.Driver) simp.Driver {
+	switch d := d.(type) {
+	case gate:
+		if !mayUse(c, d.claim.Model, d.claim.Provider) {
+			return nil
+		}
+	case *balancer:
+		b := &balancer{alias: d.alias}
+		for _, m := range d.members {
+			if mayUse(c, m.Model, m.Provider) {
+				b.members = append(b.members, m)
+			}
+		}
+		if len(b.members) == 0 {
+			return nil
+		}
+		return b
+	case *fallback:
+		f := &fallback{}
+		for _, l := range d.chain {
+			if ld := usable(c, l.Driver); ld != nil {
+				f.chain = append(f.chain, link{ld, l.model})
+			}
+		}
+		if len(f.chain) == 0 {
+			return nil
+		}
+		return f
+	}
+	return d
+}
+
+func forbidden(c *fiber.Ctx, what string) error {
+	c.Status(fiber.StatusForbidden)
+	return &openai.APIError{
+		Type:           "permission_error",
+		Message:        fmt.Sprintf("%s is not allowed from %s", what, clientIP(c)),
+		HTTPStatusCode: fiber.StatusForbidden,
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/busthorne/simp/config"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestAllowedIPs(t *testing.T) {
+	defer func(c *config.Config) { cfg = c }(cfg)
+	cfg = &config.Config{
+		Daemon: &config.Daemon{
+			AllowedIPs: []string{"10.0.0.0/8"},
+			// the test requests come from 0.0.0.0
+			TrustedProxies: []string{"0.0.0.0", "192.168.1.1"},
+		},
+		Providers: []config.Provider{
+			{Driver: "openai", Name: "api", Models: []config.Model{
+				{Name: "gpt-4o", Alias: []string{"4o"}},
+				{Name: "o1", AllowedIPs: []string{"10.1.0.0/16"}},
+			}},
+		},
+	}
+	f := fiber.New(fiber.Config{
+		ErrorHandler: func(c *fiber.Ctx, err error) error {
+			return c.SendString(err.Error())
+		},
+	})
+	f.Use(allowIPs)
+	f.Get("/ip", func(c *fiber.Ctx) error {
+		return c.SendString(clientIP(c).String())
+	})
+	f.Get("/use/:model", func(c *fiber.Ctx) error {
+		if err := permit(c, c.Params("model")); err != nil {
+			return c.SendString(err.Error())
+		}
+		return c.SendString("ok")
+	})
+	get := func(path, xff string) (int, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		if xff != "" {
+			req.Header.Set("X-Forwarded-For", xff)
+		}
+		resp, err := f.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	cases := []struct {
+		xff  string
+		code int
+		ip   string
+	}{
+		{"", fiber.StatusForbidden, ""},
+		{"10.2.3.4", fiber.StatusOK, "10.2.3.4"},
+		{"10.2.3.4, 192.168.1.1", fiber.StatusOK, "10.2.3.4"},
+		// the client may say anything, but only the trusted hops count
+		{"10.2.3.4, 8.8.8.8", fiber.StatusForbidden, ""},
+		{"10.2.3.4, 8.8.8.8, 192.168.1.1", fiber.StatusForbidden, ""},
+	}
+	for _, c := range cases {
+		code, ip := get("/ip", c.xff)
+		if code != c.code {
+			t.Errorf("%q: %d, want %d", c.xff, code, c.code)
+			continue
+		}
+		if code == fiber.StatusOK && ip != c.ip {
+			t.Errorf("%q: the client is %s, want %s", c.xff, ip, c.ip)
+		}
+	}
+
+	for model, want := range map[string]bool{"4o": true, "o1": false, "unknown": true} {
+		_, body := get("/use/"+model, "10.2.3.4")
+		if got := body == "ok"; got != want {
+			t.Errorf("model %s: %s", model, body)
+		}
+	}
+	if _, body := get("/use/o1", "10.1.2.3"); body != "ok" {
+		t.Errorf("model o1 from 10.1.2.3: %s", body)
+	}
+	if _, body := get("/use/o1", "10.2.3.4"); !strings.Contains(body, "not allowed") {
+		t.Errorf("model o1 from 10.2.3.4: %s", body)
+	}
+}
+
+func TestUsable(t *testing.T) {
+	defer func(c *config.Config) { cfg = c }(cfg)
+	cfg = &config.Config{
+		Daemon: &config.Daemon{TrustedProxies: []string{"0.0.0.0"}},
+		Providers: []config.Provider{
+			{Driver: "openai", Name: "private", AllowedIPs: []string{"10.1.0.0/16"}, Models: []config.Model{
+				{Name: "gpt-4o", Alias: []string{"4o"}},
+			}},
+			{Driver: "openai", Name: "open", Models: []config.Model{
+				{Name: "gpt-4o", Alias: []string{"4o"}},
+			}},
+			{Driver: "openai", Name: "mini", Models: []config.Model{
+				{Name: "gpt-4o-mini"},
+			}},
+		},
+	}
+	private := config.Claim{Model: cfg.Providers[0].Models[0], Provider: cfg.Providers[0]}
+	open := config.Claim{Model: cfg.Providers[1].Models[0], Provider: cfg.Providers[1]}
+	mini := config.Claim{Model: cfg.Providers[2].Models[0], Provider: cfg.Providers[2]}
+	f := &fallback{chain: []link{
+		{&balancer{alias: "4o", members: []member{
+			{gate{&canned{}, private}, private},
+			{gate{&canned{}, open}, open},
+		}}, open.Model},
+		{gate{&canned{}, private}, private.Model},
+		{gate{&canned{}, mini}, mini.Model},
+	}}
+
+	app := fiber.New()
+	app.Get("/", func(c *fiber.Ctx) error {
+		if scope := c.Get("X-Scope"); scope != "" {
+			c.Locals(localGrant, &grant{id: "k1", scope: []string{scope}})
+		}
+		if err := permit(c, "4o"); err != nil {
+			return err
+		}
+		d, ok := usable(c, f).(*fallback)
+		if !ok {
+			return c.SendString("none")
+		}
+		var links []string
+		for _, l := range d.chain {
+			switch l := l.Driver.(type) {
+			case *balancer:
+				var names []string
+				for _, m := range l.members {
+					names = append(names, m.Provider.Name)
+				}
+				links = append(links, strings.Join(names, "+"))
+			case gate:
+				links = append(links, l.claim.Provider.Name)
+			}
+		}
+		return c.SendString(strings.Join(links, ","))
+	})
+	for _, tc := range []struct{ ip, scope, want string }{
+		{"10.1.2.3", "", "private+open,private,mini"},
+		// the first claim is out of reach, but the model is not
+		{"10.2.3.4", "", "open,mini"},
+		// the key may not fall back on the models out of its scope
+		{"10.1.2.3", "4o", "private+open,private"},
+		{"10.2.3.4", "4o", "open"},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Forwarded-For", tc.ip)
+		req.Header.Set("X-Scope", tc.scope)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		if string(b) != tc.want {
+			t.Errorf("%s %s: %q, want %q", tc.ip, tc.scope, b, tc.want)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/busthorne/simp"
+	"github.com/busthorne/simp/config"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	// how many conversations are remembered for sticky routing
+	stickyLimit = 10000
+	// how much the latest latency counts towards the average
+	latencyWeight = 0.2
+	// how long the provider is out after its first failure, doubling with
+	// every failure in a row, up to downMax
+	downMin = time.Second
+	downMax = time.Minute
+)
+
+// pool keeps the health of the providers, and the conversations that stick
+// to them, between the requests.
+var pool = balance{
+	health: map[string]*health{},
+	sticky: map[string]string{},
+}
+
+type balance struct {
+	sync.Mutex
+
+	// health by claim, i.e. provider, and model
+	health map[string]*health
+	// claims by conversation
+	sticky map[string]string
+}
+
+// health is how the provider has been doing with the model lately.
+type health struct {
+	// the moving average latency of the successful calls
+	latency time.Duration
+	// the failures in a row, and when the provider could be back
+	failures int
+	down     time.Time
+}
+
+// balancer is the driver of the model that is claimed by more than one
+// provider; the calls are spread between them by weight, health, and
+// latency, and the conversations stick to the provider they started with,
+// so that its prompt cache would still hit.
+type balancer struct {
+	alias   string
+	members []member
+}
+
+// member is one provider of the balanced model.
+type member struct {
+	simp.Driver
+	config.Claim
+}
+
+func (m member) key() string {
+	return m.Provider.ID() + "/" + m.Model.Name
+}
+
+// balancerFor makes the balancer of the model, if more than one provider
+// claims it; the providers that cannot be driven are left out. The driver
+// given is that of the claim by p, and should be gated already.
+func balancerFor(alias string, d simp.Driver, m config.Model, p config.Provider) simp.Driver {
+	claims := cfg.LookupClaims(alias)
+	if len(claims) < 2 {
+		return d
+	}
+	b := &balancer{alias: alias}
+	for _, c := range claims {
+		if c.Provider.ID() == p.ID() {
+			b.members = append(b.members, member{d, c})
+			continue
+		}
+		cd, err := drive(c.Provider)
+		if err != nil {
+			log.Warnf("model %s: provider %s: %v\n", alias, c.Provider.Name, err)
+			continue
+		}
+		b.members = append(b.members, member{gate{cd, c}, c})
+	}
+	return b
+}
+
+// weight is the configured weight of the claim; zero means one, and the
+// negative means the provider is only there for the batches.
+func weight(m config.Model) float64 {
+	if m.Weight == 0 {
+		return 1
+	}
+	return float64(max(m.Weight, 0))
+}
+
+// pick the member for the conversation, if there's one: the conversation
+// sticks to its member for as long as it's healthy, and otherwise, the
+// healthy members are picked at random by weight, over latency relative
+// to the average.
+func (b *balancer) pick(conversation string) member {
+	pool.Lock()
+	defer pool.Unlock()
+	now := time.Now()
+
+	var (
+		healthy []member
+		average time.Duration
+		known   int
+	)
+	for _, m := range b.members {
+		h := pool.of(m)
+		if weight(m.Model) > 0 && !now.Before(h.down) {
+			healthy = append(healthy, m)
+			if h.latency > 0 {
+				average += h.latency
+				known++
+			}
+		}
+	}
+	if len(healthy) == 0 {
+		// everyone is down, so it's as good as anyone
+		for _, m := range b.members {
+			if weight(m.Model) > 0 {
+				healthy = append(healthy, m)
+			}
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = b.members
+	}
+	if known > 0 {
+		average /= time.Duration(known)
+	}
+	if conversation != "" {
+		if key, ok := pool.sticky[conversation]; ok {
+			for _, m := range healthy {
+				if m.key() == key {
+					return m
+				}
+			}
+		}
+	}
+	weights := make([]float64, len(healthy))
+	var total float64
+	for i, m := range healthy {
+		weights[i] = weight(m.Model)
+		if h := pool.of(m); h.latency > 0 && average > 0 {
+			weights[i] *= float64(average) / float64(h.latency)
+		}
+		total += weights[i]
+	}
+	chosen := healthy[len(healthy)-1]
+	for i, x := 0, rand.Float64()*total; i < len(healthy); i++ {
+		if x -= weights[i]; x < 0 {
+			chosen = healthy[i]
+			break
+		}
+	}
+	if conversation != "" {
+		if len(pool.sticky) >= stickyLimit {
+			clear(pool.sticky)
+		}
+		pool.sticky[conversation] = chosen.key()
+	}
+	return chosen
+}
+
+// of is the health of the member; the pool must be locked.
+func (p *balance) of(m member) *health {
+	h, ok := p.health[m.key()]
+	if !ok {
+		h = &health{}
+		p.health[m.key()] = h
+	}
+	return h
+}
+
+// record how the call to the member went; only the transient errors would
+// count against its health, as the others are the caller's fault.
+func (b *balancer) record(m member, start time.Time, err error) {
+	pool.Lock()
+	defer pool.Unlock()
+	h := pool.of(m)
+	switch {
+	case err == nil:
+		took := time.Since(start)
+		if h.latency == 0 {
+			h.latency = took
+		} else {
+			h.latency = time.Duration(latencyWeight*float64(took) + (1-latencyWeight)*float64(h.latency))
+		}
+		h.failures = 0
+	case errors.Is(err, simp.ErrRetry):
+		down := downMax
+		if h.failures < 16 {
+			down = min(downMin<<h.failures, downMax)
+		}
+		h.failures++
+		h.down = time.Now().Add(down)
+		log.Warnf("model %s: provider %s is down for %v: %v\n", b.alias, m.Provider.ID(), down, err)
+	}
+}
+
+// conversation is what the chat is known by for sticky routing: the model,
+// and the messages up to the first user message, as any follow-ups would
+// share them.
+func conversation(alias string, req openai.ChatCompletionRequest) string {
+	h := sha256.New()
+	h.Write([]byte(alias))
+	for _, msg := range req.Messages {
+		h.Write([]byte{0})
+		h.Write([]byte(msg.Role))
+		h.Write([]byte{0})
+		h.Write([]byte(msg.Content))
+		for _, part := range msg.MultiContent {
+			h.Write([]byte(part.Text))
+		}
+		if msg.Role == openai.ChatMessageRoleUser {
+			break
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (b *balancer) List(ctx context.Context) ([]openai.Model, error) {
+	return b.members[0].List(ctx)
+}
+
+func (b *balancer) Embed(ctx context.Context, req openai.EmbeddingRequest) (resp openai.EmbeddingResponse, err error) {
+	m := b.pick("")
+	served(ctx, m.Provider.ID())
+	req.Model = m.Model.Name
+	start := time.Now()
+	resp, err = m.Embed(context.WithValue(ctx, simp.KeyModel, m.Model), req)
+	b.record(m, start, err)
+	resp.Model = openai.EmbeddingModel(m.Model.Name)
+	return
+}
+
+func (b *balancer) Complete(ctx context.Context, req openai.CompletionRequest) (resp openai.CompletionResponse, err error) {
+	m := b.pick("")
+	served(ctx, m.Provider.ID())
+	req.Model = m.Model.Name
+	start := time.Now()
+	resp, err = m.Complete(context.WithValue(ctx, simp.KeyModel, m.Model), req)
+	b.record(m, start, err)
+	resp.Model = m.Model.Name
+	return
+}
+
+// Chat is timed up to the first chunk of the stream.
+func (b *balancer) Chat(ctx context.Context, req openai.ChatCompletionRequest) (resp openai.ChatCompletionResponse, err error) {
+	m := b.pick(conversation(b.alias, req))
+	served(ctx, m.Provider.ID())
+	req.Model = m.Model.Name
+	start := time.Now()
+	resp, err = m.Chat(context.WithValue(ctx, simp.KeyModel, m.Model), req)
+	if err == nil {
+		resp, _, err = peek(resp)
+	}
+	b.record(m, start, err)
+	resp.Model = m.Model.Name
+	return
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/busthorne/simp"
+	"github.com/busthorne/simp/config"
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestBalancer(t *testing.T) {
+	pool.Lock()
+	clear(pool.health)
+	clear(pool.sticky)
+	pool.Unlock()
+
+	claim := func(name string, weight int) config.Claim {
+		return config.Claim{
+			Model:    config.Model{Name: "gpt-4o", Weight: weight},
+			Provider: config.Provider{Driver: "openai", Name: name},
+		}
+	}
+	org1, org2, spare := &canned{}, &canned{}, &canned{}
+	b := &balancer{alias: "4o", members: []member{
+		{org1, claim("balance-org1", 3)},
+		{org2, claim("balance-org2", 1)},
+		{spare, claim("balance-spare", -1)},
+	}}
+	counts := map[string]int{}
+	for i := 0; i < 400; i++ {
+		counts[b.pick("").Provider.Name]++
+	}
+	if counts["balance-spare"] > 0 {
+		t.Errorf("the spare was picked %d times", counts["balance-spare"])
+	}
+	if n := counts["balance-org1"]; n < 200 || n > 380 {
+		t.Errorf("org1 was picked %d/400 times with 3/4 of the weight", n)
+	}
+
+	// the conversation sticks to its provider
+	req := func(follow ...string) openai.ChatCompletionRequest {
+		r := openai.ChatCompletionRequest{Messages: []openai.ChatCompletionMessage{
+			{Role: "system", Content: "be brief"},
+			{Role: "user", Content: "hello"},
+		}}
+		for _, s := range follow {
+			r.Messages = append(r.Messages, openai.ChatCompletionMessage{Role: "user", Content: s})
+		}
+		return r
+	}
+	first := b.pick(conversation(b.alias, req()))
+	for i := 0; i < 20; i++ {
+		if m := b.pick(conversation(b.alias, req("and again"))); m.key() != first.key() {
+			t.Fatalf("the conversation went from %s to %s", first.key(), m.key())
+		}
+	}
+
+	// unless the provider is down
+	var other member
+	for _, m := range b.members[:2] {
+		if m.key() != first.key() {
+			other = m
+		}
+	}
+	b.record(first, time.Now(), &simp.RetryError{Err: simp.ErrRetry})
+	if m := b.pick(conversation(b.alias, req("and again"))); m.key() != other.key() {
+		t.Errorf("the conversation stuck to %s while it's down", m.key())
+	}
+	// and it's down for everyone else
+	for i := 0; i < 50; i++ {
+		if m := b.pick(""); m.key() == first.key() {
+			t.Fatalf("%s was picked while it's down", m.key())
+		}
+	}
+
+	// the chat says who has answered
+	resp, err := b.Chat(context.Background(), req())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Model != "gpt-4o" || answered(b, config.Model{Name: "4o"}, resp.Model) != "gpt-4o" {
+		t.Errorf("answered by %q", resp.Model)
+	}
+}
@@ -6,6 +6,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/busthorne/simp"
@@ -17,6 +21,12 @@ import (
 	"github.com/sashabaranov/go-openai"
 )
 
+const (
+	errorFilePrefix = "error-"
+	// the partial download cursor
+	cursorHeader = "Simp-Cursor"
+)
+
 var (
 	errNoid        = fmt.Errorf("missing custom_id")
 	errBadMethod   = fmt.Errorf("POST method is required")
@@ -45,15 +55,148 @@ func BatchUpload(c *fiber.Ctx) error {
 	}
 	defer f.Close()
 
+	parts, err := partition(f)
+	if err != nil {
+		return err
+	}
+	defer parts.Close()
+	for model := range parts.spools {
+		if err := permit(c, model); err != nil {
+			return err
+		}
+	}
+	parts.may = func(cl config.Claim) bool {
+		return mayUse(c, cl.Model, cl.Provider)
+	}
+	if c.QueryBool("dry_run") {
+		plan, err := parts.plan(ctx)
+		if err != nil {
+			return err
+		}
+		return c.JSON(plan)
+	}
+
+	id := uuid.New().String()
+	super := openai.Batch{
+		ID:               id,
+		Object:           "batch",
+		CompletionWindow: "24h",
+		CreatedAt:        time.Now().Unix(),
+		RequestCounts:    openai.BatchRequestCounts{},
+		Metadata:         map[string]any{},
+		OutputFileID:     id,
+	}
+
+	log.Debugf("batch %q partitions:\n", super.ID)
+	for model, sp := range parts.spools {
+		log.Debugf("%d %s\n", sp.n, model)
+		super.RequestCounts.Total += sp.n
+	}
+
+	// the uploads come first, so that the books are written to in one go
+	var (
+		subs     []staged
+		implicit []*spool
+	)
+	for model, sp := range parts.spools {
+		// the cheapest provider that would batch it natively
+		batched := false
+		for _, r := range parts.routes(model) {
+			var uploaded []staged
+			uploaded, batched, err = upload(ctx, super.ID, r, sp)
+			if err != nil {
+				return err
+			}
+			if batched {
+				subs = append(subs, uploaded...)
+				break
+			}
+		}
+		if !batched {
+			implicit = append(implicit, sp)
+		}
+	}
+
+	tx, err := books.DB.BeginTx(c.Context(), nil)
+	if err != nil {
+		return notkeep(err, "begin")
+	}
+	defer tx.Rollback()
+
+	book := books.Session().WithTx(tx)
+	err = book.InsertBatch(ctx, books.InsertBatchParams{
+		ID:   super.ID,
+		Body: super,
+	})
+	if err != nil {
+		return notkeep(err, "insert super batch")
+	}
+	// the outputs are charged to whoever has uploaded the batch
+	grant := books.InsertBatchGrantParams{Batch: super.ID, Principal: who(c)}
+	if g := grantOf(c); g != nil && g.id != "" {
+		grant.ApiKey = &g.id
+	}
+	if err := book.InsertBatchGrant(ctx, grant); err != nil {
+		return notkeep(err, "insert batch grant")
+	}
+	if err := keepStaged(ctx, book, super.ID, nil, subs); err != nil {
+		return err
+	}
+	for _, sp := range implicit {
+		all, err := sp.all()
+		if err != nil {
+			return notkeep(err, "spool")
+		}
+		if err := implicitOps(ctx, book, super.ID, sp.inputs(all)); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return notkeep(err, "commit")
+	}
+	for _, sp := range parts.spools {
+		keepReferred(ctx, sp)
+	}
+	return c.JSON(openai.File{
+		ID:       super.ID,
+		Object:   "file",
+		Bytes:    int(ff.Size),
+		FileName: ff.Filename,
+		Purpose:  "batch",
+	})
+}
+
+// partitions are the validated batch inputs, spooled by model.
+type partitions struct {
+	// spooled inputs by model, as requested
+	spools map[string]*spool
+	// the claims that the uploader may use; nil is all of them
+	may func(config.Claim) bool
+}
+
+// routes are those of the model that the uploader may use.
+func (p *partitions) routes(model string) (rr []route) {
+	for _, r := range routes(model) {
+		if p.may == nil || p.may(r.Claim) {
+			rr = append(rr, r)
+		}
+	}
+	return
+}
+
+// partition will validate the batch inputs, and spool them by the model as
+// requested; the inputs keep the alias, so that they could be routed to any
+// provider that claims it, and are only renamed once the route is known.
+func partition(r io.Reader) (_ *partitions, err error) {
+	p := &partitions{spools: map[string]*spool{}}
+	defer func() {
+		if err != nil {
+			p.Close()
+		}
+	}()
 	var (
-		// driver (nil, if doesn't support batching) by model name
-		drivers = map[string]simp.BatchDriver{}
-		// magazine by model name
-		inputs = map[string][]openai.BatchInput{}
-		// model config by model name
-		models = map[string]config.Model{}
 		// will parse one request at a time
-		lines = json.NewDecoder(f)
+		lines = json.NewDecoder(r)
 		// ids
 		ids = map[string]bool{}
 	)
@@ -69,183 +212,339 @@ func BatchUpload(c *fiber.Ctx) error {
 		switch err := lines.Decode(&input); err {
 		case nil:
 			if input.CustomID == "" {
-				return malformed(errNoid)
+				return nil, malformed(errNoid)
 			}
 			if _, ok := ids[input.CustomID]; ok {
-				return malformed(fmt.Errorf("duplicate custom_id %q", input.CustomID))
+				return nil, malformed(fmt.Errorf("duplicate custom_id %q", input.CustomID))
 			}
 			switch input.Method {
 			case "", "POST", "post":
 				input.Method = "POST"
 			default:
-				return malformed(errBadMethod)
+				return nil, malformed(errBadMethod)
 			}
 			ids[input.CustomID] = true
 		case io.EOF:
 			goto eof
 		default:
-			return malformed(err)
+			return nil, malformed(err)
 		}
 		model := input.Model()
-		d, m, err := findWaldo(model)
-		if err != nil {
-			return malformed(fmt.Errorf("model %q: %w", model, err))
-		}
-		models[model] = m
-		// cache the batch driver variant
-		if bd, ok := d.(simp.BatchDriver); ok {
-			drivers[model] = bd
+		// resolved by config, as findWaldo would only see the daemon
+		m, _, ok := cfg.LookupModel(model)
+		if !ok {
+			return nil, malformed(fmt.Errorf("model %q: %w", model, simp.ErrNotFound))
 		}
 		// contextual validation
 		switch {
 		case input.ChatCompletion != nil:
 			if m.Embedding {
-				return malformed(fmt.Errorf("model %q is not a chat model", model))
+				return nil, malformed(fmt.Errorf("model %q is not a chat model", model))
 			}
 			alt := ""
 			for i, m := range input.ChatCompletion.Messages {
 				switch m.Role {
 				case "system":
 					if i != 0 {
-						return malformed(fmt.Errorf("system message/%d is misplaced", i))
+						return nil, malformed(fmt.Errorf("system message/%d is misplaced", i))
 					}
 				case "user", "assistant":
 					if alt == m.Role {
-						return malformed(fmt.Errorf("message/%d is not alternating", i))
+						return nil, malformed(fmt.Errorf("message/%d is not alternating", i))
 					}
 				default:
-					return malformed(fmt.Errorf("message/%d unsupported role %q", i, m.Role))
+					return nil, malformed(fmt.Errorf("message/%d unsupported role %q", i, m.Role))
 				}
 				alt = m.Role
 			}
-			input.ChatCompletion.Model = m.Name
 		case input.Embedding != nil:
 			if !m.Embedding {
-				return malformed(fmt.Errorf("model %q is not an embedding model", model))
+				return nil, malformed(fmt.Errorf("model %q is not an embedding model", model))
 			}
-			input.Embedding.Model = m.Name
 		default:
-			return malformed(errMeatNorFish)
+			return nil, malformed(errMeatNorFish)
+		}
+		sp, ok := p.spools[model]
+		if !ok {
+			if sp, err = newSpool(); err != nil {
+				return nil, notkeep(err, "spool")
+			}
+			p.spools[model] = sp
+		}
+		if err := sp.Write(input); err != nil {
+			return nil, notkeep(err, "spool request/%d", i)
 		}
-		inputs[model] = append(inputs[model], input)
 	}
 
-	// the super batch has been partitioned into sub-batches
 eof:
-	if len(inputs) == 0 {
-		return fmt.Errorf("no requests to batch")
-	}
-	id := uuid.New().String()
-	super := openai.Batch{
-		ID:               id,
-		Object:           "batch",
-		CompletionWindow: "24h",
-		CreatedAt:        time.Now().Unix(),
-		RequestCounts:    openai.BatchRequestCounts{},
-		Metadata:         map[string]any{},
-		OutputFileID:     id,
+	if len(p.spools) == 0 {
+		return nil, fmt.Errorf("no requests to batch")
 	}
+	return p, nil
+}
 
-	log.Debugf("batch %q partitions:\n", super.ID)
-	for model, inputs := range inputs {
-		log.Debugf("%d %s (%T)\n", len(inputs), model, drivers[model])
-		super.RequestCounts.Total += len(inputs)
+// Close removes the spools.
+func (p *partitions) Close() {
+	for _, sp := range p.spools {
+		sp.Close()
 	}
+}
 
-	tx, err := books.DB.BeginTx(c.Context(), nil)
-	if err != nil {
-		return notkeep(err, "begin")
-	}
-	defer tx.Rollback()
+// staged is the sub-batch that has been uploaded to the provider, and is
+// yet to be kept in the books.
+type staged struct {
+	batch    openai.Batch
+	model    string
+	provider string
+	sect     section
+	cost     *float64
+	deferred bool
+	sp       *spool
+}
 
-	book := books.Session().WithTx(tx)
-	err = book.InsertBatch(ctx, books.InsertBatchParams{
-		ID:   super.ID,
-		Body: super,
-	})
+// upload the spooled inputs to the provider in sub-batches of the
+// superbatch. Nothing is kept in the books just yet, so that the uploads,
+// that may take a while, would not hold up the writes of the others; see
+// keepStaged.
+//
+// It returns false if the driver would not batch the inputs, in which case
+// they should be routed elsewhere, or done implicitly.
+func upload(ctx context.Context, super string, r route, sp *spool) ([]staged, bool, error) {
+	m, bd, provider := r.Model, r.bd, r.Provider.ID()
+	sections, err := sp.split(batchLimits(r.Provider, bd))
 	if err != nil {
-		return notkeep(err, "insert super batch")
+		return nil, false, notkeep(err, "split spool")
 	}
-	for model, inputs := range inputs {
-		var (
-			implicit, deferred bool
+	var subs []staged
+	for _, sect := range sections {
+		log.Debugf("batch %q split length %d\n", super, sect.n)
+		b := openai.Batch{
+			ID:       uuid.New().String(),
+			Endpoint: sect.url,
+			RequestCounts: openai.BatchRequestCounts{
+				Total: sect.n,
+			},
+			Metadata: map[string]any{},
+		}
+		deferred := false
+		ctx := context.WithValue(ctx, simp.KeyModel, m)
+		switch err := bd.BatchUpload(ctx, &b, rename(sp.inputs(sect), m.Name)); err {
+		case nil:
+		case simp.ErrNotImplemented:
+			// i.e. openai-compatible providers that do not support batching
+			return nil, false, nil
+		case simp.ErrBatchDeferred:
+			// i.e. anthropic which doesn't require an upload
+			b.Metadata[simp.MetaDeferred] = true
+			deferred = true
+		default:
+			return nil, false, fmt.Errorf("batch upload failed for model %q: %w", m.Name, err)
+		}
+		subs = append(subs, staged{
+			batch:    b,
+			model:    m.Name,
+			provider: provider,
+			sect:     sect,
+			cost:     r.cost(sect.tokens),
+			deferred: deferred,
+			sp:       sp,
+		})
+	}
+	return subs, true, nil
+}
 
-			parent = super
-			bd, ok = drivers[model]
-		)
-		const chunkSize = 25000
-		if ok {
-			splits := make([][]openai.BatchInput, 0, len(inputs)/chunkSize+1)
-			for i := 0; i < len(inputs); i += chunkSize {
-				end := i + chunkSize
-				if end > len(inputs) {
-					end = len(inputs)
-				}
-				splits = append(splits, inputs[i:end])
-			}
-			for _, inputs := range splits {
-				log.Debugf("batch %q split length %d\n", super.ID, len(inputs))
-				b := openai.Batch{
-					ID:       uuid.New().String(),
-					Endpoint: inputs[0].URL,
-					RequestCounts: openai.BatchRequestCounts{
-						Total: len(inputs),
-					},
-					Metadata: map[string]any{},
-				}
-				ctx := context.WithValue(ctx, simp.KeyModel, models[model])
-				switch err := bd.BatchUpload(ctx, &b, inputs); err {
-				case simp.ErrNotImplemented:
-					// i.e. openai-compatible providers that do not support batching
-					implicit = true
-				case simp.ErrBatchDeferred:
-					// i.e. anthropic which doesn't require an upload
-					b.Metadata["deferred"] = true
-					deferred = true
-					parent = b
-					fallthrough
-				case nil:
-					err := book.InsertBatch(ctx, books.InsertBatchParams{
-						ID:    b.ID,
-						Super: &super.ID,
-						Model: model,
-						Body:  b,
-					})
-					if err != nil {
-						return notkeep(err, "create batch")
-					}
-				default:
-					return fmt.Errorf("batch upload failed for model %q: %w", model, err)
-				}
-			}
+// keepStaged keeps the uploaded sub-batches of the superbatch in the books.
+// The sub-batches refer to their sections of the spool, so that they could
+// be retried; only the deferred ones keep the inputs in batch_op, as the
+// driver would need them at send time.
+func keepStaged(ctx context.Context, book *books.Queries, super string, retryOf *string, subs []staged) error {
+	for _, s := range subs {
+		b := s.batch
+		err := book.InsertBatch(ctx, books.InsertBatchParams{
+			ID:       b.ID,
+			Super:    &super,
+			Model:    s.model,
+			Body:     b,
+			RetryOf:  retryOf,
+			Provider: &s.provider,
+			Cost:     s.cost,
+		})
+		if err != nil {
+			return notkeep(err, "create batch")
 		}
-		if !deferred && !implicit {
+		log.Debugf("batch %q routed to %s\n", b.ID, s.provider)
+		if !s.deferred {
+			err := book.InsertBatchSpool(ctx, books.InsertBatchSpoolParams{
+				Batch: b.ID,
+				Path:  s.sp.f.Name(),
+				Off:   s.sect.off,
+				Size:  s.sect.size,
+			})
+			if err != nil {
+				return notkeep(err, "create batch spool")
+			}
 			continue
 		}
-		// create implicit and deferred batch ops
-		for i, input := range inputs {
+		i := 0
+		for input, err := range rename(s.sp.inputs(s.sect), s.model) {
+			if err != nil {
+				return notkeep(err, "read spool/%d", i)
+			}
 			err := book.InsertBatchOp(ctx, books.InsertBatchOpParams{
-				Batch:    parent.ID,
+				Batch:    b.ID,
 				CustomID: input.CustomID,
 				Request:  input,
-				Implicit: implicit,
-				Deferred: deferred,
+				Deferred: true,
 			})
 			if err != nil {
 				return notkeep(err, "create batch op/%d", i)
 			}
+			i++
 		}
 	}
-	if err := tx.Commit(); err != nil {
-		return notkeep(err, "commit")
+	return nil
+}
+
+// keepReferred keeps the spool past Close, if any sub-batch refers to it.
+func keepReferred(ctx context.Context, sp *spool) {
+	n, err := books.Session().SpoolRefs(ctx, sp.f.Name())
+	if err != nil {
+		log.Errorf("spool %s: %v\n", sp.f.Name(), notkeep(err, "count refs"))
+	}
+	if err != nil || n > 0 {
+		sp.keep()
 	}
-	return c.JSON(openai.File{
-		ID:       super.ID,
-		Object:   "file",
-		Bytes:    int(ff.Size),
-		FileName: ff.Filename,
-		Purpose:  "batch",
-	})
+}
+
+// unspool lets go of the spool of the sub-batch, and removes the file once
+// no other sub-batch refers to it.
+func unspool(ctx context.Context, batch string) error {
+	book := books.Session()
+	s, err := book.BatchSpool(ctx, batch)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return nil
+	default:
+		return notkeep(err, "fetch batch spool")
+	}
+	if err := book.DeleteBatchSpool(ctx, batch); err != nil {
+		return notkeep(err, "delete batch spool")
+	}
+	n, err := book.SpoolRefs(ctx, s.Path)
+	if err != nil {
+		return notkeep(err, "count spool refs")
+	}
+	if n == 0 {
+		os.Remove(s.Path)
+	}
+	return nil
+}
+
+// unspoolAll lets go of the spools of the superbatch that is not going to
+// be retried.
+func unspoolAll(ctx context.Context, super string) {
+	spools, err := books.Session().SuperBatchSpools(ctx, &super)
+	if err != nil && err != sql.ErrNoRows {
+		log.Errorf("batch %q: %v\n", super, notkeep(err, "fetch batch spools"))
+	}
+	for _, s := range spools {
+		if err := unspool(ctx, s.Batch); err != nil {
+			log.Errorf("batch %q: %v\n", s.Batch, err)
+		}
+	}
+}
+
+// retryable spools the inputs of the sub-batch that have either failed, or
+// never come back; the native sub-batches are read back from their spool,
+// and the deferred ones from batch_op.
+func retryable(ctx context.Context, book *books.Queries, sub books.Batch, sp *spool) error {
+	s, err := book.BatchSpool(ctx, sub.ID)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		inputs, err := book.BatchOpsRetryable(ctx, sub.ID)
+		switch err {
+		case nil:
+		case sql.ErrNoRows:
+		default:
+			return notkeep(err, "fetch retryable ops")
+		}
+		for _, input := range inputs {
+			if err := sp.Write(input); err != nil {
+				return notkeep(err, "spool")
+			}
+		}
+		return nil
+	default:
+		return notkeep(err, "fetch batch spool")
+	}
+	succeeded, err := book.BatchOpsSucceeded(ctx, sub.ID)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+	default:
+		return notkeep(err, "fetch succeeded ops")
+	}
+	done := make(map[string]bool, len(succeeded))
+	for _, id := range succeeded {
+		done[id] = true
+	}
+	from, err := openSpool(s.Path)
+	if err != nil {
+		return fmt.Errorf("batch %q cannot be retried: %w", sub.ID, err)
+	}
+	defer from.Close()
+	i := 0
+	for input, err := range from.inputs(section{off: s.Off, size: s.Size}) {
+		if err != nil {
+			return notkeep(err, "read spool/%d", i)
+		}
+		i++
+		if done[input.CustomID] {
+			continue
+		}
+		if err := sp.Write(input); err != nil {
+			return notkeep(err, "spool")
+		}
+	}
+	return nil
+}
+
+// batchLimits are the driver's limits, as overridden by the provider config.
+func batchLimits(p config.Provider, bd simp.BatchDriver) simp.BatchLimits {
+	limits := bd.BatchLimits()
+	if p.BatchRequests > 0 {
+		limits.Requests = p.BatchRequests
+	}
+	if p.BatchBytes > 0 {
+		limits.Bytes = p.BatchBytes
+	}
+	if p.BatchTokens > 0 {
+		limits.Tokens = p.BatchTokens
+	}
+	return limits
+}
+
+// implicitOps will commit the inputs to be done by the implicit worker.
+func implicitOps(ctx context.Context, book *books.Queries, super string, inputs simp.BatchInputs) error {
+	i := 0
+	for input, err := range inputs {
+		if err != nil {
+			return notkeep(err, "read request/%d", i)
+		}
+		err := book.InsertBatchOp(ctx, books.InsertBatchOpParams{
+			Batch:    super,
+			CustomID: input.CustomID,
+			Request:  input,
+			Implicit: true,
+		})
+		if err != nil {
+			return notkeep(err, "create batch op/%d", i)
+		}
+		i++
+	}
+	return nil
 }
 
 func BatchSend(c *fiber.Ctx) error {
@@ -254,6 +553,12 @@ func BatchSend(c *fiber.Ctx) error {
 		return fmt.Errorf("invalid request body: %w", err)
 	}
 
+	for k := range req.Metadata {
+		if strings.HasPrefix(k, simp.MetaPrefix) {
+			return fmt.Errorf("metadata key %q is reserved", k)
+		}
+	}
+
 	ctx := c.Context()
 	book := books.Session()
 	now := time.Now()
@@ -272,55 +577,34 @@ func BatchSend(c *fiber.Ctx) error {
 	if err != nil {
 		return fmt.Errorf("empty batch content, will not create")
 	}
+	if req.CompletionWindow != "" {
+		super.CompletionWindow = req.CompletionWindow
+	}
+	window, err := time.ParseDuration(super.CompletionWindow)
+	if err != nil || window <= 0 {
+		return fmt.Errorf("invalid completion window %q", super.CompletionWindow)
+	}
+	super.ExpiresAt = now.Add(window).Unix()
+	if len(req.Metadata) > 0 {
+		super.Metadata = req.Metadata
+	}
+	// kept before any sub-batch is sent, so that resend would have it
+	if err := book.UpdateBatch(ctx, books.BatchUpdates(super)); err != nil {
+		return notkeep(err, "update super batch")
+	}
 
-	// submit a sub-batch, and do the bookkeeping on it
+	sent := 0
 	for _, sub := range subs {
-		batch := sub.Body
-
-		bd, m, err := findBaldo(sub.Model)
+		ok, err := send(ctx, &super, sub)
 		if err != nil {
-			return fmt.Errorf("model %q is not available for batching", sub.Model)
-		}
-
-		var ctx context.Context = ctx
-
-		// pre-deferred
-		_, deferred := batch.Metadata["deferred"]
-		if deferred {
-			inputs, err := book.BatchOps(ctx, batch.ID)
-			if err != nil {
-				return notkeep(err, "fetch deferred ops")
-			}
-			ctx = context.WithValue(ctx, simp.KeyBatchInputs, inputs)
-		}
-		ctx = context.WithValue(ctx, simp.KeyModel, m)
-
-		// send
-		if err := bd.BatchSend(ctx, &batch); err != nil {
-			berr := openai.BatchError{Message: err.Error()}
-			if super.Errors == nil {
-				super.Errors = &openai.BatchErrors{}
-			}
-			super.Errors.Data = append(super.Errors.Data, berr)
-			batch.Status = openai.BatchStatusCancelled
-			batch.CancelledAt = now.Unix()
-		} else {
-			batch.Status = openai.BatchStatusInProgress
-			batch.InProgressAt = now.Unix()
-		}
-
-		// post-deferred
-		if deferred {
-			if err := book.DeleteBatchOps(ctx, batch.ID); err != nil {
-				return notkeep(err, "delete deferred ops")
-			}
+			return err
 		}
-		if err := book.UpdateBatch(ctx, books.BatchUpdates(batch)); err != nil {
-			return notkeep(err, "update sub-batch")
+		if ok {
+			sent++
 		}
 	}
 
-	if super.Errors != nil && len(super.Errors.Data) == len(subs) {
+	if sent == 0 && len(subs) > 0 {
 		super.Status = openai.BatchStatusFailed
 		super.CancelledAt = now.Unix()
 	} else {
@@ -330,9 +614,187 @@ func BatchSend(c *fiber.Ctx) error {
 	if err := book.UpdateBatch(ctx, books.BatchUpdates(super)); err != nil {
 		return notkeep(err, "update super batch")
 	}
+	batchEvents.publish(super)
 	return c.JSON(super)
 }
 
+// send will submit the sub-batch, and do the bookkeeping on it; the sub-batch
+// that could not be sent is cancelled, and the error is kept in the superbatch.
+func send(ctx context.Context, super *openai.Batch, sub books.Batch) (bool, error) {
+	book := books.Session()
+	batch := sub.Body
+	batch.ExpiresAt = super.ExpiresAt
+
+	bd, claim, err := findBaldoFor(sub)
+	if err != nil {
+		return false, fmt.Errorf("model %q is not available for batching", sub.Model)
+	}
+	if _, deferred := batch.Metadata[simp.MetaDeferred]; deferred {
+		inputs, err := book.BatchOps(ctx, batch.ID)
+		if err != nil {
+			return false, notkeep(err, "fetch deferred ops")
+		}
+		ctx = context.WithValue(ctx, simp.KeyBatchInputs, simp.SliceInputs(inputs))
+	}
+	ctx = context.WithValue(ctx, simp.KeyModel, claim.Model)
+	// the job is kept the moment the provider has taken it, so that the
+	// reconcile would not cancel the sub-batch that is running upstream
+	ctx = context.WithValue(ctx, simp.KeySent, func(b openai.Batch) {
+		if err := book.UpdateBatch(ctx, books.BatchUpdates(b)); err != nil {
+			log.Errorf("batch %q: %v\n", b.ID, notkeep(err, "keep job"))
+		}
+	})
+
+	// if the daemon dies while sending, this is how it will know
+	batch.Status = openai.BatchStatusValidating
+	if err := book.UpdateBatch(ctx, books.BatchUpdates(batch)); err != nil {
+		return false, notkeep(err, "update sub-batch")
+	}
+	now := time.Now().Unix()
+	err = bd.BatchSend(ctx, &batch)
+	if err != nil {
+		berr := openai.BatchError{Message: err.Error()}
+		if super.Errors == nil {
+			super.Errors = &openai.BatchErrors{}
+		}
+		super.Errors.Data = append(super.Errors.Data, berr)
+		batch.Status = openai.BatchStatusCancelled
+		batch.CancelledAt = now
+	} else {
+		batch.Status = openai.BatchStatusInProgress
+		batch.InProgressAt = now
+	}
+	if err := book.UpdateBatch(ctx, books.BatchUpdates(batch)); err != nil {
+		return false, notkeep(err, "update sub-batch")
+	}
+	return err == nil, nil
+}
+
+func BatchList(c *fiber.Ctx) error {
+	ctx := c.Context()
+	book := books.Session()
+	limit := c.QueryInt("limit", 20)
+	if limit < 1 || limit > 100 {
+		return fmt.Errorf("limit must be between 1 and 100")
+	}
+	// the sub-batches go by the names of the providers' models, and the
+	// ops by the alias that the client has asked for
+	var models string
+	if model := c.Query("model"); model != "" {
+		names := []string{model}
+		for _, cl := range cfg.LookupClaims(model) {
+			if !slices.Contains(names, cl.Model.Name) {
+				names = append(names, cl.Model.Name)
+			}
+		}
+		b, err := json.Marshal(names)
+		if err != nil {
+			return err
+		}
+		models = string(b)
+	}
+	// metadata[key]=value
+	metadata := map[string]string{}
+	for k, v := range c.Queries() {
+		if k, ok := strings.CutPrefix(k, "metadata["); ok && strings.HasSuffix(k, "]") {
+			metadata[strings.TrimSuffix(k, "]")] = v
+		}
+	}
+	filter, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	// one extra to tell if there's more
+	rows, err := book.ListBatches(ctx, books.ListBatchesParams{
+		After:    c.Query("after"),
+		Status:   c.Query("status"),
+		Models:   models,
+		Metadata: string(filter),
+		Limit:    int64(limit) + 1,
+	})
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+	default:
+		return notkeep(err, "list batches")
+	}
+	list := openai.ListBatchResponse{
+		Object: "list",
+		Data:   []openai.Batch{},
+	}
+	if len(rows) > limit {
+		rows = rows[:limit]
+		list.HasMore = true
+	}
+	for _, row := range rows {
+		batch := row.Body
+		counts, err := requestCounts(ctx, batch)
+		if err != nil {
+			return err
+		}
+		batch.RequestCounts = counts
+		list.Data = append(list.Data, batch)
+	}
+	if n := len(list.Data); n > 0 {
+		list.FirstID = list.Data[0].ID
+		list.LastID = list.Data[n-1].ID
+	}
+	return c.JSON(list)
+}
+
+// requestCounts will aggregate the outputs of the superbatch, whether
+// downloaded from the sub-batches, or produced by the implicit ops; the
+// sub-batches that haven't been downloaded yet are counted as reported
+// by their providers.
+func requestCounts(ctx context.Context, super openai.Batch) (openai.BatchRequestCounts, error) {
+	book := books.Session()
+	counts := openai.BatchRequestCounts{Total: super.RequestCounts.Total}
+	outputs, err := book.CountBatchOutputs(ctx, super.ID)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+	default:
+		return counts, notkeep(err, "count batch outputs")
+	}
+	counts.Completed = int(outputs.Completed)
+	counts.Failed = int(outputs.Failed)
+
+	subs, err := book.SubBatches(ctx, &super.ID)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+	default:
+		return counts, notkeep(err, "fetch sub-batches")
+	}
+	// the sub-batches that were retried are accounted for by their retries
+	retried := map[string]bool{}
+	for _, sub := range subs {
+		if sub.RetryOf != nil {
+			retried[*sub.RetryOf] = true
+		}
+	}
+	for _, sub := range subs {
+		if sub.ReceivedAt != nil || retried[sub.ID] {
+			continue
+		}
+		n := sub.Body.RequestCounts
+		counts.Completed += n.Completed
+		switch sub.Body.Status {
+		case openai.BatchStatusFailed, openai.BatchStatusCancelled, openai.BatchStatusExpired:
+			// whatever did not complete by now, never will
+			counts.Failed += n.Total - n.Completed
+		default:
+			counts.Failed += n.Failed
+		}
+	}
+	return counts, nil
+}
+
+// errorFileID is where the failed outputs of the superbatch are served.
+func errorFileID(id string) string {
+	return errorFilePrefix + id
+}
+
 func BatchRefresh(c *fiber.Ctx) error {
 	ctx := c.Context()
 	book := books.Session()
@@ -343,7 +805,13 @@ func BatchRefresh(c *fiber.Ctx) error {
 	}
 	super := row.Body
 	switch super.Status {
-	case openai.BatchStatusCompleted, openai.BatchStatusFailed, openai.BatchStatusCancelled:
+	case openai.BatchStatusCompleted, openai.BatchStatusFailed, openai.BatchStatusCancelled, openai.BatchStatusExpired:
+		return c.JSON(super)
+	}
+	if super.ExpiresAt != 0 && time.Now().Unix() >= super.ExpiresAt {
+		if err := expire(ctx, &super); err != nil {
+			return err
+		}
 		return c.JSON(super)
 	}
 
@@ -351,33 +819,127 @@ func BatchRefresh(c *fiber.Ctx) error {
 	if err != nil {
 		return notkeep(err, "fetch pending sub-batches")
 	}
-	elapsed := 0
-	for i, sub := range subs {
-		batch := &subs[i].Body
+	for i := range subs {
+		if err := refreshSub(ctx, &subs[i]); err != nil {
+			return err
+		}
+	}
+	if err := rollup(ctx, &super); err != nil {
+		return err
+	}
+	return c.JSON(super)
+}
+
+// refreshSub will inquire the provider for the most recent sub-batch status,
+// and download the outputs as soon as the sub-batch is completed.
+func refreshSub(ctx context.Context, sub *books.Batch) error {
+	book := books.Session()
+	batch := &sub.Body
+
+	bd, _, err := findBaldoFor(*sub)
+	if err != nil {
+		return notkeep(err, "model %q is not available for batching", sub.Model)
+	}
+	if err := bd.BatchRefresh(ctx, batch); err != nil {
+		return fmt.Errorf("refresh %s sub-batch failed: %w", sub.Model, err)
+	}
+	switch now := time.Now().Unix(); batch.Status {
+	case openai.BatchStatusFailed:
+		batch.FailedAt = now
+	case openai.BatchStatusCancelled:
+		batch.CancelledAt = now
+	case openai.BatchStatusCompleted:
+		batch.CompletedAt = now
+	}
+	if err := book.UpdateBatch(ctx, books.BatchUpdates(*batch)); err != nil {
+		return notkeep(err, "update sub-batch")
+	}
+	if batch.Status != openai.BatchStatusCompleted {
+		return nil
+	}
+	return receiveSub(ctx, bd, *sub)
+}
 
-		bd, _, err := findBaldo(sub.Model)
+// receiveSub will download the sub-batch outputs to batch_op, so that
+// they would outlive the provider-side result files.
+func receiveSub(ctx context.Context, bd simp.BatchDriver, sub books.Batch) error {
+	batch := sub.Body
+	outputs, err := bd.BatchReceive(ctx, &batch)
+	if err != nil {
+		return fmt.Errorf("receive %s sub-batch failed: %w", sub.Model, err)
+	}
+	tx, err := books.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return notkeep(err, "begin")
+	}
+	defer tx.Rollback()
+
+	book := books.Session().WithTx(tx)
+	// whoever gets to claim the sub-batch first records, and charges for it
+	n, err := book.ReceiveBatch(ctx, sub.ID)
+	if err != nil {
+		return notkeep(err, "receive sub-batch")
+	}
+	if n == 0 {
+		log.Debugf("batch %q has already been received\n", batch.ID)
+		return nil
+	}
+	for i, output := range outputs {
+		err := book.InsertBatchOutput(ctx, books.InsertBatchOutputParams{
+			Batch:    sub.ID,
+			CustomID: output.CustomID,
+			Request:  openai.BatchInput{CustomID: output.CustomID},
+			Response: output,
+		})
 		if err != nil {
-			return notkeep(err, "model %q is not available for batching", sub.Model)
-		}
-		if err := bd.BatchRefresh(ctx, batch); err != nil {
-			return fmt.Errorf("refresh %s sub-batch failed: %w", sub.Model, err)
+			return notkeep(err, "insert batch output/%d", i)
 		}
-		switch now := time.Now().Unix(); batch.Status {
-		case openai.BatchStatusFailed:
-			batch.FailedAt = now
-		case openai.BatchStatusCancelled:
-			batch.CancelledAt = now
-		case openai.BatchStatusCompleted:
-			batch.CompletedAt = now
+	}
+	if err := tx.Commit(); err != nil {
+		return notkeep(err, "commit")
+	}
+	var provider string
+	if sub.Provider != nil {
+		provider = *sub.Provider
+	}
+	failed := 0
+	var g *grant
+	if sub.Super != nil {
+		g = batchGrant(ctx, *sub.Super)
+	}
+	for _, output := range outputs {
+		recordBatch(output, g, sub.Model, provider, 0)
+		name, usage := outputModel(output, sub.Model)
+		g.spendBatch(name, provider, usage)
+		if output.Error != nil {
+			failed++
 		}
-		if err := book.UpdateBatch(ctx, books.BatchUpdates(*batch)); err != nil {
-			return notkeep(err, "update sub-batch")
+	}
+	// there's nothing to retry once every input has come back
+	if failed == 0 && len(outputs) >= batch.RequestCounts.Total {
+		if err := unspool(ctx, sub.ID); err != nil {
+			log.Errorf("batch %q: %v\n", sub.ID, err)
 		}
-		if batch.Status != openai.BatchStatusInProgress {
+	}
+	log.Debugf("batch %q received %d outputs\n", batch.ID, len(outputs))
+	return nil
+}
+
+// rollup will complete the superbatch once none of its sub-batches are in
+// progress, and the implicit ops have all elapsed.
+func rollup(ctx context.Context, super *openai.Batch) error {
+	book := books.Session()
+	subs, err := book.SubBatchesPending(ctx, &super.ID)
+	if err != nil {
+		return notkeep(err, "fetch pending sub-batches")
+	}
+	elapsed := 0
+	for _, sub := range subs {
+		if sub.Body.Status != openai.BatchStatusInProgress {
 			elapsed++
 		}
 	}
-	if elapsed == len(subs) {
+	if super.Status == openai.BatchStatusInProgress && elapsed == len(subs) {
 		ops, err := book.CountBatchOps(ctx, super.ID)
 		switch err {
 		case nil:
@@ -390,51 +952,123 @@ func BatchRefresh(c *fiber.Ctx) error {
 			super.CompletedAt = time.Now().Unix()
 		}
 	}
-	if err := book.UpdateBatch(ctx, books.BatchUpdates(super)); err != nil {
+	counts, err := requestCounts(ctx, *super)
+	if err != nil {
+		return err
+	}
+	super.RequestCounts = counts
+	if counts.Failed > 0 {
+		super.ErrorFileID = errorFileID(super.ID)
+	}
+	if err := book.UpdateBatch(ctx, books.BatchUpdates(*super)); err != nil {
 		return notkeep(err, "update super batch")
 	}
-	return c.JSON(super)
+	batchEvents.publish(*super)
+	return nil
 }
 
+// expire will cancel whatever is still outstanding in the superbatch that
+// has outlived its completion window. The outputs that were received up to
+// this point remain downloadable.
+func expire(ctx context.Context, super *openai.Batch) error {
+	book := books.Session()
+	subs, err := book.SubBatchesPending(ctx, &super.ID)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+	default:
+		return notkeep(err, "fetch pending sub-batches")
+	}
+	now := time.Now().Unix()
+	for _, sub := range subs {
+		batch := sub.Body
+		bd, _, err := findBaldoFor(sub)
+		if err != nil {
+			log.Errorf("batch %q: expire: %v\n", batch.ID, err)
+		} else if err := bd.BatchCancel(ctx, &batch); err != nil {
+			log.Errorf("batch %q: expire: %v\n", batch.ID, err)
+		}
+		batch.Status = openai.BatchStatusExpired
+		batch.ExpiredAt = now
+		if err := book.UpdateBatch(ctx, books.BatchUpdates(batch)); err != nil {
+			return notkeep(err, "update sub-batch")
+		}
+		if bd == nil {
+			continue
+		}
+		// some providers would hand out the partial results straight away
+		sub.Body = batch
+		if err := receiveSub(ctx, bd, sub); err != nil {
+			log.Debugf("batch %q: no partial results: %v\n", batch.ID, err)
+		}
+	}
+	if err := book.CancelBatchOps(ctx, super.ID); err != nil {
+		return notkeep(err, "cancel batch ops")
+	}
+	unspoolAll(ctx, super.ID)
+	super.Status = openai.BatchStatusExpired
+	super.ExpiredAt = now
+	return rollup(ctx, super)
+}
+
+// BatchReceive serves the outputs of the superbatch in JSONL, as many as
+// there are so far.
+//
+// With partial=true, the outputs are served as they come in while the batch
+// is still in progress; the cursor header is to be passed as `after` on the
+// next call, so that only the new outputs would be served.
 func BatchReceive(c *fiber.Ctx) error {
 	ctx := c.Context()
 	book := books.Session()
-	superid := c.Params("id")
+	// the failed outputs are served separately, as per OpenAI
+	superid, failed := strings.CutPrefix(c.Params("id"), errorFilePrefix)
+	if _, err := book.BatchById(ctx, superid); err != nil {
+		return fmt.Errorf("batch not found: %w", err)
+	}
+	var after int64
+	if c.QueryBool("partial") {
+		var err error
+		after, err = strconv.ParseInt(c.Query("after", "0"), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid cursor %q", c.Query("after"))
+		}
+	}
 	subs, err := book.SubBatchesCompleted(ctx, &superid)
 	if err != nil {
 		return fmt.Errorf("batch not found: %w", err)
 	}
-	c.Set("Content-Type", "application/jsonl")
-	w := json.NewEncoder(c.Response().BodyWriter())
-
-	drivers := map[string]simp.BatchDriver{}
+	// the poller may not have gotten to these yet
 	for _, sub := range subs {
-		batch := sub.Body
-		bd, ok := drivers[sub.Model]
-		if !ok {
-			d, _, err := findBaldo(sub.Model)
-			if err != nil {
-				continue
-			}
-			bd = d
+		if sub.ReceivedAt != nil {
+			continue
 		}
-		outputs, err := bd.BatchReceive(ctx, &batch)
+		bd, _, err := findBaldoFor(sub)
 		if err != nil {
 			continue
 		}
-		log.Debugf("batch %q received %d outputs\n", batch.ID, len(outputs))
-		for _, output := range outputs {
-			w.Encode(output)
+		if err := receiveSub(ctx, bd, sub); err != nil {
+			log.Errorf("batch %q: %v\n", sub.ID, err)
 		}
 	}
+	// whatever comes in while the outputs are being served, is left
+	// for the next time around
+	until, err := book.BatchSeq(ctx, superid)
+	if err != nil {
+		return notkeep(err, "fetch batch cursor")
+	}
+	c.Set(cursorHeader, strconv.FormatInt(until, 10))
+	c.Set("Content-Type", "application/jsonl")
+	w := json.NewEncoder(c.Response().BodyWriter())
 
 	const chunkSize = 10000
 
-	for i := int64(0); ; i += chunkSize {
+	for {
 		outputs, err := book.BatchOpsCompleted(ctx, books.BatchOpsCompletedParams{
 			Batch:  superid,
+			Failed: failed,
+			After:  after,
+			Until:  until,
 			Limit:  chunkSize,
-			Offset: i,
 		})
 		switch err {
 		case nil:
@@ -442,8 +1076,9 @@ func BatchReceive(c *fiber.Ctx) error {
 				return nil
 			}
 			for _, output := range outputs {
-				w.Encode(output)
+				w.Encode(output.Response)
 			}
+			after = *outputs[len(outputs)-1].Seq
 		case sql.ErrNoRows:
 			return nil
 		default:
@@ -452,6 +1087,165 @@ func BatchReceive(c *fiber.Ctx) error {
 	}
 }
 
+// BatchRetry will resubmit the sub-batches that have failed or have been
+// cancelled, as well as the individual requests that have failed, under the
+// same superbatch, so that the outputs end up in the original output file.
+func BatchRetry(c *fiber.Ctx) error {
+	ctx := c.Context()
+	book := books.Session()
+	row, err := book.BatchById(ctx, c.Params("id"))
+	if err != nil {
+		return fmt.Errorf("batch not found: %w", err)
+	}
+	super := row.Body
+	switch super.Status {
+	case openai.BatchStatusInProgress, openai.BatchStatusCompleted, openai.BatchStatusFailed:
+	case "":
+		return fmt.Errorf("batch %q has not been sent", super.ID)
+	default:
+		return fmt.Errorf("batch %q is %s, will not retry", super.ID, super.Status)
+	}
+	subs, err := book.SubBatches(ctx, &super.ID)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+	default:
+		return notkeep(err, "fetch sub-batches")
+	}
+
+	// the retries are uploaded first, so that the books are written to in
+	// one go
+	type retry struct {
+		sub     string
+		subs    []staged
+		batched bool
+		sp      *spool
+	}
+	var (
+		retries []retry
+		spools  []*spool
+	)
+	defer func() {
+		for _, sp := range spools {
+			sp.Close()
+		}
+	}()
+	for _, sub := range subs {
+		// the sub-batch is still in progress, or hasn't been downloaded yet
+		if sub.CanceledAt == nil && sub.ReceivedAt == nil {
+			continue
+		}
+		sp, err := newSpool()
+		if err != nil {
+			return notkeep(err, "spool")
+		}
+		spools = append(spools, sp)
+		if err := retryable(ctx, book, sub, sp); err != nil {
+			return err
+		}
+		if sp.n == 0 {
+			continue
+		}
+		bd, claim, err := findBaldoFor(sub)
+		if err != nil {
+			return fmt.Errorf("model %q is not available for batching", sub.Model)
+		}
+		uploaded, batched, err := upload(ctx, super.ID, route{Claim: claim, bd: bd}, sp)
+		if err != nil {
+			return err
+		}
+		retries = append(retries, retry{sub.ID, uploaded, batched, sp})
+	}
+
+	tx, err := books.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return notkeep(err, "begin")
+	}
+	defer tx.Rollback()
+
+	tome := book.WithTx(tx)
+	var (
+		staged  = 0
+		retired []string
+	)
+	for _, r := range retries {
+		if r.batched {
+			if err := keepStaged(ctx, tome, super.ID, &r.sub, r.subs); err != nil {
+				return err
+			}
+		} else {
+			all, err := r.sp.all()
+			if err != nil {
+				return notkeep(err, "spool")
+			}
+			if err := implicitOps(ctx, tome, super.ID, r.sp.inputs(all)); err != nil {
+				return err
+			}
+		}
+		if err := tome.RetireBatchOps(ctx, r.sub); err != nil {
+			return notkeep(err, "retire batch ops")
+		}
+		staged += r.sp.n
+		retired = append(retired, r.sub)
+	}
+	// the failed implicit ops are simply done over
+	n, err := tome.RetryBatchOps(ctx, super.ID)
+	if err != nil {
+		return notkeep(err, "retry batch ops")
+	}
+	if staged == 0 && n == 0 {
+		return fmt.Errorf("batch %q has nothing to retry", super.ID)
+	}
+	if err := tx.Commit(); err != nil {
+		return notkeep(err, "commit")
+	}
+	for _, sp := range spools {
+		keepReferred(ctx, sp)
+	}
+	// the retries have spools of their own
+	for _, id := range retired {
+		if err := unspool(ctx, id); err != nil {
+			log.Errorf("batch %q: %v\n", id, err)
+		}
+	}
+	log.Infof("batch %q retrying %d requests\n", super.ID, staged+int(n))
+
+	// the completion window starts over
+	now := time.Now()
+	if window, err := time.ParseDuration(super.CompletionWindow); err == nil {
+		super.ExpiresAt = now.Add(window).Unix()
+	}
+	pending, err := book.SubBatchesPending(ctx, &super.ID)
+	if err != nil {
+		return notkeep(err, "fetch pending sub-batches")
+	}
+	sent := 0
+	for _, sub := range pending {
+		if sub.Body.Status != "" {
+			continue
+		}
+		ok, err := send(ctx, &super, sub)
+		if err != nil {
+			return err
+		}
+		if ok {
+			sent++
+		}
+	}
+	super.CompletedAt, super.FailedAt, super.CancelledAt = 0, 0, 0
+	if sent == 0 && n == 0 {
+		super.Status = openai.BatchStatusFailed
+		super.FailedAt = now.Unix()
+	} else {
+		super.Status = openai.BatchStatusInProgress
+		super.InProgressAt = now.Unix()
+	}
+	if err := rollup(ctx, &super); err != nil {
+		return err
+	}
+	return c.JSON(super)
+}
+
 func BatchCancel(c *fiber.Ctx) error {
 	ctx := c.Context()
 	book := books.Session()
@@ -471,7 +1265,7 @@ func BatchCancel(c *fiber.Ctx) error {
 		return notkeep(err, "fetch pending sub-batches")
 	}
 	for _, sub := range subs {
-		bd, _, err := findBaldo(sub.Model)
+		bd, _, err := findBaldoFor(sub)
 		if err != nil {
 			return fmt.Errorf("model %q is not available for batching", sub.Model)
 		}
@@ -488,11 +1282,13 @@ func BatchCancel(c *fiber.Ctx) error {
 	if err := book.CancelBatchOps(ctx, id); err != nil {
 		return notkeep(err, "cancel batch ops")
 	}
+	unspoolAll(ctx, id)
 	batch := super.Body
 	batch.Status = openai.BatchStatusCancelled
 	batch.CancelledAt = time.Now().Unix()
 	if err := book.UpdateBatch(ctx, books.BatchUpdates(batch)); err != nil {
 		return notkeep(err, "update superbatch")
 	}
+	batchEvents.publish(batch)
 	return c.JSON(batch)
 }
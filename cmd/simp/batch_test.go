@@ -10,7 +10,7 @@ import (
 	"time"
 
 	"github.com/busthorne/simp/books"
-	"github.com/busthorne/simp/driver"
+	"github.com/busthorne/simp/config"
 	"github.com/sashabaranov/go-openai"
 )
 
@@ -69,7 +69,7 @@ func batch(t *testing.T) {
 	if len(models) == 0 {
 		t.Fatal("unknown setup:", setup)
 	}
-	drv, err := driver.NewDaemon(*cfg.Daemon)
+	drv, err := daemonDriver(*cfg.Daemon)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -157,3 +157,38 @@ func batch(t *testing.T) {
 	}
 	t.Fatalf("expected %d outputs, got %d", len(inputs), len(outputs))
 }
+
+func TestPartitionDaemon(t *testing.T) {
+	defer func(c *config.Config) { cfg = c }(cfg)
+	// the daemon is nowhere to be found, but the plan is made by config
+	cfg = &config.Config{
+		Daemon: &config.Daemon{DaemonAddr: "http://127.0.0.1:1"},
+		Providers: []config.Provider{
+			{Driver: "openai", Name: "api", APIKey: "-", Models: []config.Model{
+				{Name: "gpt-4o-mini"},
+				{Name: "text-embedding-3-small", Embedding: true},
+			}},
+		},
+	}
+	cfg.ClearCache()
+	defer cfg.ClearCache()
+
+	const input = `{"custom_id":"a","body":{"model":"gpt-4o-mini","messages":[{"role":"user","content":"hi"}]}}
+{"custom_id":"b","url":"/v1/embeddings","body":{"model":"text-embedding-3-small","input":[{"text":"hi"}]}}
+`
+	parts, err := partition(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parts.Close()
+	for _, model := range []string{"gpt-4o-mini", "text-embedding-3-small"} {
+		if _, ok := parts.spools[model]; !ok {
+			t.Errorf("model %q was not partitioned", model)
+		}
+	}
+
+	_, err = partition(strings.NewReader(`{"custom_id":"c","url":"/v1/embeddings","body":{"model":"gpt-4o-mini","input":[{"text":"hi"}]}}`))
+	if err == nil || !strings.Contains(err.Error(), "not an embedding model") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
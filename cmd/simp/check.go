@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/busthorne/simp"
+)
+
+// batchPlan is what would become of the batch input file, had it been
+// uploaded for real; this is what the dry run responds with.
+type batchPlan struct {
+	Requests int         `json:"requests"`
+	Tokens   int64       `json:"tokens"`
+	Models   []modelPlan `json:"models"`
+}
+
+// modelPlan is the partition of one model.
+type modelPlan struct {
+	Model string `json:"model"`
+	// the provider that it would be routed to
+	Provider string `json:"provider"`
+	// native, deferred, or implicit
+	Mode       string    `json:"mode"`
+	Requests   int       `json:"requests"`
+	Tokens     int64     `json:"tokens"`
+	SubBatches []subPlan `json:"sub_batches,omitempty"`
+}
+
+type subPlan struct {
+	Requests int      `json:"requests"`
+	Bytes    int64    `json:"bytes"`
+	Tokens   int64    `json:"tokens"`
+	Cost     *float64 `json:"cost,omitempty"`
+}
+
+// plan will work out the routes, and the sub-batches, without writing, or
+// uploading anything; the drivers are asked to check the inputs, and tell
+// whether they would batch them.
+func (p *partitions) plan(ctx context.Context) (plan batchPlan, err error) {
+	for model, sp := range p.spools {
+		mp := modelPlan{Model: model, Mode: "implicit"}
+		if _, provider, ok := cfg.LookupModel(model); ok {
+			mp.Provider = provider.ID()
+		}
+		whole, err := sp.all()
+		if err != nil {
+			return plan, notkeep(err, "read spool")
+		}
+		var sections []section
+		for _, r := range p.routes(model) {
+			if sections, err = sp.split(batchLimits(r.Provider, r.bd)); err != nil {
+				return plan, notkeep(err, "split spool")
+			}
+			ctx := context.WithValue(ctx, simp.KeyModel, r.Model)
+			switch err := r.bd.BatchCheck(ctx, sp.inputs(whole)); err {
+			case nil:
+				mp.Mode = "native"
+			case simp.ErrBatchDeferred:
+				mp.Mode = "deferred"
+			case simp.ErrNotImplemented:
+				continue
+			default:
+				return plan, fmt.Errorf("batch would fail for model %q: %w", model, err)
+			}
+			mp.Provider = r.Provider.ID()
+			for _, sect := range sections {
+				mp.SubBatches = append(mp.SubBatches, subPlan{
+					Requests: sect.n,
+					Bytes:    sect.size,
+					Tokens:   sect.tokens,
+					Cost:     r.cost(sect.tokens),
+				})
+			}
+			break
+		}
+		if mp.Mode == "implicit" {
+			if sections, err = sp.split(simp.BatchLimits{}); err != nil {
+				return plan, notkeep(err, "split spool")
+			}
+		}
+		for _, sect := range sections {
+			mp.Requests += sect.n
+			mp.Tokens += sect.tokens
+		}
+		plan.Requests += mp.Requests
+		plan.Tokens += mp.Tokens
+		plan.Models = append(plan.Models, mp)
+	}
+	sort.Slice(plan.Models, func(i, j int) bool {
+		return plan.Models[i].Model < plan.Models[j].Model
+	})
+	return plan, nil
+}
+
+// batchCheck validates the batch input file as the daemon would, and
+// prints the plan without writing anything.
+func batchCheck(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	parts, err := partition(f)
+	if err != nil {
+		return err
+	}
+	defer parts.Close()
+	plan, err := parts.plan(bg)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "MODEL\tPROVIDER\tMODE\tREQUESTS\tTOKENS\tSUB-BATCHES")
+	for _, mp := range plan.Models {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t~%d\t%d\n",
+			mp.Model, mp.Provider, mp.Mode, mp.Requests, mp.Tokens, len(mp.SubBatches))
+	}
+	fmt.Fprintf(w, "\t\t\t%d\t~%d\t\n", plan.Requests, plan.Tokens)
+	return w.Flush()
+}
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/busthorne/simp"
+	"github.com/gofiber/fiber/v2"
 	"github.com/sashabaranov/go-openai"
 )
 
@@ -67,8 +68,8 @@ func promptComplete() error {
 		}
 	}
 	start := time.Now()
-	ctx := context.WithValue(bg, simp.KeyModel, m)
-	resp, err := drv.Chat(ctx, openai.ChatCompletionRequest{
+	ctx, provider := serving(context.WithValue(bg, simp.KeyModel, m))
+	resp, err := chat(ctx, drv, backoffOf(m.Name), openai.ChatCompletionRequest{
 		Stream:           !*nos,
 		Model:            m.Name,
 		Messages:         cable.Messages(),
@@ -79,6 +80,13 @@ func promptComplete() error {
 		StreamOptions:    so,
 	})
 	if err != nil {
+		recordCLI(drv, entry{
+			kind:     "chat",
+			model:    m.Name,
+			provider: *provider,
+			latency:  time.Since(start),
+			status:   statusOf(err),
+		})
 		stderrf("%T %v\n", drv, err)
 		exit(1)
 	}
@@ -108,6 +116,14 @@ func promptComplete() error {
 	}
 	fmt.Println()
 suffix:
+	recordCLI(drv, entry{
+		kind:     "chat",
+		model:    answered(drv, m, resp.Model),
+		provider: *provider,
+		usage:    resp.Usage,
+		latency:  time.Since(start),
+		status:   fiber.StatusOK,
+	})
 	if *verbose {
 		stderrf("\n\t\t\t%d", resp.Usage.PromptTokens)
 		if resp.Usage.PromptTokensDetails != nil {
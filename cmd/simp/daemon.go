@@ -3,9 +3,12 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"strings"
 	"time"
 
@@ -17,13 +20,43 @@ import (
 	"github.com/sashabaranov/go-openai"
 )
 
+// the bodies of the requests, save for the batch uploads
+const bodyLimit = 10 << 22 // 40 MB
+
+// holdBody holds the bodies that are streamed to the limit, unless they're
+// the batch uploads, which are spooled to disk as they're read.
+func holdBody(c *fiber.Ctx) error {
+	req := c.Request()
+	if !req.IsBodyStream() || c.Path() == "/v1/files" {
+		return c.Next()
+	}
+	b, err := io.ReadAll(io.LimitReader(req.BodyStream(), bodyLimit+1))
+	if err != nil {
+		return err
+	}
+	if len(b) > bodyLimit {
+		// the rest of the body is not going to be read
+		c.Context().SetConnectionClose()
+		return fiber.ErrRequestEntityTooLarge
+	}
+	req.SetBody(b)
+	return c.Next()
+}
+
 func listen() *fiber.App {
-	nop := notImplemented
-	once := cache.New(cache.Config{Expiration: time.Hour})
+	once := cache.New(cache.Config{
+		Expiration: time.Hour,
+		// the models are listed as far as the client may use them, so the
+		// list is cached by the address, and the grant of the client
+		KeyGenerator: func(c *fiber.Ctx) string {
+			return c.Path() + "@" + clientIP(c).String() + "/" + grantOf(c).principal()
+		},
+	})
 
 	f := fiber.New(fiber.Config{
 		DisableStartupMessage: true,
-		BodyLimit:             10 << 27, // 1.34 GB
+		BodyLimit:             bodyLimit,
+		StreamRequestBody:     true,     // the batch uploads, see holdBody
 		ReadBufferSize:        10 << 10, // 10 KB
 		WriteBufferSize:       10 << 12, // 40 KB
 	})
@@ -32,7 +65,7 @@ func listen() *fiber.App {
 		if err = c.Next(); err == nil {
 			return nil
 		}
-		log.Errorf("%s %s %v\n", c.Method(), c.Path(), err)
+		log.Errorf("%s %s %s: %v\n", who(c), c.Method(), c.Path(), err)
 		if errors.Is(err, simp.ErrBookkeeping) {
 			c.Status(fiber.StatusInternalServerError)
 			return c.JSON(fiber.Map{"error": fiber.Map{
@@ -46,7 +79,7 @@ func listen() *fiber.App {
 		if un := errors.Unwrap(err); un != nil {
 			err = un
 		}
-		if apiErr, ok := err.(*openai.APIError); ok {
+		if apiErr := (*openai.APIError)(nil); errors.As(err, &apiErr) {
 			errType = apiErr.Type
 		}
 		return c.JSON(fiber.Map{"error": fiber.Map{
@@ -54,6 +87,9 @@ func listen() *fiber.App {
 			"type":    errType,
 		}})
 	})
+	f.Use(holdBody)
+	f.Use(allowIPs)
+	f.Use(authorize)
 
 	v1 := f.Group("/v1")
 	v1.Get("/ping", func(c *fiber.Ctx) error {
@@ -71,6 +107,9 @@ func listen() *fiber.App {
 				}
 			}
 			for _, m := range p.Models {
+				if !mayUse(c, m, p) {
+					continue
+				}
 				omm := openai.Model{
 					ID:         m.Name,
 					Object:     "model",
@@ -89,18 +128,40 @@ func listen() *fiber.App {
 		if err := c.BodyParser(&req); err != nil {
 			return err
 		}
+		if err := permit(c, string(req.Model)); err != nil {
+			return err
+		}
 		drv, model, err := findWaldo(string(req.Model))
 		if err != nil {
 			return err
 		}
-		log.Debugf("embedding model %s (%T)\n", model.Name, drv)
+		if drv = usable(c, drv); drv == nil {
+			return forbidden(c, "model "+string(req.Model))
+		}
+		log.Debugf("%s embedding model %s (%T)\n", who(c), model.Name, drv)
 		req.Model = model.Name
-		ctx := context.WithValue(c.Context(), simp.KeyModel, model)
-		resp, err := drv.Embed(ctx, req)
+		ctx, release, err := throttled(c, simp.EstimateTokens(openai.BatchInput{Embedding: &req}))
+		if err != nil {
+			return err
+		}
+		ctx, provider := serving(context.WithValue(ctx, simp.KeyModel, model))
+		start := time.Now()
+		resp, err := embed(ctx, drv, backoffOf(model.Name), req)
+		release(int64(resp.Usage.TotalTokens))
+		resp.Model = openai.EmbeddingModel(answered(drv, model, string(resp.Model)))
+		record(entry{
+			kind:      "embedding",
+			model:     string(resp.Model),
+			provider:  *provider,
+			principal: principalOf(c),
+			usage:     resp.Usage,
+			latency:   time.Since(start),
+			status:    statusOf(err),
+		})
 		if err != nil {
-			return internalError(c, err)
+			return upstreamError(c, err)
 		}
-		resp.Model = openai.EmbeddingModel(model.Name)
+		grantOf(c).spend(string(resp.Model), *provider, resp.Usage)
 		resp.Object = "list"
 		for i := range resp.Data {
 			resp.Data[i].Object = "embedding"
@@ -112,35 +173,81 @@ func listen() *fiber.App {
 		if err := c.BodyParser(&req); err != nil {
 			return err
 		}
+		if err := permit(c, req.Model); err != nil {
+			return err
+		}
 		drv, model, err := findWaldo(req.Model)
 		if err != nil {
 			return err
 		}
-		log.Debugf("completion model %s (%T)\n", model.Name, drv)
+		if drv = usable(c, drv); drv == nil {
+			return forbidden(c, "model "+req.Model)
+		}
+		log.Debugf("%s completion model %s (%T)\n", who(c), model.Name, drv)
 		req.Model = model.Name
-		ctx := context.WithValue(c.Context(), simp.KeyModel, model)
-		resp, err := drv.Chat(ctx, req)
+		ctx, release, err := throttled(c, simp.EstimateTokens(openai.BatchInput{ChatCompletion: &req}))
+		if err != nil {
+			return err
+		}
+		ctx, provider := serving(context.WithValue(ctx, simp.KeyModel, model))
+		start := time.Now()
+		resp, err := chat(ctx, drv, backoffOf(model.Name), req)
+		name := answered(drv, model, resp.Model)
+		e := entry{
+			kind:      "chat",
+			model:     name,
+			provider:  *provider,
+			principal: principalOf(c),
+		}
 		if err != nil {
-			return internalError(c, err)
+			release(0)
+			e.latency, e.status = time.Since(start), statusOf(err)
+			record(e)
+			return upstreamError(c, err)
 		}
 		if !req.Stream {
+			release(int64(resp.Usage.TotalTokens))
+			grantOf(c).spend(name, *provider, resp.Usage)
+			e.usage, e.latency, e.status = resp.Usage, time.Since(start), fiber.StatusOK
+			record(e)
 			resp.Object = "chat.completion"
-			resp.Model = model.Name
+			resp.Model = name
 			return c.JSON(resp)
 		}
+		g := grantOf(c)
 		c.Set("Content-Type", "text/event-stream")
 		c.Set("Cache-Control", "no-cache")
 		c.Set("Connection", "keep-alive")
 		c.Set("Transfer-Encoding", "chunked")
 		c.Status(200)
 		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
-			var ret error
+			var (
+				ret   error
+				usage openai.Usage
+			)
+			defer func() {
+				// the rest of the stream, if any, so that the gate would let go
+				go func(rest <-chan openai.ChatCompletionStreamResponse) {
+					for range rest {
+					}
+				}(resp.Stream)
+				release(int64(usage.TotalTokens))
+				g.spend(name, *provider, usage)
+				e.usage, e.latency, e.status = usage, time.Since(start), statusOf(ret)
+				record(e)
+			}()
 			for chunk := range resp.Stream {
+				if chunk.Error != nil {
+					ret = chunk.Error
+					break
+				}
 				if len(chunk.Choices) == 0 {
 					if chunk.Usage != nil {
+						usage = *chunk.Usage
 						fmt.Fprint(w, "data: ")
 						json.NewEncoder(w).Encode(openai.ChatCompletionStreamResponse{
 							Object:  "chat.completion.chunk",
+							Model:   name,
 							Usage:   chunk.Usage,
 							Created: time.Now().Unix(),
 						})
@@ -161,6 +268,7 @@ func listen() *fiber.App {
 				fmt.Fprint(w, "data: ")
 				json.NewEncoder(w).Encode(openai.ChatCompletionStreamResponse{
 					Object: "chat.completion.chunk",
+					Model:  name,
 					Choices: []openai.ChatCompletionStreamChoice{{
 						FinishReason: c.FinishReason,
 						Delta:        delta}},
@@ -187,17 +295,33 @@ func listen() *fiber.App {
 		})
 		return nil
 	})
+	v1.Get("/usage", Usage)
 	v1.Post("/files", BatchUpload)
 	v1.Get("/files/:id/content", BatchReceive)
-	v1.Get("/batches", nop)
+	v1.Get("/batches", BatchList)
 	v1.Post("/batches", BatchSend)
 	v1.Post("/batches/:id/cancel", BatchCancel)
+	v1.Post("/batches/:id/retry", BatchRetry)
+	v1.Get("/batches/:id/events", BatchEvents)
 	v1.Get("/batches/:id", BatchRefresh)
 
 	addr := strings.Split(cfg.Daemon.ListenAddr, "://")
 	switch addr[0] {
 	case "https":
-		log.Fatal("HTTPS is not supported yet.")
+		tlsConfig, err := serverTLS(*cfg.Daemon)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ln, err := tls.Listen("tcp", addr[1], tlsConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("listening on %s\n", cfg.Daemon.ListenAddr)
+		go func() {
+			if err := f.Listener(ln); err != nil {
+				log.Fatal(err)
+			}
+		}()
 	case "http":
 		log.Infof("listening on %s\n", cfg.Daemon.ListenAddr)
 		go func() {
@@ -216,6 +340,23 @@ func internalError(c *fiber.Ctx, err error) error {
 	return err
 }
 
+// upstreamError is the error that the provider had failed with; if it was
+// transient, and the retries didn't help, the client is asked to retry.
+func upstreamError(c *fiber.Ctx, err error) error {
+	if errors.As(err, new(rateLimited)) {
+		return tooMany(c, err)
+	}
+	if !errors.Is(err, simp.ErrRetry) {
+		return internalError(c, err)
+	}
+	c.Status(fiber.StatusServiceUnavailable)
+	var re *simp.RetryError
+	if errors.As(err, &re) && re.After > 0 {
+		c.Set(fiber.HeaderRetryAfter, fmt.Sprint(int(math.Ceil(re.After.Seconds()))))
+	}
+	return err
+}
+
 func notImplemented(c *fiber.Ctx) error {
 	c.Status(fiber.StatusNotImplemented)
 	return simp.ErrNotImplemented
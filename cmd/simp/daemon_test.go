@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestHoldBody(t *testing.T) {
+	f := fiber.New(fiber.Config{
+		BodyLimit:         bodyLimit,
+		StreamRequestBody: true,
+	})
+	f.Use(holdBody)
+	f.Post("/*", func(c *fiber.Ctx) error {
+		return c.SendString(strconv.Itoa(len(c.Body())))
+	})
+	big := bytes.Repeat([]byte("x"), bodyLimit+1)
+	for _, r := range []struct {
+		path string
+		body []byte
+		want int
+	}{
+		{"/v1/files", big, fiber.StatusOK},
+		{"/v1/chat/completions", big, fiber.StatusRequestEntityTooLarge},
+		{"/v1/chat/completions", []byte("{}"), fiber.StatusOK},
+	} {
+		req := httptest.NewRequest("POST", r.path, bytes.NewReader(r.body))
+		req.Close = true
+		resp, err := f.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != r.want {
+			t.Errorf("%s: %d, want %d", r.path, resp.StatusCode, r.want)
+		}
+	}
+}
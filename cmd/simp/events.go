@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/busthorne/simp/books"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+// how many of the most recent errors go with the event
+const eventsErrors = 10
+
+// how often the idle event streams are pinged
+var eventsKeepalive = 15 * time.Second
+
+// batchEvents is where the batch progress is published.
+var batchEvents = hub{watchers: map[string]map[chan openai.Batch]bool{}}
+
+// hub fans out the superbatch updates to whoever is watching.
+//
+// The watchers are only ever interested in the latest state of the batch,
+// so the updates that the watcher has not caught up with are dropped.
+type hub struct {
+	sync.Mutex
+
+	// watchers by superbatch id
+	watchers map[string]map[chan openai.Batch]bool
+	// closed on hangup
+	done chan struct{}
+}
+
+// watch subscribes to the superbatch updates until unwatch is called, or
+// until the hub hangs up, which is when done is closed.
+func (h *hub) watch(id string) (updates chan openai.Batch, done <-chan struct{}, unwatch func()) {
+	h.Lock()
+	defer h.Unlock()
+	if h.done == nil {
+		h.done = make(chan struct{})
+	}
+	done = h.done
+	updates = make(chan openai.Batch, 1)
+	if h.watchers[id] == nil {
+		h.watchers[id] = map[chan openai.Batch]bool{}
+	}
+	h.watchers[id][updates] = true
+	return updates, done, func() {
+		h.Lock()
+		defer h.Unlock()
+		delete(h.watchers[id], updates)
+		if len(h.watchers[id]) == 0 {
+			delete(h.watchers, id)
+		}
+	}
+}
+
+// watched tells whether anybody is watching the superbatch.
+func (h *hub) watched(id string) bool {
+	h.Lock()
+	defer h.Unlock()
+	return len(h.watchers[id]) > 0
+}
+
+// hangup lets go of whoever is watching, so that the streams would end, and
+// the server that has them could shut down.
+func (h *hub) hangup() {
+	h.Lock()
+	defer h.Unlock()
+	if h.done != nil {
+		close(h.done)
+		h.done = nil
+	}
+}
+
+// publish will never block; the stale update is replaced by the latest one.
+func (h *hub) publish(batch openai.Batch) {
+	h.Lock()
+	defer h.Unlock()
+	for updates := range h.watchers[batch.ID] {
+		select {
+		case <-updates:
+		default:
+		}
+		updates <- batch
+	}
+}
+
+// BatchEvents streams the superbatch progress as server-sent events: the
+// batch itself, with up-to-date request counts, whenever it changes, and
+// the most recent errors whenever there are new ones.
+//
+// The stream ends once the batch is in a terminal state, or the server is
+// shutting down.
+func BatchEvents(c *fiber.Ctx) error {
+	row, err := books.Session().BatchById(c.UserContext(), c.Params("id"))
+	if err != nil {
+		return fmt.Errorf("batch not found: %w", err)
+	}
+	if row.Super != nil {
+		return fmt.Errorf("batch %q is a sub-batch", row.ID)
+	}
+	super := row.Body
+	counts, err := requestCounts(bg, super)
+	if err != nil {
+		return err
+	}
+	super.RequestCounts = counts
+	updates, done, unwatch := batchEvents.watch(super.ID)
+
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+	c.Set("Transfer-Encoding", "chunked")
+	c.Status(200)
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer unwatch()
+
+		keepalive := time.NewTicker(eventsKeepalive)
+		defer keepalive.Stop()
+		failed := 0
+		for {
+			if err := batchEvent(w, super, &failed); err != nil {
+				log.Debugf("batch %q events: %v\n", super.ID, err)
+				return
+			}
+			switch super.Status {
+			case openai.BatchStatusCompleted, openai.BatchStatusFailed,
+				openai.BatchStatusCancelled, openai.BatchStatusExpired:
+				return
+			}
+			for idle := true; idle; {
+				select {
+				case super = <-updates:
+					idle = false
+				case <-done:
+					return
+				case <-keepalive.C:
+					// the client is gone if the ping won't go through
+					fmt.Fprint(w, ": ping\n\n")
+					if err := w.Flush(); err != nil {
+						return
+					}
+				}
+			}
+		}
+	})
+	return nil
+}
+
+// batchEvent writes the batch, and the latest errors if there are new ones.
+func batchEvent(w *bufio.Writer, super openai.Batch, failed *int) error {
+	b, err := json.Marshal(super)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "event: batch\ndata: %s\n\n", b)
+	if super.RequestCounts.Failed > *failed {
+		*failed = super.RequestCounts.Failed
+		outputs, err := books.Session().LatestBatchErrors(bg, books.LatestBatchErrorsParams{
+			Batch: super.ID,
+			Limit: eventsErrors,
+		})
+		if err != nil {
+			return notkeep(err, "fetch latest errors")
+		}
+		if len(outputs) > 0 {
+			b, err := json.Marshal(outputs)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "event: errors\ndata: %s\n\n", b)
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/busthorne/simp/books"
+	"github.com/gofiber/fiber/v2"
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestHub(t *testing.T) {
+	h := hub{watchers: map[string]map[chan openai.Batch]bool{}}
+	updates, done, unwatch := h.watch("a")
+	if !h.watched("a") || h.watched("b") {
+		t.Fatal("unexpected watchers")
+	}
+	// the watcher only gets the latest state
+	for _, status := range []openai.BatchStatus{
+		openai.BatchStatusInProgress,
+		openai.BatchStatusCompleted,
+	} {
+		h.publish(openai.Batch{ID: "a", Status: status})
+	}
+	h.publish(openai.Batch{ID: "b"})
+	if got := <-updates; got.Status != openai.BatchStatusCompleted {
+		t.Fatalf("got %q, want the latest update", got.Status)
+	}
+	select {
+	case got := <-updates:
+		t.Fatalf("unexpected update %+v", got)
+	default:
+	}
+	unwatch()
+	if h.watched("a") {
+		t.Fatal("still watched")
+	}
+	h.hangup()
+	if !isClosed(done) {
+		t.Fatal("not hung up")
+	}
+	// the hub is good for the next server
+	if _, done, _ := h.watch("a"); isClosed(done) {
+		t.Fatal("hung up on the next watcher")
+	}
+}
+
+func isClosed(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestBatchEvents(t *testing.T) {
+	if err := books.Open(":memory:"); err != nil {
+		t.Fatal(err)
+	}
+	defer func(d time.Duration) { eventsKeepalive = d }(eventsKeepalive)
+	eventsKeepalive = 10 * time.Millisecond
+
+	for _, b := range []openai.Batch{
+		{ID: "done", Status: openai.BatchStatusCompleted},
+		{ID: "going", Status: openai.BatchStatusInProgress},
+	} {
+		if err := books.Session().InsertBatch(bg, books.InsertBatchParams{ID: b.ID, Body: b}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f := fiber.New()
+	f.Get("/v1/batches/:id/events", BatchEvents)
+	events := func(id string, then func()) string {
+		body := make(chan string, 1)
+		go func() {
+			resp, err := f.Test(httptest.NewRequest("GET", "/v1/batches/"+id+"/events", nil), -1)
+			if err != nil {
+				body <- err.Error()
+				return
+			}
+			b, _ := io.ReadAll(resp.Body)
+			body <- string(b)
+		}()
+		if then != nil {
+			for deadline := time.Now().Add(5 * time.Second); !batchEvents.watched(id); {
+				if time.Now().After(deadline) {
+					t.Fatalf("%s: nobody is watching", id)
+				}
+				time.Sleep(time.Millisecond)
+			}
+			then()
+		}
+		select {
+		case b := <-body:
+			return b
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: the stream would not end", id)
+		}
+		return ""
+	}
+
+	// the batch that is done is done
+	if b := events("done", nil); strings.Count(b, "event: batch") != 1 || !strings.Contains(b, `"completed"`) {
+		t.Errorf("done: %q", b)
+	}
+	// the idle stream is pinged, until the batch is done
+	b := events("going", func() {
+		time.Sleep(5 * eventsKeepalive)
+		batchEvents.publish(openai.Batch{ID: "going", Status: openai.BatchStatusCompleted})
+	})
+	if strings.Count(b, "event: batch") != 2 || !strings.Contains(b, ": ping") || !strings.Contains(b, `"completed"`) {
+		t.Errorf("going: %q", b)
+	}
+	// the shutdown would not wait for the batch
+	b = events("going", batchEvents.hangup)
+	if strings.Count(b, "event: batch") != 1 {
+		t.Errorf("hangup: %q", b)
+	}
+}
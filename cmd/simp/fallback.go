@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/busthorne/simp"
+	"github.com/busthorne/simp/config"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+// fallback is the driver of the model with fallbacks; the models are tried
+// in order until one of them answers.
+type fallback struct {
+	chain []link
+}
+
+// link is one model of the fallback chain, and its driver.
+type link struct {
+	simp.Driver
+	model config.Model
+}
+
+// fallbackFor makes the chain of the model, if it has any fallbacks; the
+// fallbacks that cannot be driven are left out.
+func fallbackFor(d simp.Driver, m config.Model) simp.Driver {
+	if len(m.Fallback) == 0 {
+		return d
+	}
+	f := &fallback{chain: []link{{d, m}}}
+	for _, alias := range m.Fallback {
+		fm, p, ok := cfg.LookupModel(alias)
+		if !ok {
+			log.Warnf("model %s: fallback %s is not found\n", m.Name, alias)
+			continue
+		}
+		fd, err := drive(p)
+		if err != nil {
+			log.Warnf("model %s: fallback %s: %v\n", m.Name, alias, err)
+			continue
+		}
+		fd = gate{fd, config.Claim{Model: fm, Provider: p}}
+		f.chain = append(f.chain, link{balancerFor(alias, fd, fm, p), fm})
+	}
+	return f
+}
+
+// fallsBack tells whether the next model might do better.
+func fallsBack(err error) bool {
+	return errors.Is(err, simp.ErrRetry) ||
+		errors.Is(err, simp.ErrContextLength) ||
+		errors.Is(err, simp.ErrContentFilter)
+}
+
+// answered is the name of the model that has actually answered; only the
+// fallback chain, or the balancer would know, otherwise it's the model
+// requested.
+func answered(d simp.Driver, m config.Model, model string) string {
+	switch d.(type) {
+	case *fallback, *balancer:
+		if model != "" {
+			return model
+		}
+	}
+	return m.Name
+}
+
+// through calls the links in turn for as long as they fail in a way that
+// the next one might not; the last link gets the final say.
+func through[T any](ctx context.Context, f *fallback, call func(ctx context.Context, l link, last bool) (T, error)) (v T, err error) {
+	for i, l := range f.chain {
+		last := i == len(f.chain)-1
+		v, err = call(context.WithValue(ctx, simp.KeyModel, l.model), l, last)
+		switch {
+		case err == nil:
+			if i > 0 {
+				log.Warnf("model %s answered for %s\n", l.model.Name, f.chain[0].model.Name)
+			}
+			return v, nil
+		case !fallsBack(err) || last:
+			return v, err
+		}
+		log.Warnf("model %s failed, falling back to %s: %v\n", l.model.Name, f.chain[i+1].model.Name, err)
+	}
+	return
+}
+
+func (f *fallback) List(ctx context.Context) ([]openai.Model, error) {
+	return f.chain[0].List(ctx)
+}
+
+func (f *fallback) Embed(ctx context.Context, req openai.EmbeddingRequest) (openai.EmbeddingResponse, error) {
+	return through(ctx, f, func(ctx context.Context, l link, last bool) (openai.EmbeddingResponse, error) {
+		req.Model = l.model.Name
+		resp, err := l.Embed(ctx, req)
+		if resp.Model == "" {
+			resp.Model = openai.EmbeddingModel(l.model.Name)
+		}
+		return resp, err
+	})
+}
+
+func (f *fallback) Complete(ctx context.Context, req openai.CompletionRequest) (openai.CompletionResponse, error) {
+	return through(ctx, f, func(ctx context.Context, l link, last bool) (openai.CompletionResponse, error) {
+		req.Model = l.model.Name
+		resp, err := l.Complete(ctx, req)
+		if resp.Model == "" {
+			resp.Model = l.model.Name
+		}
+		return resp, err
+	})
+}
+
+// Chat falls back on the filtered answers, too, unless it's the last link;
+// the stream may only fall back before its first chunk.
+func (f *fallback) Chat(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	return through(ctx, f, func(ctx context.Context, l link, last bool) (openai.ChatCompletionResponse, error) {
+		req.Model = l.model.Name
+		resp, err := l.Chat(ctx, req)
+		if err != nil {
+			return resp, err
+		}
+		// the driver knows best which model has answered
+		if resp.Model == "" {
+			resp.Model = l.model.Name
+		}
+		var (
+			first  *openai.ChatCompletionStreamResponse
+			reason openai.FinishReason
+		)
+		if resp, first, err = peek(resp); err != nil {
+			return resp, err
+		}
+		switch {
+		case first != nil && len(first.Choices) > 0:
+			reason = first.Choices[0].FinishReason
+		case len(resp.Choices) > 0:
+			reason = resp.Choices[0].FinishReason
+		}
+		if reason == openai.FinishReasonContentFilter && !last {
+			if resp.Stream != nil {
+				go func(rest <-chan openai.ChatCompletionStreamResponse) {
+					for range rest {
+					}
+				}(resp.Stream)
+			}
+			return resp, fmt.Errorf("model %s: %w", l.model.Name, simp.ErrContentFilter)
+		}
+		return resp, nil
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/busthorne/simp"
+	"github.com/busthorne/simp/config"
+	"github.com/sashabaranov/go-openai"
+)
+
+// canned answers the chat with the finish reason, or fails with the error.
+type canned struct {
+	simp.Driver
+	reason openai.FinishReason
+	err    error
+	model  string
+	calls  int
+}
+
+func (c *canned) Chat(ctx context.Context, req openai.ChatCompletionRequest) (resp openai.ChatCompletionResponse, err error) {
+	c.calls++
+	if c.err != nil {
+		return resp, c.err
+	}
+	choice := openai.ChatCompletionStreamChoice{
+		Delta:        openai.ChatCompletionStreamChoiceDelta{Content: req.Model},
+		FinishReason: c.reason,
+	}
+	resp.Model = c.model
+	if !req.Stream {
+		resp.Choices = []openai.ChatCompletionChoice{{
+			Message:      openai.ChatCompletionMessage{Content: req.Model},
+			FinishReason: c.reason,
+		}}
+		return resp, nil
+	}
+	resp.Stream = make(chan openai.ChatCompletionStreamResponse, 1)
+	resp.Stream <- openai.ChatCompletionStreamResponse{Choices: []openai.ChatCompletionStreamChoice{choice}}
+	close(resp.Stream)
+	return resp, nil
+}
+
+func TestFallback(t *testing.T) {
+	chain := func(drivers ...*canned) *fallback {
+		f := &fallback{}
+		for i, d := range drivers {
+			f.chain = append(f.chain, link{d, config.Model{Name: fmt.Sprint("m", i)}})
+		}
+		return f
+	}
+	ctx := context.Background()
+	cases := []struct {
+		name   string
+		chain  []*canned
+		stream bool
+		want   string
+		calls  []int
+	}{
+		{"primary", []*canned{{}, {}}, false, "m0", []int{1, 0}},
+		{"transient", []*canned{{err: simp.ErrRetry}, {}}, false, "m1", []int{1, 1}},
+		{"context length", []*canned{{err: simp.ErrContextLength}, {err: simp.ErrRetry}, {}}, true, "m2", []int{1, 1, 1}},
+		{"filtered", []*canned{{reason: openai.FinishReasonContentFilter}, {}}, true, "m1", []int{1, 1}},
+		{"filtered last", []*canned{{err: simp.ErrRetry}, {reason: openai.FinishReasonContentFilter}}, false, "m1", []int{1, 1}},
+		{"reported", []*canned{{err: simp.ErrRetry}, {model: "m1-2024"}}, false, "m1-2024", []int{1, 1}},
+	}
+	for _, c := range cases {
+		f := chain(c.chain...)
+		resp, err := f.Chat(ctx, openai.ChatCompletionRequest{Stream: c.stream})
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if resp.Model != c.want {
+			t.Errorf("%s: answered by %s, want %s", c.name, resp.Model, c.want)
+		}
+		if got := answered(f, f.chain[0].model, resp.Model); got != c.want {
+			t.Errorf("%s: answered is %s", c.name, got)
+		}
+		if c.stream {
+			for chunk := range resp.Stream {
+				if s := chunk.Choices[0].Delta.Content; s != c.want {
+					t.Errorf("%s: streamed by %s", c.name, s)
+				}
+			}
+		}
+		for i, d := range c.chain {
+			if d.calls != c.calls[i] {
+				t.Errorf("%s: %s called %d times, want %d", c.name, f.chain[i].model.Name, d.calls, c.calls[i])
+			}
+		}
+	}
+
+	// the errors that the other models wouldn't fare any better with
+	bad := errors.New("invalid request")
+	f := chain(&canned{err: bad}, &canned{})
+	if _, err := f.Chat(ctx, openai.ChatCompletionRequest{}); err != bad {
+		t.Errorf("fell back on %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/busthorne/simp"
+	"github.com/busthorne/simp/books"
+	"github.com/busthorne/simp/config"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	// how often the pending implicit ops are polled for
+	implicitTick = 5 * time.Second
+	// how many pending ops of every model are scheduled at a time
+	implicitLimit = 1000
+)
+
+// implicitWorker drains the implicit batch ops, i.e. the requests to models
+// whose drivers won't batch natively, through the normal endpoints.
+//
+// Each model gets its own lane, so that a slow model would not hold up
+// the others; the lane is throttled according to the provider, and model
+// rate limits, shared with the daemon requests.
+type implicitWorker struct {
+	sync.Mutex
+
+	// models that are currently being drained
+	lanes map[string]bool
+}
+
+// implicit runs the implicit worker until the context is done.
+func implicit(ctx context.Context) {
+	w := implicitWorker{lanes: map[string]bool{}}
+	tick := time.NewTicker(implicitTick)
+	defer tick.Stop()
+	for {
+		if err := w.schedule(ctx); err != nil {
+			log.Errorf("implicit: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// schedule fetches the pending ops, and starts a lane for every model
+// that is not already being drained; every model has its own window of
+// ops, so that the backlog of one would not crowd out the others.
+func (w *implicitWorker) schedule(ctx context.Context) error {
+	ops, err := books.Session().BatchOpsPending(ctx, implicitLimit)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return nil
+	default:
+		return notkeep(err, "fetch pending ops")
+	}
+	lanes := map[string][]books.BatchOp{}
+	for _, op := range ops {
+		model := op.Request.Model()
+		lanes[model] = append(lanes[model], op)
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	for model, ops := range lanes {
+		if w.lanes[model] {
+			continue
+		}
+		w.lanes[model] = true
+		go func() {
+			defer func() {
+				w.Lock()
+				delete(w.lanes, model)
+				w.Unlock()
+			}()
+			w.drain(ctx, model, ops)
+		}()
+	}
+	return nil
+}
+
+// drain processes the ops one call at a time, writing the outputs back; the
+// independent embedding ops are inlined into multi-input calls.
+func (w *implicitWorker) drain(ctx context.Context, model string, ops []books.BatchOp) {
+	book := books.Session()
+	d, m, err := findWaldo(model)
+	if err != nil {
+		// the model is gone from config, so the ops would never complete
+		log.Errorf("implicit %q: %v\n", model, err)
+	}
+	log.Debugf("implicit %q draining %d ops\n", model, len(ops))
+
+	ctx = context.WithValue(ctx, simp.KeyModel, m)
+	// the batches with progress that has not been published yet
+	unpublished, published := map[string]bool{}, time.Time{}
+	// whoever has uploaded the batches, to be charged for the outputs
+	grants := map[string]*grant{}
+	defer func() {
+		for id := range unpublished {
+			progress(ctx, id)
+		}
+	}()
+	for _, call := range inline(ops, inlineLimits(model)) {
+		// claim the ops, so that each would be done exactly once
+		claimed := call[:0]
+		for _, op := range call {
+			n, err := book.StartBatchOp(ctx, books.StartBatchOpParams{
+				Batch:    op.Batch,
+				CustomID: op.CustomID,
+			})
+			if err != nil {
+				log.Errorf("implicit %q: %v\n", model, notkeep(err, "start op %q", op.CustomID))
+				unstart(model, claimed)
+				return
+			}
+			if n > 0 {
+				claimed = append(claimed, op)
+			}
+		}
+		if len(claimed) == 0 {
+			continue
+		}
+		var outputs []openai.BatchOutput
+		if d != nil {
+			// the batch ops are in no hurry, so the gates would have them
+			// wait as long as it takes
+			callCtx, provider := serving(ctx)
+			start := time.Now()
+			outputs = implicitCall(callCtx, d, m, claimed)
+			if ctx.Err() != nil {
+				// the ops are left started, to be reset on the next run
+				return
+			}
+			for i, output := range outputs {
+				batch := claimed[i].Batch
+				g, ok := grants[batch]
+				if !ok {
+					g = batchGrant(ctx, batch)
+					grants[batch] = g
+				}
+				recordBatch(output, g, m.Name, *provider, time.Since(start))
+				name, usage := outputModel(output, m.Name)
+				g.spend(name, *provider, usage)
+			}
+		} else {
+			for _, op := range claimed {
+				outputs = append(outputs, openai.BatchOutput{
+					CustomID: op.CustomID,
+					Error:    batchError(err),
+				})
+			}
+		}
+		for i, op := range claimed {
+			err := book.CompleteBatchOp(ctx, books.CompleteBatchOpParams{
+				Response: outputs[i],
+				Batch:    op.Batch,
+				CustomID: op.CustomID,
+			})
+			if err != nil {
+				log.Errorf("implicit %q: %v\n", model, notkeep(err, "complete op %q", op.CustomID))
+				unstart(model, claimed[i:])
+				return
+			}
+			if batchEvents.watched(op.Batch) {
+				unpublished[op.Batch] = true
+			}
+		}
+		if len(unpublished) > 0 && time.Since(published) > time.Second {
+			for id := range unpublished {
+				progress(ctx, id)
+			}
+			clear(unpublished)
+			published = time.Now()
+		}
+	}
+}
+
+// unstart lets go of the claimed ops that have not been completed, so that
+// they would be scheduled again, rather than wait for the restart.
+func unstart(model string, ops []books.BatchOp) {
+	for _, op := range ops {
+		err := books.Session().UnstartBatchOp(bg, books.UnstartBatchOpParams{
+			Batch:    op.Batch,
+			CustomID: op.CustomID,
+		})
+		if err != nil {
+			log.Errorf("implicit %q: %v\n", model, notkeep(err, "unstart op %q", op.CustomID))
+		}
+	}
+}
+
+// progress will publish the up-to-date request counts of the superbatch;
+// the batch is not updated, so as not to race the poller.
+func progress(ctx context.Context, id string) {
+	row, err := books.Session().BatchById(ctx, id)
+	if err != nil {
+		log.Errorf("implicit: batch %q: %v\n", id, err)
+		return
+	}
+	super := row.Body
+	counts, err := requestCounts(ctx, super)
+	if err != nil {
+		log.Errorf("implicit: batch %q: %v\n", id, err)
+		return
+	}
+	super.RequestCounts = counts
+	batchEvents.publish(super)
+}
+
+// implicitOp performs a single batch input as-if it was a normal request;
+// the input goes by the alias, so it has to be named after the model.
+func implicitOp(ctx context.Context, d simp.Driver, m config.Model, input openai.BatchInput) openai.BatchOutput {
+	output := openai.BatchOutput{CustomID: input.CustomID}
+
+	var err error
+	switch {
+	case input.ChatCompletion != nil:
+		req := *input.ChatCompletion
+		req.Model = m.Name
+		req.Stream = false
+		var resp openai.ChatCompletionResponse
+		resp, err = chat(ctx, d, backoffOf(m.Name), req)
+		if err != nil {
+			break
+		}
+		resp.Object = "chat.completion"
+		resp.Model = answered(d, m, resp.Model)
+		output.ChatCompletion = &resp
+	case input.Embedding != nil:
+		req := *input.Embedding
+		req.Model = m.Name
+		var resp openai.EmbeddingResponse
+		resp, err = embed(ctx, d, backoffOf(m.Name), req)
+		if err != nil {
+			break
+		}
+		resp.Model = openai.EmbeddingModel(answered(d, m, string(resp.Model)))
+		resp.Object = "list"
+		for i := range resp.Data {
+			resp.Data[i].Object = "embedding"
+		}
+		output.Embedding = &resp
+	default:
+		err = errMeatNorFish
+	}
+	if err != nil {
+		output.Error = batchError(err)
+	}
+	return output
+}
+
+// batchError converts the error to the API error for batch outputs.
+func batchError(err error) *openai.APIError {
+	if apiErr := (*openai.APIError)(nil); errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return &openai.APIError{
+		Type:    "provider_error",
+		Message: err.Error(),
+	}
+}
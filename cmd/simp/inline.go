@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/busthorne/simp"
+	"github.com/busthorne/simp/books"
+	"github.com/busthorne/simp/config"
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	// how many inputs go in one inlined embedding call by default
+	inlineInputs = 100
+	// how many estimated tokens go in one inlined embedding call by default
+	inlineTokens = 100000
+)
+
+// inlineLimits bound the inlined calls to the model, as overridden by the
+// provider config; the call could go to any provider that claims the model,
+// so it's the tightest of them that counts.
+func inlineLimits(model string) simp.BatchLimits {
+	claims := cfg.LookupClaims(model)
+	if len(claims) == 0 {
+		return simp.BatchLimits{Requests: inlineInputs, Tokens: inlineTokens}
+	}
+	var limits simp.BatchLimits
+	for i, c := range claims {
+		p, l := c.Provider, simp.BatchLimits{Requests: inlineInputs, Tokens: inlineTokens}
+		if p.InlineInputs > 0 {
+			l.Requests = p.InlineInputs
+		}
+		if p.InlineTokens > 0 {
+			l.Tokens = p.InlineTokens
+		}
+		if i > 0 {
+			l.Requests = min(l.Requests, limits.Requests)
+			l.Tokens = min(l.Tokens, limits.Tokens)
+		}
+		limits = l
+	}
+	return limits
+}
+
+// inlineable tells whether the op is an independent embedding request, so
+// that it could be inlined with others; the task, and late chunking, would
+// make the embeddings depend on the rest of the inputs.
+func inlineable(input openai.BatchInput) bool {
+	e := input.Embedding
+	return e != nil && e.Task == "" && !e.LateChunking
+}
+
+// inline groups the ops into calls: the independent embedding ops that
+// share the options are coalesced into as few multi-input calls as the
+// limits would allow, where every input counts as a request, and the
+// rest of the ops are called one by one.
+func inline(ops []books.BatchOp, limits simp.BatchLimits) (calls [][]books.BatchOp) {
+	type key struct {
+		user       string
+		format     openai.EmbeddingEncodingFormat
+		dimensions int
+	}
+	type open struct {
+		call           int
+		inputs, tokens int64
+	}
+	opened := map[key]*open{}
+	for _, op := range ops {
+		if !inlineable(op.Request) {
+			calls = append(calls, []books.BatchOp{op})
+			continue
+		}
+		e := op.Request.Embedding
+		k := key{e.User, e.EncodingFormat, e.Dimensions}
+		n, t := int64(len(e.Input)), simp.EstimateTokens(op.Request)
+		o, ok := opened[k]
+		if !ok || limits.Exceeds(int(o.inputs+n), 0, o.tokens+t) {
+			o = &open{call: len(calls)}
+			opened[k] = o
+			calls = append(calls, nil)
+		}
+		calls[o.call] = append(calls[o.call], op)
+		o.inputs += n
+		o.tokens += t
+	}
+	return
+}
+
+// implicitCall performs the ops, inlining them into one embedding call if
+// there's more than one.
+func implicitCall(ctx context.Context, d simp.Driver, m config.Model, ops []books.BatchOp) []openai.BatchOutput {
+	if len(ops) == 1 {
+		return []openai.BatchOutput{implicitOp(ctx, d, m, ops[0].Request)}
+	}
+	outputs := make([]openai.BatchOutput, len(ops))
+	for i, op := range ops {
+		outputs[i].CustomID = op.CustomID
+	}
+	req := *ops[0].Request.Embedding
+	req.Model = m.Name
+	req.Input = nil
+	for _, op := range ops {
+		req.Input = append(req.Input, op.Request.Embedding.Input...)
+	}
+	resp, err := embed(ctx, d, backoffOf(m.Name), req)
+	if err == nil && len(resp.Data) != len(req.Input) {
+		err = fmt.Errorf("%d embeddings for %d inputs", len(resp.Data), len(req.Input))
+	}
+	if err != nil {
+		for i := range outputs {
+			outputs[i].Error = batchError(err)
+		}
+		return outputs
+	}
+	data := make([]openai.Embedding, len(resp.Data))
+	for i, e := range resp.Data {
+		if e.Index >= 0 && e.Index < len(data) {
+			i = e.Index
+		}
+		data[i] = e
+	}
+	usage := splitUsage(resp.Usage, ops)
+	off := 0
+	for i, op := range ops {
+		n := len(op.Request.Embedding.Input)
+		part := openai.EmbeddingResponse{
+			Object: "list",
+			Model:  openai.EmbeddingModel(answered(d, m, string(resp.Model))),
+			Usage:  usage[i],
+		}
+		for j, e := range data[off : off+n] {
+			e.Object, e.Index = "embedding", j
+			part.Data = append(part.Data, e)
+		}
+		off += n
+		outputs[i].Embedding = &part
+	}
+	return outputs
+}
+
+// splitUsage splits the usage of the inlined call between the ops, in
+// proportion to their estimated tokens; the remainder goes to the last op,
+// so that the parts would add up to the whole.
+func splitUsage(usage openai.Usage, ops []books.BatchOp) []openai.Usage {
+	var (
+		parts = make([]openai.Usage, len(ops))
+		sizes = make([]int64, len(ops))
+		total int64
+	)
+	for i, op := range ops {
+		sizes[i] = max(simp.EstimateTokens(op.Request), 1)
+		total += sizes[i]
+	}
+	share := func(n, i int) int {
+		return int(int64(n) * sizes[i] / total)
+	}
+	left := usage
+	for i := range ops[:len(ops)-1] {
+		parts[i] = openai.Usage{
+			PromptTokens:     share(usage.PromptTokens, i),
+			CompletionTokens: share(usage.CompletionTokens, i),
+			TotalTokens:      share(usage.TotalTokens, i),
+		}
+		left.PromptTokens -= parts[i].PromptTokens
+		left.CompletionTokens -= parts[i].CompletionTokens
+		left.TotalTokens -= parts[i].TotalTokens
+	}
+	parts[len(ops)-1] = openai.Usage{
+		PromptTokens:     left.PromptTokens,
+		CompletionTokens: left.CompletionTokens,
+		TotalTokens:      left.TotalTokens,
+	}
+	return parts
+}
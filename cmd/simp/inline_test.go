@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/busthorne/simp"
+	"github.com/busthorne/simp/books"
+	"github.com/busthorne/simp/config"
+	"github.com/google/go-cmp/cmp"
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestInline(t *testing.T) {
+	embed := func(id string, inputs int, task string) books.BatchOp {
+		req := &openai.EmbeddingRequest{Model: "jina-embeddings-v3", Task: task}
+		for i := 0; i < inputs; i++ {
+			req.Input = append(req.Input, openai.EmbeddingInput{Text: fmt.Sprint("text ", i)})
+		}
+		return books.BatchOp{CustomID: id, Request: openai.BatchInput{CustomID: id, Embedding: req}}
+	}
+	ops := []books.BatchOp{
+		embed("a", 2, ""),
+		embed("b", 1, "retrieval.query"),
+		embed("c", 2, ""),
+		{CustomID: "d", Request: openai.BatchInput{CustomID: "d", ChatCompletion: &openai.ChatCompletionRequest{}}},
+		embed("e", 1, ""),
+		embed("f", 1, ""),
+	}
+	var got [][]string
+	for _, call := range inline(ops, simp.BatchLimits{Requests: 5}) {
+		var ids []string
+		for _, op := range call {
+			ids = append(ids, op.CustomID)
+		}
+		got = append(got, ids)
+	}
+	want := [][]string{{"a", "c", "e"}, {"b"}, {"d"}, {"f"}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestInlineLimits(t *testing.T) {
+	defer func(c *config.Config) { cfg = c }(cfg)
+	cfg = &config.Config{
+		Providers: []config.Provider{
+			{Driver: "openai", Name: "roomy", InlineInputs: 500, Models: []config.Model{
+				{Name: "jina-embeddings-v3", Alias: []string{"jina"}},
+			}},
+			{Driver: "openai", Name: "tight", InlineTokens: 8000, Models: []config.Model{
+				{Name: "jina-embeddings-v3@tight", Alias: []string{"jina"}},
+			}},
+		},
+	}
+	want := simp.BatchLimits{Requests: inlineInputs, Tokens: 8000}
+	if diff := cmp.Diff(want, inlineLimits("jina")); diff != "" {
+		t.Error(diff)
+	}
+	want = simp.BatchLimits{Requests: 500, Tokens: inlineTokens}
+	if diff := cmp.Diff(want, inlineLimits("jina-embeddings-v3")); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestSplitUsage(t *testing.T) {
+	text := func(id, s string) books.BatchOp {
+		return books.BatchOp{CustomID: id, Request: openai.BatchInput{
+			Embedding: &openai.EmbeddingRequest{Input: []openai.EmbeddingInput{{Text: s}}},
+		}}
+	}
+	ops := []books.BatchOp{
+		text("a", "12345678"),
+		text("b", "1234567812345678"),
+		text("c", "1234567812345678"),
+	}
+	usage := openai.Usage{PromptTokens: 101, TotalTokens: 101}
+	parts := splitUsage(usage, ops)
+	var sum int
+	for _, u := range parts {
+		sum += u.PromptTokens
+	}
+	if sum != usage.PromptTokens {
+		t.Fatalf("the parts add up to %d, want %d", sum, usage.PromptTokens)
+	}
+	if parts[0].PromptTokens != 20 || parts[1].PromptTokens != 40 {
+		t.Fatalf("unexpected split: %+v", parts)
+	}
+}
+
+// echo embeds the inputs as their lengths, in reverse order.
+type echo struct{ simp.Driver }
+
+func (echo) Embed(ctx context.Context, req openai.EmbeddingRequest) (e openai.EmbeddingResponse, err error) {
+	for i := len(req.Input) - 1; i >= 0; i-- {
+		e.Data = append(e.Data, openai.Embedding{
+			Index:     i,
+			Embedding: []float32{float32(len(req.Input[i].Text))},
+		})
+	}
+	e.Usage = openai.Usage{PromptTokens: 10, TotalTokens: 10}
+	return
+}
+
+func TestImplicitCall(t *testing.T) {
+	op := func(id string, texts ...string) books.BatchOp {
+		req := &openai.EmbeddingRequest{}
+		for _, s := range texts {
+			req.Input = append(req.Input, openai.EmbeddingInput{Text: s})
+		}
+		return books.BatchOp{CustomID: id, Request: openai.BatchInput{CustomID: id, Embedding: req}}
+	}
+	ops := []books.BatchOp{op("a", "x", "xx"), op("b", "xxx")}
+	outputs := implicitCall(context.Background(), echo{}, config.Model{Name: "m"}, ops)
+	got := map[string][]float32{}
+	tokens := 0
+	for _, output := range outputs {
+		if output.Error != nil {
+			t.Fatal(output.Error)
+		}
+		for i, e := range output.Embedding.Data {
+			if e.Index != i {
+				t.Errorf("%s: embedding %d has index %d", output.CustomID, i, e.Index)
+			}
+			got[output.CustomID] = append(got[output.CustomID], e.Embedding...)
+		}
+		tokens += output.Embedding.Usage.PromptTokens
+	}
+	want := map[string][]float32{"a": {1, 2}, "b": {3}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error(diff)
+	}
+	if tokens != 10 {
+		t.Errorf("usage adds up to %d tokens", tokens)
+	}
+}
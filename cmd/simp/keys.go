@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/busthorne/keyring"
+	"github.com/busthorne/simp/books"
+	"github.com/busthorne/simp/config"
+	"github.com/busthorne/simp/driver"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	// what the issued keys start with
+	keyPrefix = "sk-simp-"
+	// the grant of the client, once it's been authorized
+	localGrant = "simp.grant"
+	// the key that simp presents to the daemon, as kept in the keyring
+	daemonKey = "apikey"
+)
+
+// grant is what the client may do, as issued with its key, or mapped from
+// the roles of its token.
+type grant struct {
+	// the key, if the grant has come from one; the name is the identity of
+	// the token otherwise
+	id, name string
+	// the models, aliases, or tags; empty means any
+	scope    []string
+	rpm, tpm int
+	budget   *float64
+	spent    float64
+}
+
+func grantOf(c *fiber.Ctx) *grant {
+	g, _ := c.Locals(localGrant).(*grant)
+	return g
+}
+
+func keyGrant(k books.ApiKey) *grant {
+	g := &grant{
+		id:     k.ID,
+		name:   k.Name,
+		rpm:    int(k.Rpm),
+		tpm:    int(k.Tpm),
+		budget: k.Budget,
+		spent:  k.Spent,
+	}
+	if k.Scope != "" {
+		g.scope = strings.Split(k.Scope, ",")
+	}
+	return g
+}
+
+// covers tells whether the model is within the scope; no grant is no scope.
+func (g *grant) covers(m config.Model) bool {
+	if g == nil || len(g.scope) == 0 {
+		return true
+	}
+	for _, s := range g.scope {
+		if s == m.Name || slices.Contains(m.Alias, s) || slices.Contains(m.Tags, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// principal is the throttle scope of the grant, and what sets its clients
+// apart; no grant is no principal.
+func (g *grant) principal() string {
+	switch {
+	case g == nil:
+		return ""
+	case g.id != "":
+		return "key:" + g.id
+	}
+	return "sso:" + g.name
+}
+
+// rate is the limit of the grant, as its own throttle scope.
+func (g *grant) rate() (rate, bool) {
+	if g == nil || g.rpm == 0 && g.tpm == 0 {
+		return rate{}, false
+	}
+	return rate{scope: g.principal(), rpm: g.rpm, tpm: g.tpm}, true
+}
+
+// spend the cost of the usage of the model against the key, at the price
+// of the provider that has served it; the model has to be priced for it
+// to count.
+func (g *grant) spend(model, provider string, usage openai.Usage) {
+	g.charge(model, provider, usage, false)
+}
+
+// spendBatch is spend at the batch prices, for the native batch outputs.
+func (g *grant) spendBatch(model, provider string, usage openai.Usage) {
+	g.charge(model, provider, usage, true)
+}
+
+func (g *grant) charge(model, provider string, usage openai.Usage, batch bool) {
+	if g == nil || g.id == "" {
+		return
+	}
+	m, _, ok := cfg.LookupClaim(model, provider)
+	if !ok {
+		// the provider is not known, or has named the model differently
+		m, _, ok = cfg.LookupModel(model)
+	}
+	if !ok {
+		return
+	}
+	input, output := m.InputPrice, m.OutputPrice
+	if batch {
+		input = m.BatchPrice()
+		if m.BatchOutputPrice > 0 {
+			output = m.BatchOutputPrice
+		}
+	}
+	cost := (float64(usage.PromptTokens)*input + float64(usage.CompletionTokens)*output) / 1e6
+	if cost <= 0 {
+		return
+	}
+	err := books.Session().SpendAPIKey(bg, books.SpendAPIKeyParams{Spent: cost, ID: g.id})
+	if err != nil {
+		log.Errorf("key %s: %v\n", g.id, notkeep(err, "spend"))
+	}
+}
+
+// batchGrant is the grant of whoever has uploaded the batch, as far as it
+// would be charged; nil is no one to charge.
+func batchGrant(ctx context.Context, batch string) *grant {
+	row, err := books.Session().BatchGrant(ctx, batch)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return nil
+	default:
+		log.Errorf("batch %q: %v\n", batch, notkeep(err, "fetch grant"))
+		return nil
+	}
+	g := &grant{name: row.Principal}
+	if row.ApiKey != nil {
+		g.id = *row.ApiKey
+	}
+	return g
+}
+
+func hashKey(key string) []byte {
+	h := sha256.Sum256([]byte(key))
+	return h[:]
+}
+
+// authorize the client by its bearer key, the token of an SSO auth, or
+// its certificate, if the daemon requires either; the ping is left alone,
+// as it's how the clients find the daemon.
+func authorize(c *fiber.Ctx) error {
+	if c.Path() == "/v1/ping" {
+		return c.Next()
+	}
+	sso, d := verifiers(), cfg.Daemon
+	mtls := d != nil && d.ClientCA != ""
+	if len(sso) == 0 && !mtls && (d == nil || !d.RequireKeys) {
+		return c.Next()
+	}
+	bearer := strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if strings.HasPrefix(bearer, keyPrefix) {
+		return authorizeKey(c, bearer)
+	}
+	for _, j := range sso {
+		t := token(c, j, bearer)
+		if t == "" {
+			continue
+		}
+		claims, err := j.Verify(c.UserContext(), t)
+		if err != nil {
+			return unauthorized(c, err.Error())
+		}
+		g := claimGrant(j.Auth, claims)
+		if g == nil {
+			return noRole(c, claims.String("email"), j.Auth.Name)
+		}
+		c.Locals(localGrant, g)
+		return c.Next()
+	}
+	if id, ok := certIdentity(c); ok && mtls {
+		g := roleGrant(d.Roles, id)
+		if g == nil {
+			return noRole(c, id.name, "daemon")
+		}
+		c.Locals(localGrant, g)
+		return c.Next()
+	}
+	if bearer == "" {
+		return unauthorized(c, "missing api key")
+	}
+	return unauthorized(c, "invalid api key")
+}
+
+func authorizeKey(c *fiber.Ctx, key string) error {
+	k, err := books.Session().APIKeyByHash(c.UserContext(), hashKey(key))
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return unauthorized(c, "invalid api key")
+	default:
+		return notkeep(err, "fetch api key")
+	}
+	if k.Budget != nil && k.Spent >= *k.Budget {
+		c.Status(fiber.StatusTooManyRequests)
+		return &openai.APIError{
+			Type:           "insufficient_quota",
+			Code:           "insufficient_quota",
+			Message:        fmt.Sprintf("key %s has spent its budget of %g", k.Name, *k.Budget),
+			HTTPStatusCode: fiber.StatusTooManyRequests,
+		}
+	}
+	c.Locals(localGrant, keyGrant(k))
+	return c.Next()
+}
+
+// who is the client, for the logs: the name of the key, the identity of the
+// token, or the address.
+func who(c *fiber.Ctx) string {
+	if g := grantOf(c); g != nil && g.name != "" {
+		return g.name
+	}
+	return clientIP(c).String()
+}
+
+// principalOf is the client, for the ledger: unlike the names, the key ids
+// and the identities are never mistaken for one another.
+func principalOf(c *fiber.Ctx) string {
+	if g := grantOf(c); g != nil {
+		return g.principal()
+	}
+	return clientIP(c).String()
+}
+
+func noRole(c *fiber.Ctx, who, where string) error {
+	c.Status(fiber.StatusForbidden)
+	return &openai.APIError{
+		Type:           "permission_error",
+		Message:        fmt.Sprintf("%s has no role in %s", who, where),
+		HTTPStatusCode: fiber.StatusForbidden,
+	}
+}
+
+func unauthorized(c *fiber.Ctx, message string) error {
+	c.Status(fiber.StatusUnauthorized)
+	return &openai.APIError{
+		Type:           "invalid_request_error",
+		Code:           "invalid_api_key",
+		Message:        message,
+		HTTPStatusCode: fiber.StatusUnauthorized,
+	}
+}
+
+// keys manages the daemon client keys:
+//
+//	simp -keys create name [-scope cs35,fast] [-rpm 60] [-tpm 0] [-budget 10]
+//	simp -keys list
+//	simp -keys revoke id-or-name
+//	simp -keys use < key
+func keys(cmd string, args []string) error {
+	book := books.Session()
+	switch cmd {
+	case "create":
+		if len(args) == 0 {
+			return errors.New("usage: simp -keys create name [-scope models] [-rpm n] [-tpm n] [-budget n]")
+		}
+		fs := flag.NewFlagSet("keys create", flag.ContinueOnError)
+		var (
+			scope  = fs.String("scope", "", "comma-separated models, aliases, or tags")
+			rpm    = fs.Int("rpm", 0, "requests per minute")
+			tpm    = fs.Int("tpm", 0, "tokens per minute")
+			budget = fs.Float64("budget", 0, "spend budget, in the currency of model prices")
+		)
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		id, key, err := newKey()
+		if err != nil {
+			return err
+		}
+		params := books.InsertAPIKeyParams{
+			ID:    id,
+			Name:  args[0],
+			Hash:  hashKey(key),
+			Scope: *scope,
+			Rpm:   int64(*rpm),
+			Tpm:   int64(*tpm),
+		}
+		if *budget > 0 {
+			params.Budget = budget
+		}
+		if err := book.InsertAPIKey(bg, params); err != nil {
+			return notkeep(err, "insert api key")
+		}
+		// the key is never to be seen again
+		fmt.Println(key)
+		return nil
+	case "list":
+		list, err := book.APIKeys(bg)
+		if err != nil {
+			return notkeep(err, "fetch api keys")
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tSCOPE\tRPM\tTPM\tSPENT\tBUDGET\tCREATED\tUSED\tREVOKED")
+		for _, k := range list {
+			budget, used, revoked := "-", "-", "-"
+			if k.Budget != nil {
+				budget = fmt.Sprintf("%.2f", *k.Budget)
+			}
+			if k.UsedAt != nil {
+				used = k.UsedAt.Format("2006-01-02 15:04")
+			}
+			if k.RevokedAt != nil {
+				revoked = k.RevokedAt.Format("2006-01-02 15:04")
+			}
+			scope := k.Scope
+			if scope == "" {
+				scope = "*"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%.2f\t%s\t%s\t%s\t%s\n",
+				k.ID, k.Name, scope, k.Rpm, k.Tpm, k.Spent, budget,
+				k.CreatedAt.Format("2006-01-02 15:04"), used, revoked)
+		}
+		return w.Flush()
+	case "revoke":
+		if len(args) != 1 {
+			return errors.New("usage: simp -keys revoke id-or-name")
+		}
+		n, err := book.RevokeAPIKey(bg, args[0])
+		if err != nil {
+			return notkeep(err, "revoke api key")
+		}
+		if n == 0 {
+			return fmt.Errorf("key %q is not found", args[0])
+		}
+		return nil
+	case "use":
+		// the key is read from stdin, so that it's not left in the history
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("read key: %w", err)
+		}
+		key := strings.TrimSpace(line)
+		if !strings.HasPrefix(key, keyPrefix) {
+			return errors.New("usage: simp -keys use < key")
+		}
+		ring, err := daemonKeyring(cfg)
+		if err != nil {
+			return fmt.Errorf("daemon keyring: %w", err)
+		}
+		return ring.Set(keyring.Item{Key: daemonKey, Data: []byte(key)})
+	}
+	return fmt.Errorf("unknown keys command %q: create, list, revoke, or use", cmd)
+}
+
+// daemonDriver is the driver of the daemon at daemon_addr, that presents
+// the key from the keyring, if there's one.
+func daemonDriver(d config.Daemon) (*driver.Daemon, error) {
+	if ring, err := daemonKeyring(cfg); err == nil {
+		if item, err := ring.Get(daemonKey); err == nil {
+			d.APIKey = string(item.Data)
+		}
+	}
+	return driver.NewDaemon(d, clientTLS(d))
+}
+
+// newKey makes the key, and its public id.
+func newKey() (id, key string, err error) {
+	b := make([]byte, 36)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(b[:4]), keyPrefix + base64.RawURLEncoding.EncodeToString(b[4:]), nil
+}
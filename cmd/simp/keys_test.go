@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/busthorne/simp/books"
+	"github.com/busthorne/simp/config"
+	"github.com/gofiber/fiber/v2"
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestKeys(t *testing.T) {
+	if err := books.Open(":memory:"); err != nil {
+		t.Fatal(err)
+	}
+	defer func(c *config.Config) { cfg = c }(cfg)
+	cfg = &config.Config{
+		Daemon: &config.Daemon{RequireKeys: true},
+		Providers: []config.Provider{
+			{Driver: "openai", Name: "api", Models: []config.Model{
+				{Name: "gpt-4o", Alias: []string{"4o"}, InputPrice: 1e6},
+				{Name: "o1", Tags: []string{"reasoning"}},
+			}},
+		},
+	}
+	cfg.ClearCache()
+	id, key, err := newKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	budget := 10.0
+	err = books.Session().InsertAPIKey(bg, books.InsertAPIKeyParams{
+		ID:     id,
+		Name:   "ci",
+		Hash:   hashKey(key),
+		Scope:  "4o",
+		Budget: &budget,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := fiber.New(fiber.Config{
+		ErrorHandler: func(c *fiber.Ctx, err error) error {
+			return c.SendString(err.Error())
+		},
+	})
+	f.Use(authorize)
+	f.Get("/v1/ping", func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
+	f.Get("/v1/use/:model", func(c *fiber.Ctx) error {
+		if err := permit(c, c.Params("model")); err != nil {
+			return err
+		}
+		grantOf(c).spend(c.Params("model"), "", openai.Usage{PromptTokens: 4})
+		return c.SendString(grantOf(c).name)
+	})
+	get := func(path, key string) (int, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		resp, err := f.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	if code, _ := get("/v1/ping", ""); code != fiber.StatusOK {
+		t.Errorf("ping: %d", code)
+	}
+	if code, _ := get("/v1/use/4o", ""); code != fiber.StatusUnauthorized {
+		t.Errorf("no key: %d", code)
+	}
+	if code, _ := get("/v1/use/4o", keyPrefix+"nope"); code != fiber.StatusUnauthorized {
+		t.Errorf("bad key: %d", code)
+	}
+	if code, _ := get("/v1/use/o1", key); code != fiber.StatusForbidden {
+		t.Errorf("out of scope: %d", code)
+	}
+	// each use spends 4 out of 10
+	for i, want := range []int{200, 200, 200, 429} {
+		if code, body := get("/v1/use/4o", key); code != want {
+			t.Errorf("use %d: %d %s", i, code, body)
+		}
+	}
+	if err := keys("revoke", []string{"ci"}); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := get("/v1/use/4o", key); code != fiber.StatusUnauthorized {
+		t.Errorf("revoked key: %d", code)
+	}
+	if err := keys("revoke", []string{"ci"}); err == nil {
+		t.Error("revoked twice")
+	}
+
+	g := &grant{scope: []string{"reasoning"}}
+	if !g.covers(config.Model{Name: "o1", Tags: []string{"reasoning"}}) || g.covers(config.Model{Name: "gpt-4o"}) {
+		t.Error("scope by tag")
+	}
+}
+
+func TestBatchSpend(t *testing.T) {
+	if err := books.Open(":memory:"); err != nil {
+		t.Fatal(err)
+	}
+	defer func(c *config.Config) { cfg = c }(cfg)
+	cfg = &config.Config{
+		Providers: []config.Provider{
+			{Driver: "openai", Name: "api", Models: []config.Model{
+				{Name: "gpt-4o", InputPrice: 2e6, OutputPrice: 8e6, BatchInputPrice: 1e6},
+			}},
+			{Driver: "openai", Name: "azure", Models: []config.Model{
+				{Name: "gpt-4o", InputPrice: 4e6, OutputPrice: 8e6, BatchInputPrice: 3e6},
+			}},
+		},
+	}
+	cfg.ClearCache()
+	book := books.Session()
+	err := book.InsertAPIKey(bg, books.InsertAPIKeyParams{ID: "k1", Name: "ci", Hash: hashKey("k1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := "k1"
+	err = book.InsertBatchGrant(bg, books.InsertBatchGrantParams{Batch: "batch_1", ApiKey: &id, Principal: "ci"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := batchGrant(bg, "batch_2"); g != nil {
+		t.Errorf("no one uploaded it: %+v", g)
+	}
+	g := batchGrant(bg, "batch_1")
+	if g == nil || g.id != "k1" || g.name != "ci" {
+		t.Fatalf("grant: %+v", g)
+	}
+	output := openai.BatchOutput{
+		ChatCompletion: &openai.ChatCompletionResponse{
+			Model: "gpt-4o",
+			Usage: openai.Usage{PromptTokens: 1, CompletionTokens: 1},
+		},
+	}
+	// the batch input price, and the regular output price for the want of
+	// the batch one
+	model, usage := outputModel(output, "4o")
+	g.spendBatch(model, "openai:api", usage)
+	// the implicit ops are not batched by the provider, so at full price,
+	// and that of the provider that has served them
+	g.spend(model, "openai:azure", usage)
+	k, err := book.APIKeyByHash(bg, hashKey("k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 1.0 + 8 + 4 + 8; k.Spent != want {
+		t.Errorf("spent %g, want %g", k.Spent, want)
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/busthorne/simp"
+	"github.com/busthorne/simp/books"
+	"github.com/busthorne/simp/driver"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+// entry is the request, as it goes in the ledger.
+type entry struct {
+	kind      string
+	model     string
+	provider  string
+	principal string
+	usage     openai.Usage
+	latency   time.Duration
+	status    int
+}
+
+// record the entry in the ledger; the provider, if not known, is the one
+// that claims the model.
+func record(e entry) {
+	if books.DB == nil {
+		return
+	}
+	if e.provider == "" && cfg != nil {
+		if _, p, ok := cfg.LookupModel(e.model); ok {
+			e.provider = p.ID()
+		}
+	}
+	params := books.InsertLedgerParams{
+		At:               time.Now().UTC(),
+		Kind:             e.kind,
+		Model:            e.model,
+		Provider:         e.provider,
+		Principal:        e.principal,
+		PromptTokens:     int64(e.usage.PromptTokens),
+		CompletionTokens: int64(e.usage.CompletionTokens),
+		LatencyMs:        e.latency.Milliseconds(),
+		Status:           int64(e.status),
+	}
+	if d := e.usage.PromptTokensDetails; d != nil {
+		params.CachedTokens = int64(d.CachedTokens)
+	}
+	if d := e.usage.CompletionTokensDetails; d != nil {
+		params.ReasoningTokens = int64(d.ReasoningTokens)
+	}
+	if err := books.Session().InsertLedger(bg, params); err != nil {
+		log.Errorf("ledger: %v\n", notkeep(err, "insert"))
+	}
+}
+
+// statusOf is the status that the request has ended with, as far as the
+// ledger is concerned.
+func statusOf(err error) int {
+	var (
+		apiErr *openai.APIError
+		reqErr *openai.RequestError
+	)
+	switch {
+	case err == nil:
+		return fiber.StatusOK
+	case errors.Is(err, simp.ErrRetry):
+		return fiber.StatusServiceUnavailable
+	case errors.As(err, &apiErr) && apiErr.HTTPStatusCode != 0:
+		return apiErr.HTTPStatusCode
+	case errors.As(err, &reqErr) && reqErr.HTTPStatusCode != 0:
+		return reqErr.HTTPStatusCode
+	}
+	return fiber.StatusInternalServerError
+}
+
+// servedKey is where the balancer leaves the provider that it has picked.
+type servedKey struct{}
+
+// serving makes the context that the balancer would report to.
+func serving(ctx context.Context) (context.Context, *string) {
+	provider := new(string)
+	return context.WithValue(ctx, servedKey{}, provider), provider
+}
+
+func served(ctx context.Context, provider string) {
+	if p, ok := ctx.Value(servedKey{}).(*string); ok {
+		*p = provider
+	}
+}
+
+// recordBatch records the output of the batch, as far as it's known; the
+// principal is whoever has uploaded the batch.
+func recordBatch(output openai.BatchOutput, g *grant, model, provider string, latency time.Duration) {
+	e := entry{
+		kind:     "batch",
+		provider: provider,
+		latency:  latency,
+		status:   fiber.StatusOK,
+	}
+	if g != nil {
+		e.principal = g.principal()
+	}
+	e.model, e.usage = outputModel(output, model)
+	if output.Error != nil {
+		e.status = statusOf(output.Error)
+	}
+	record(e)
+}
+
+// outputModel is the model that has produced the output, if it says so,
+// and its usage.
+func outputModel(output openai.BatchOutput, model string) (string, openai.Usage) {
+	var usage openai.Usage
+	switch {
+	case output.ChatCompletion != nil:
+		usage = output.ChatCompletion.Usage
+		if m := output.ChatCompletion.Model; m != "" {
+			model = m
+		}
+	case output.Embedding != nil:
+		usage = output.Embedding.Usage
+		if m := string(output.Embedding.Model); m != "" {
+			model = m
+		}
+	}
+	return model, usage
+}
+
+// cliPrincipal is who is running simp, as the ledger knows them.
+func cliPrincipal() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "cli"
+}
+
+// recordCLI records the request that simp has made by itself; the requests
+// made through the daemon are recorded by the daemon.
+func recordCLI(d simp.Driver, e entry) {
+	if _, ok := d.(*driver.Daemon); ok {
+		return
+	}
+	e.principal = cliPrincipal()
+	record(e)
+}
+
+// usageRow is the usage of the requests in the bucket, and the group.
+type usageRow struct {
+	Bucket           *time.Time `json:"bucket,omitempty"`
+	Kind             string     `json:"kind,omitempty"`
+	Model            string     `json:"model,omitempty"`
+	Provider         string     `json:"provider,omitempty"`
+	Principal        string     `json:"principal,omitempty"`
+	Status           int64      `json:"status,omitempty"`
+	Requests         int64      `json:"requests"`
+	Errors           int64      `json:"errors"`
+	PromptTokens     int64      `json:"prompt_tokens"`
+	CachedTokens     int64      `json:"cached_tokens"`
+	CompletionTokens int64      `json:"completion_tokens"`
+	ReasoningTokens  int64      `json:"reasoning_tokens"`
+	// the average latency
+	LatencyMs int64 `json:"latency_ms"`
+}
+
+// usageQuery is the report to be made of the ledger.
+type usageQuery struct {
+	since, until time.Time
+	// hour, day, week, month, or none
+	bucket  string
+	groupBy []string
+	// the principal that the report is limited to, if any
+	principal string
+}
+
+var groupings = []string{"kind", "model", "provider", "principal", "status"}
+
+// parseUsageQuery reads the query, as given to /v1/usage, or simp -usage;
+// the since may be either a date, a timestamp, or the duration ago, such
+// as 24h, or 7d.
+func parseUsageQuery(since, until, bucket, groupBy string) (q usageQuery, err error) {
+	now := time.Now().UTC()
+	q.since, q.until = now.AddDate(0, 0, -7), now
+	if since != "" {
+		if q.since, err = parseSince(since, now); err != nil {
+			return q, fmt.Errorf("since: %w", err)
+		}
+	}
+	if until != "" {
+		if q.until, err = parseSince(until, now); err != nil {
+			return q, fmt.Errorf("until: %w", err)
+		}
+	}
+	switch bucket {
+	case "", "none", "hour", "day", "week", "month":
+		q.bucket = bucket
+	default:
+		return q, fmt.Errorf("bucket %q: hour, day, week, month, or none", bucket)
+	}
+	for _, g := range strings.Split(groupBy, ",") {
+		g = strings.TrimSpace(g)
+		if g == "" {
+			continue
+		}
+		if !slices.Contains(groupings, g) {
+			return q, fmt.Errorf("group_by %q: %s", g, strings.Join(groupings, ", "))
+		}
+		q.groupBy = append(q.groupBy, g)
+	}
+	return q, nil
+}
+
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if n, ok := strings.CutSuffix(s, "d"); ok {
+		if days, err := strconv.Atoi(n); err == nil {
+			return now.AddDate(0, 0, -days), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Parse(time.DateOnly, s)
+}
+
+// usageReport adds up the ledger by the buckets, and the groups, as far as
+// the principal goes; the report is sorted by the bucket, then by the most
+// tokens.
+func usageReport(ctx context.Context, q usageQuery) ([]usageRow, error) {
+	params := books.LedgerUsageParams{
+		Bucket:      q.bucket,
+		Since:       q.since.UTC(),
+		Until:       q.until.UTC(),
+		PrincipalOf: q.principal,
+	}
+	for _, g := range q.groupBy {
+		switch g {
+		case "kind":
+			params.ByKind = true
+		case "model":
+			params.ByModel = true
+		case "provider":
+			params.ByProvider = true
+		case "principal":
+			params.ByPrincipal = true
+		case "status":
+			params.ByStatus = true
+		}
+	}
+	ledger, err := books.Session().LedgerUsage(ctx, params)
+	if err != nil {
+		return nil, notkeep(err, "fetch usage")
+	}
+	report := make([]usageRow, 0, len(ledger))
+	for _, l := range ledger {
+		r := usageRow{
+			Kind:             l.Kind,
+			Model:            l.Model,
+			Provider:         l.Provider,
+			Principal:        l.Principal,
+			Status:           l.Status,
+			Requests:         l.Requests,
+			Errors:           l.Errors,
+			PromptTokens:     l.PromptTokens,
+			CachedTokens:     l.CachedTokens,
+			CompletionTokens: l.CompletionTokens,
+			ReasoningTokens:  l.ReasoningTokens,
+			LatencyMs:        l.LatencyMs,
+		}
+		if l.Bucket != "" {
+			bucket, err := time.Parse(time.RFC3339, l.Bucket)
+			if err != nil {
+				return nil, fmt.Errorf("bucket %q: %w", l.Bucket, err)
+			}
+			r.Bucket = &bucket
+		}
+		report = append(report, r)
+	}
+	return report, nil
+}
+
+// Usage reports the ledger; the clients with a grant only see their own.
+//
+//	GET /v1/usage?since=7d&until=&bucket=day&group_by=model,principal
+func Usage(c *fiber.Ctx) error {
+	q, err := parseUsageQuery(c.Query("since"), c.Query("until"), c.Query("bucket"), c.Query("group_by"))
+	if err != nil {
+		return err
+	}
+	if g := grantOf(c); g != nil {
+		q.principal = g.principal()
+	}
+	report, err := usageReport(c.UserContext(), q)
+	if err != nil {
+		return err
+	}
+	return c.JSON(fiber.Map{"object": "list", "data": report})
+}
+
+// usage prints the report of the ledger, either the local one, or the
+// daemon's:
+//
+//	simp -usage 7d [bucket] [group,by]
+func usage(since string, args []string) error {
+	var bucket, groupBy string
+	if len(args) > 0 {
+		bucket = args[0]
+	}
+	if len(args) > 1 {
+		groupBy = args[1]
+	}
+	q, err := parseUsageQuery(since, "", bucket, groupBy)
+	if err != nil {
+		return err
+	}
+	var report []usageRow
+	if d := cfg.Daemon; d != nil && d.DaemonAddr != "" {
+		drv, err := daemonDriver(*d)
+		if err != nil {
+			return err
+		}
+		var list struct {
+			Data []usageRow `json:"data"`
+		}
+		query := url.Values{"since": {since}, "bucket": {bucket}, "group_by": {groupBy}}
+		if err := drv.Usage(bg, query, &list); err != nil {
+			return err
+		}
+		report = list.Data
+	} else if report, err = usageReport(bg, q); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	var header []string
+	if q.bucket != "" && q.bucket != "none" {
+		header = append(header, "BUCKET")
+	}
+	for _, g := range q.groupBy {
+		header = append(header, strings.ToUpper(g))
+	}
+	header = append(header, "REQUESTS", "ERRORS", "PROMPT", "CACHED", "COMPLETION", "REASONING", "LATENCY")
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, r := range report {
+		var cols []string
+		if r.Bucket != nil {
+			cols = append(cols, r.Bucket.UTC().Format(bucketFormat(q.bucket)))
+		}
+		for _, g := range q.groupBy {
+			switch g {
+			case "kind":
+				cols = append(cols, r.Kind)
+			case "model":
+				cols = append(cols, r.Model)
+			case "provider":
+				cols = append(cols, r.Provider)
+			case "principal":
+				cols = append(cols, r.Principal)
+			case "status":
+				cols = append(cols, strconv.FormatInt(r.Status, 10))
+			}
+		}
+		cols = append(cols,
+			strconv.FormatInt(r.Requests, 10),
+			strconv.FormatInt(r.Errors, 10),
+			strconv.FormatInt(r.PromptTokens, 10),
+			strconv.FormatInt(r.CachedTokens, 10),
+			strconv.FormatInt(r.CompletionTokens, 10),
+			strconv.FormatInt(r.ReasoningTokens, 10),
+			(time.Duration(r.LatencyMs) * time.Millisecond).String())
+		fmt.Fprintln(w, strings.Join(cols, "\t"))
+	}
+	return w.Flush()
+}
+
+func bucketFormat(bucket string) string {
+	switch bucket {
+	case "hour":
+		return "2006-01-02 15:00"
+	case "month":
+		return "2006-01"
+	}
+	return time.DateOnly
+}
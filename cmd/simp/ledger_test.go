@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/busthorne/simp/books"
+	"github.com/busthorne/simp/config"
+	"github.com/gofiber/fiber/v2"
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestLedger(t *testing.T) {
+	if err := books.Open(":memory:"); err != nil {
+		t.Fatal(err)
+	}
+	defer func(c *config.Config) { cfg = c }(cfg)
+	cfg = &config.Config{
+		Providers: []config.Provider{
+			{Driver: "openai", Name: "api", Models: []config.Model{
+				{Name: "gpt-4o"},
+			}},
+		},
+	}
+	cfg.ClearCache()
+
+	day := time.Date(2024, 11, 4, 10, 0, 0, 0, time.UTC) // Monday
+	book := books.Session()
+	for _, l := range []books.InsertLedgerParams{
+		{At: day, Kind: "chat", Model: "gpt-4o", Principal: "alice", PromptTokens: 10, CompletionTokens: 5, LatencyMs: 100, Status: 200},
+		{At: day.Add(time.Hour), Kind: "chat", Model: "gpt-4o", Principal: "bob", PromptTokens: 20, CompletionTokens: 5, LatencyMs: 300, Status: 200},
+		{At: day.Add(24 * time.Hour), Kind: "embed", Model: "te3", Principal: "alice", PromptTokens: 7, Status: 429},
+	} {
+		if err := book.InsertLedger(bg, l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q, err := parseUsageQuery("2024-11-01", "2024-11-30", "day", "principal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := usageReport(bg, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report) != 3 {
+		t.Fatalf("report: %+v", report)
+	}
+	if r := report[0]; r.Principal != "bob" || !r.Bucket.Equal(day.Truncate(24*time.Hour)) {
+		t.Errorf("first: %+v", r)
+	}
+	if r := report[2]; r.Principal != "alice" || r.Errors != 1 || r.PromptTokens != 7 {
+		t.Errorf("last: %+v", r)
+	}
+
+	q, _ = parseUsageQuery("2024-11-01", "2024-11-30", "week", "model")
+	report, _ = usageReport(bg, q)
+	if len(report) != 2 || report[0].Model != "gpt-4o" || report[0].Requests != 2 || report[0].LatencyMs != 200 {
+		t.Errorf("weekly: %+v", report)
+	}
+	if report[0].Bucket.Weekday() != time.Monday {
+		t.Errorf("week starts on %v", report[0].Bucket.Weekday())
+	}
+
+	q, _ = parseUsageQuery("2024-11-01", "2024-11-30", "", "")
+	report, _ = usageReport(bg, q)
+	if len(report) != 1 || report[0].Bucket != nil || report[0].Requests != 3 || report[0].Errors != 1 {
+		t.Errorf("total: %+v", report)
+	}
+
+	for _, bad := range [][4]string{
+		{"yesterday", "", "", ""},
+		{"", "", "year", ""},
+		{"", "", "", "model,colour"},
+	} {
+		if _, err := parseUsageQuery(bad[0], bad[1], bad[2], bad[3]); err == nil {
+			t.Errorf("parse %q: no error", bad)
+		}
+	}
+
+	// the provider is the one that claims the model
+	record(entry{
+		kind:      "chat",
+		model:     "gpt-4o",
+		principal: "sso:carol",
+		usage:     openai.Usage{PromptTokens: 3, CompletionTokens: 1},
+		status:    statusOf(errors.New("boom")),
+	})
+	recordBatch(openai.BatchOutput{
+		ChatCompletion: &openai.ChatCompletionResponse{Model: "gpt-4o-2024-08-06"},
+	}, &grant{name: "dave"}, "gpt-4o", "", 0)
+
+	f := fiber.New()
+	f.Use(func(c *fiber.Ctx) error {
+		if name := c.Get("X-Grant"); name != "" {
+			c.Locals(localGrant, &grant{id: c.Get("X-Key"), name: name})
+		}
+		return c.Next()
+	})
+	f.Get("/v1/usage", Usage)
+	get := func(query, name string, key ...string) []usageRow {
+		req := httptest.NewRequest("GET", "/v1/usage?"+query, nil)
+		req.Header.Set("X-Grant", name)
+		if len(key) > 0 {
+			req.Header.Set("X-Key", key[0])
+		}
+		resp, err := f.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var list struct {
+			Data []usageRow `json:"data"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		return list.Data
+	}
+	rows := get("since=1h&group_by=principal,provider,status", "carol")
+	if len(rows) != 1 {
+		t.Fatalf("carol: %+v", rows)
+	}
+	if r := rows[0]; r.Principal != "sso:carol" || r.Provider != "openai:api" || r.Status != 500 || r.Errors != 1 {
+		t.Errorf("carol: %+v", r)
+	}
+	rows = get("since=1h&group_by=kind,model", "")
+	if len(rows) != 2 {
+		t.Fatalf("everyone: %+v", rows)
+	}
+	if r := rows[1]; r.Kind != "batch" || r.Model != "gpt-4o-2024-08-06" {
+		t.Errorf("batch: %+v", r)
+	}
+	// the batch is dave's, who has uploaded it
+	rows = get("since=1h&group_by=kind", "dave")
+	if len(rows) != 1 || rows[0].Kind != "batch" || rows[0].Requests != 1 {
+		t.Errorf("dave: %+v", rows)
+	}
+	// the key that goes by the same name is not dave
+	if rows = get("since=1h&group_by=kind", "dave", "k1"); len(rows) != 0 {
+		t.Errorf("dave's namesake: %+v", rows)
+	}
+}
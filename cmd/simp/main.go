@@ -28,6 +28,10 @@ var (
 	daemon           = flag.Bool("daemon", false, "run as daemon")
 	vim              = flag.Bool("vim", false, "vim mode")
 	historypath      = flag.Bool("historypath", false, "display history path per current location")
+	batchFile        = flag.String("batch-check", "", "validate batch input file, and show the plan")
+	keysCmd          = flag.String("keys", "", "manage the daemon client keys: create, list, revoke, or use")
+	clientCertName   = flag.String("client-cert", "", "issue the daemon client certificate by the local CA")
+	usageSince       = flag.String("usage", "", "usage report of the period, such as 24h, or 7d: [bucket] [group,by]")
 	interactive      = flag.Bool("i", false, "interactive mode")
 	verbose          = flag.Bool("v", false, "verbose output")
 	debug            = flag.Bool("vv", false, "very verbose (debug) output")
@@ -59,6 +63,10 @@ func main() {
 		"configure",
 		"daemon",
 		"historypath",
+		"batch-check",
+		"keys",
+		"client-cert",
+		"usage",
 		"i",
 	)
 	if conflicts != nil {
@@ -75,6 +83,30 @@ func main() {
 	case *historypath:
 		fmt.Println(anthology)
 		return
+	case *batchFile != "":
+		if err := batchCheck(*batchFile); err != nil {
+			stderr("simp:", err)
+			exit(1)
+		}
+		return
+	case *keysCmd != "":
+		if err := keys(*keysCmd, flag.Args()); err != nil {
+			stderr("simp:", err)
+			exit(1)
+		}
+		return
+	case *clientCertName != "":
+		if err := clientCertCmd(*clientCertName, flag.Args()); err != nil {
+			stderr("simp:", err)
+			exit(1)
+		}
+		return
+	case *usageSince != "":
+		if err := usage(*usageSince, flag.Args()); err != nil {
+			stderr("simp:", err)
+			exit(1)
+		}
+		return
 	case *daemon:
 		if *verbose {
 			log.SetLevel(log.LevelInfo)
@@ -103,6 +135,20 @@ func main() {
 		}()
 		sig := make(chan os.Signal, 1)
 		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+		// the native sub-batches are retried from their spools
+		spoolDir = path.Join(simp.Path, "spool")
+		if err := os.MkdirAll(spoolDir, 0700); err != nil {
+			stderr("spool:", err)
+			exit(1)
+		}
+		ctx, cancel := context.WithCancel(bg)
+		defer cancel()
+		if err := reconcile(ctx); err != nil {
+			log.Errorf("reconcile: %v\n", err)
+		}
+		go implicit(ctx)
+		go poll(ctx)
 		for {
 			f := listen()
 			for {
@@ -115,6 +161,8 @@ func main() {
 					return
 				}
 				if f != nil {
+					// the event streams would hold up the shutdown otherwise
+					batchEvents.hangup()
 					if err := f.Shutdown(); err != nil {
 						log.Error("failed to shutdown:", err)
 						return
@@ -156,7 +204,11 @@ func wave() {
 		wizard()
 		exit(1)
 	}
-	// positional control flags
+	// positional control flags, unless they're the keys, the groups of the
+	// client certificate, or the usage report
+	if *keysCmd != "" || *clientCertName != "" || *usageSince != "" {
+		return
+	}
 	for k, arg := range flag.Args() {
 		j, err := strconv.ParseFloat(arg, 32)
 		if err != nil {
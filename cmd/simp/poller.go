@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/busthorne/simp/books"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	// how often the poller wakes up
+	pollTick = 15 * time.Second
+	// the backoff bounds for each provider
+	pollMin = 30 * time.Second
+	pollMax = 10 * time.Minute
+)
+
+// poller refreshes the in-progress batches on its own, so that superbatches
+// would complete, and the outputs be downloaded, even if nobody is polling.
+//
+// The providers are polled with exponential backoff: the wait is doubled
+// whenever none of the provider's sub-batches would change status, and
+// reset as soon as any one of them does.
+type poller struct {
+	// backoff by provider
+	backoff map[string]*pollBackoff
+}
+
+type pollBackoff struct {
+	next time.Time
+	wait time.Duration
+}
+
+// poll runs the poller until the context is done.
+func poll(ctx context.Context) {
+	p := poller{backoff: map[string]*pollBackoff{}}
+	tick := time.NewTicker(pollTick)
+	defer tick.Stop()
+	for {
+		if err := p.poll(ctx); err != nil {
+			log.Errorf("poller: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+func (p *poller) poll(ctx context.Context) error {
+	book := books.Session()
+	expired, err := book.BatchesExpired(ctx)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+	default:
+		return notkeep(err, "fetch expired batches")
+	}
+	for _, row := range expired {
+		super := row.Body
+		if err := expire(ctx, &super); err != nil {
+			return err
+		}
+		log.Infof("batch %q is %s\n", super.ID, super.Status)
+	}
+
+	supers, err := book.BatchesInProgress(ctx)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return nil
+	default:
+		return notkeep(err, "fetch batches in progress")
+	}
+
+	now := time.Now()
+	// whether the provider is due, and whether any of its sub-batches changed
+	due, changed := map[string]bool{}, map[string]bool{}
+	for _, row := range supers {
+		super := row.Body
+
+		subs, err := book.SubBatchesPending(ctx, &super.ID)
+		if err != nil {
+			return notkeep(err, "fetch pending sub-batches")
+		}
+		for i, sub := range subs {
+			if sub.Body.Status != openai.BatchStatusInProgress {
+				continue
+			}
+			provider := p.provider(sub)
+			b, ok := p.backoff[provider]
+			if !ok {
+				b = &pollBackoff{wait: pollMin}
+				p.backoff[provider] = b
+			}
+			if now.Before(b.next) {
+				continue
+			}
+			due[provider] = true
+
+			if err := refreshSub(ctx, &subs[i]); err != nil {
+				log.Errorf("poller: batch %q: %v\n", sub.ID, err)
+				continue
+			}
+			if subs[i].Body.Status != sub.Body.Status {
+				changed[provider] = true
+			}
+		}
+		// the outputs that could not be downloaded the first time around
+		done, err := book.SubBatchesCompleted(ctx, &super.ID)
+		if err != nil {
+			return notkeep(err, "fetch completed sub-batches")
+		}
+		for _, sub := range done {
+			if sub.ReceivedAt != nil {
+				continue
+			}
+			bd, _, err := findBaldoFor(sub)
+			if err != nil {
+				continue
+			}
+			if err := receiveSub(ctx, bd, sub); err != nil {
+				log.Errorf("poller: batch %q: %v\n", sub.ID, err)
+			}
+		}
+		before := super.Status
+		if err := rollup(ctx, &super); err != nil {
+			return err
+		}
+		if super.Status != before {
+			log.Infof("batch %q is %s\n", super.ID, super.Status)
+		}
+	}
+	for provider := range due {
+		b := p.backoff[provider]
+		if changed[provider] {
+			b.wait = pollMin
+		} else if b.wait *= 2; b.wait > pollMax {
+			b.wait = pollMax
+		}
+		b.next = now.Add(b.wait)
+	}
+	return nil
+}
+
+// provider returns the identity of the provider serving the sub-batch.
+func (p *poller) provider(sub books.Batch) string {
+	if sub.Provider != nil {
+		return *sub.Provider
+	}
+	_, provider, ok := cfg.LookupModel(sub.Model)
+	if !ok {
+		return sub.Model
+	}
+	return provider.ID()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/busthorne/simp"
+	"github.com/busthorne/simp/books"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+// reconcile picks up the pieces after the daemon had died mid-way.
+//
+// The sub-batches that were being sent are checked against the provider
+// if the job had made it there, and cancelled otherwise, so that they could
+// be retried. The superbatches that were only partially sent are sent the
+// rest of the way. The implicit ops that were started, but never completed,
+// are released so that they would be done once again: the provider may well
+// have seen them before, so the ops are done at least once, although there
+// is only ever the one output per custom_id.
+func reconcile(ctx context.Context) error {
+	book := books.Session()
+	sending, err := book.SubBatchesSending(ctx)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+	default:
+		return notkeep(err, "fetch sub-batches sending")
+	}
+	for i := range sending {
+		sub := &sending[i]
+		if err := unsend(ctx, sub); err != nil {
+			return err
+		}
+		log.Infof("batch %q was interrupted while sending, is now %s\n", sub.ID, sub.Body.Status)
+	}
+
+	supers, err := book.BatchesInterrupted(ctx)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+	default:
+		return notkeep(err, "fetch interrupted batches")
+	}
+	for _, row := range supers {
+		super := row.Body
+		if err := resend(ctx, &super); err != nil {
+			return err
+		}
+		log.Infof("batch %q was interrupted while sending, is now %s\n", super.ID, super.Status)
+	}
+
+	n, err := book.ResetBatchOps(ctx)
+	if err != nil {
+		return notkeep(err, "reset batch ops")
+	}
+	if n > 0 {
+		log.Infof("%d implicit ops were interrupted, will resume\n", n)
+	}
+	return nil
+}
+
+// unsend settles the sub-batch that the daemon was sending when it died.
+//
+// If the provider job id had been kept, the job is real, and it's refreshed
+// like any other; otherwise, there's no telling whether the provider got it,
+// so it's cancelled.
+func unsend(ctx context.Context, sub *books.Batch) error {
+	batch := &sub.Body
+	now := time.Now().Unix()
+	_, id := batch.Metadata[simp.MetaRealID]
+	_, job := batch.Metadata[simp.MetaJob]
+	if id || job {
+		batch.Status = openai.BatchStatusInProgress
+		batch.InProgressAt = now
+		if err := books.Session().UpdateBatch(ctx, books.BatchUpdates(*batch)); err != nil {
+			return notkeep(err, "update sub-batch")
+		}
+		if err := refreshSub(ctx, sub); err != nil {
+			// the poller will get to it
+			log.Errorf("batch %q: reconcile: %v\n", sub.ID, err)
+		}
+		return nil
+	}
+	if batch.Errors == nil {
+		batch.Errors = &openai.BatchErrors{}
+	}
+	batch.Errors.Data = append(batch.Errors.Data, openai.BatchError{
+		Message: "interrupted while sending",
+	})
+	batch.Status = openai.BatchStatusCancelled
+	batch.CancelledAt = now
+	if err := books.Session().UpdateBatch(ctx, books.BatchUpdates(*batch)); err != nil {
+		return notkeep(err, "update sub-batch")
+	}
+	return nil
+}
+
+// resend will send the sub-batches of the superbatch that were never sent,
+// and bring the superbatch up to date as BatchSend would have.
+//
+// The metadata and completion window are those that BatchSend had kept
+// on the superbatch before it began sending.
+func resend(ctx context.Context, super *openai.Batch) error {
+	book := books.Session()
+	subs, err := book.SubBatches(ctx, &super.ID)
+	if err != nil {
+		return notkeep(err, "fetch sub-batches")
+	}
+	// the superbatch expires along with the sub-batches already sent
+	for _, sub := range subs {
+		if e := sub.Body.ExpiresAt; e > super.ExpiresAt {
+			super.ExpiresAt = e
+		}
+	}
+	if super.ExpiresAt == 0 {
+		window, err := time.ParseDuration(super.CompletionWindow)
+		if err != nil {
+			window = 24 * time.Hour
+		}
+		super.ExpiresAt = time.Now().Add(window).Unix()
+	}
+	sent := 0
+	for _, sub := range subs {
+		switch sub.Body.Status {
+		case "":
+			ok, err := send(ctx, super, sub)
+			if err != nil {
+				return err
+			}
+			if ok {
+				sent++
+			}
+		case openai.BatchStatusCancelled:
+		default:
+			sent++
+		}
+	}
+	now := time.Now().Unix()
+	if sent == 0 {
+		super.Status = openai.BatchStatusFailed
+		super.CancelledAt = now
+	} else {
+		super.Status = openai.BatchStatusInProgress
+		super.InProgressAt = now
+	}
+	return rollup(ctx, super)
+}
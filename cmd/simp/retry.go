@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/busthorne/simp"
+	"github.com/busthorne/simp/config"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	// how many times the transient errors are retried by default
+	retries = 3
+	// the first backoff by default, doubling with every retry
+	retryMin = 500 * time.Millisecond
+	// the longest backoff by default
+	retryMax = 30 * time.Second
+)
+
+// backoff is the retry policy of the provider.
+type backoff struct {
+	retries  int
+	min, max time.Duration
+}
+
+// backoffFor is the retry policy of the provider, as overridden by its
+// config; the negative retries mean none.
+func backoffFor(p config.Provider) backoff {
+	b := backoff{retries: retries, min: retryMin, max: retryMax}
+	switch {
+	case p.Retries < 0:
+		b.retries = 0
+	case p.Retries > 0:
+		b.retries = p.Retries
+	}
+	if d, err := time.ParseDuration(p.RetryMin); err == nil && d > 0 {
+		b.min = d
+	}
+	if d, err := time.ParseDuration(p.RetryMax); err == nil && d > 0 {
+		b.max = d
+	}
+	b.max = max(b.max, b.min)
+	return b
+}
+
+// backoffOf is the retry policy of the model's provider, or the default.
+func backoffOf(model string) backoff {
+	var p config.Provider
+	if cfg != nil {
+		_, p, _ = cfg.LookupModel(model)
+	}
+	return backoffFor(p)
+}
+
+// delay is how long to wait before the nth retry: it's exponential, with
+// the jitter of up to a half, unless the upstream had hinted otherwise.
+func (b backoff) delay(n int, err error) time.Duration {
+	d := b.max
+	if n < 32 && b.min<<n < b.max {
+		d = b.min << n
+	}
+	d = d/2 + rand.N(d/2+1)
+	if re := (*simp.RetryError)(nil); errors.As(err, &re) && re.After > d {
+		d = re.After
+	}
+	return d
+}
+
+// retry calls f until it succeeds, fails for good, or runs out of retries;
+// the upstream that asks to hold off for longer than the longest backoff
+// is given up on straight away.
+func retry[T any](ctx context.Context, b backoff, f func() (T, error)) (T, error) {
+	for n := 0; ; n++ {
+		v, err := f()
+		if err == nil || !errors.Is(err, simp.ErrRetry) || n >= b.retries {
+			return v, err
+		}
+		d := b.delay(n, err)
+		if d > b.max {
+			return v, err
+		}
+		log.Debugf("retry %d/%d in %v: %v\n", n+1, b.retries, d.Round(time.Millisecond), err)
+		select {
+		case <-ctx.Done():
+			return v, err
+		case <-time.After(d):
+		}
+	}
+}
+
+// chat is the completion with retries; the stream is only retried if it
+// fails before the first chunk, for nothing would have been sent by then.
+func chat(ctx context.Context, d simp.Driver, b backoff, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	return retry(ctx, b, func() (openai.ChatCompletionResponse, error) {
+		resp, err := d.Chat(ctx, req)
+		if err != nil {
+			return resp, err
+		}
+		resp, _, err = peek(resp)
+		return resp, err
+	})
+}
+
+// peek waits for the first chunk of the stream, if it's a stream at all,
+// so that the stream that fails right away could be told from the one that
+// has begun; the first chunk is replayed.
+func peek(resp openai.ChatCompletionResponse) (_ openai.ChatCompletionResponse, first *openai.ChatCompletionStreamResponse, err error) {
+	if resp.Stream == nil {
+		return resp, nil, nil
+	}
+	chunk, ok := <-resp.Stream
+	switch {
+	case !ok:
+		return resp, nil, nil
+	case chunk.Error != nil:
+		return resp, &chunk, chunk.Error
+	}
+	stream := make(chan openai.ChatCompletionStreamResponse, 1)
+	go func(rest <-chan openai.ChatCompletionStreamResponse) {
+		defer close(stream)
+		stream <- chunk
+		for chunk := range rest {
+			stream <- chunk
+		}
+	}(resp.Stream)
+	resp.Stream = stream
+	return resp, &chunk, nil
+}
+
+// embed is the embedding with retries.
+func embed(ctx context.Context, d simp.Driver, b backoff, req openai.EmbeddingRequest) (openai.EmbeddingResponse, error) {
+	return retry(ctx, b, func() (openai.EmbeddingResponse, error) {
+		return d.Embed(ctx, req)
+	})
+}
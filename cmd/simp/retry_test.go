@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/busthorne/simp"
+	"github.com/sashabaranov/go-openai"
+)
+
+// flaky fails the first so many chats with a transient error, either right
+// away, or in the first chunk of the stream.
+type flaky struct {
+	simp.Driver
+	fails, calls int
+}
+
+func (f *flaky) Chat(ctx context.Context, req openai.ChatCompletionRequest) (c openai.ChatCompletionResponse, err error) {
+	f.calls++
+	fail := f.calls <= f.fails
+	if !req.Stream {
+		if fail {
+			return c, &simp.RetryError{Err: errors.New("overloaded")}
+		}
+		c.Choices = []openai.ChatCompletionChoice{{Message: openai.ChatCompletionMessage{Content: "ok"}}}
+		return c, nil
+	}
+	c.Stream = make(chan openai.ChatCompletionStreamResponse, 2)
+	if fail {
+		c.Stream <- openai.ChatCompletionStreamResponse{
+			Choices: []openai.ChatCompletionStreamChoice{{FinishReason: "error"}},
+			Error:   &simp.RetryError{Err: errors.New("overloaded")},
+		}
+	} else {
+		c.Stream <- openai.ChatCompletionStreamResponse{
+			Choices: []openai.ChatCompletionStreamChoice{{Delta: openai.ChatCompletionStreamChoiceDelta{Content: "ok"}}},
+		}
+		c.Stream <- openai.ChatCompletionStreamResponse{
+			Choices: []openai.ChatCompletionStreamChoice{{FinishReason: "stop"}},
+		}
+	}
+	close(c.Stream)
+	return c, nil
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	b := backoff{retries: 2, min: time.Millisecond, max: 10 * time.Millisecond}
+
+	for _, stream := range []bool{false, true} {
+		f := &flaky{fails: 2}
+		resp, err := chat(ctx, f, b, openai.ChatCompletionRequest{Stream: stream})
+		if err != nil {
+			t.Fatalf("stream=%v: %v", stream, err)
+		}
+		if f.calls != 3 {
+			t.Errorf("stream=%v: %d calls, want 3", stream, f.calls)
+		}
+		if stream {
+			var content string
+			for chunk := range resp.Stream {
+				content += chunk.Choices[0].Delta.Content
+			}
+			if content != "ok" {
+				t.Errorf("stream content %q", content)
+			}
+		}
+
+		f = &flaky{fails: 3}
+		if _, err := chat(ctx, f, b, openai.ChatCompletionRequest{Stream: stream}); !errors.Is(err, simp.ErrRetry) {
+			t.Errorf("stream=%v: retries exhausted, got %v", stream, err)
+		}
+	}
+
+	// the upstream wants more than the backoff would allow
+	calls := 0
+	_, err := retry(ctx, b, func() (int, error) {
+		calls++
+		return 0, &simp.RetryError{Err: errors.New("rate limited"), After: time.Minute}
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("%d calls, err %v", calls, err)
+	}
+	// not transient
+	calls = 0
+	_, err = retry(ctx, b, func() (int, error) {
+		calls++
+		return 0, errors.New("bad request")
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("%d calls, err %v", calls, err)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	b := backoff{retries: 10, min: 100 * time.Millisecond, max: time.Second}
+	for n := 0; n < 10; n++ {
+		d := b.delay(n, simp.ErrRetry)
+		ceil := min(b.min<<n, b.max)
+		if d < ceil/2 || d > ceil {
+			t.Errorf("retry %d: %v not within [%v, %v]", n, d, ceil/2, ceil)
+		}
+	}
+	hinted := &simp.RetryError{Err: errors.New("slow down"), After: 3 * time.Second}
+	if d := b.delay(0, hinted); d != hinted.After {
+		t.Errorf("hinted delay %v", d)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/busthorne/simp"
+	"github.com/busthorne/simp/config"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+// route is the provider that a batch could be routed to.
+type route struct {
+	config.Claim
+
+	bd simp.BatchDriver
+}
+
+// routes are the claims on the model by the providers that could batch it,
+// cheapest first; the output is anybody's guess ahead of time, so it's the
+// input price that counts. The claims without a price go last, in the order
+// of configuration.
+func routes(model string) (rr []route) {
+	for _, c := range cfg.LookupClaims(model) {
+		d, err := drive(c.Provider)
+		if err != nil {
+			log.Errorf("route %q: provider %s: %v\n", model, c.Provider.Name, err)
+			continue
+		}
+		if bd, ok := d.(simp.BatchDriver); ok {
+			rr = append(rr, route{Claim: c, bd: bd})
+		}
+	}
+	slices.SortStableFunc(rr, func(a, b route) int {
+		pa, pb := a.Model.BatchPrice(), b.Model.BatchPrice()
+		switch {
+		case pa > 0 && pb > 0:
+			return cmp.Compare(pa, pb)
+		case pa > 0:
+			return -1
+		case pb > 0:
+			return 1
+		}
+		return 0
+	})
+	return
+}
+
+// cost is the estimated cost of so many input tokens, if the price is known.
+func (r route) cost(tokens int64) *float64 {
+	price := r.Model.BatchPrice()
+	if price == 0 {
+		return nil
+	}
+	cost := float64(tokens) * price / 1e6
+	return &cost
+}
+
+// rename the inputs after the model as the provider knows it.
+func rename(inputs simp.BatchInputs, model string) simp.BatchInputs {
+	return func(yield func(openai.BatchInput, error) bool) {
+		for input, err := range inputs {
+			switch {
+			case input.ChatCompletion != nil:
+				input.ChatCompletion.Model = model
+			case input.Embedding != nil:
+				input.Embedding.Model = model
+			}
+			if !yield(input, err) {
+				return
+			}
+		}
+	}
+}
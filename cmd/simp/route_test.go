@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/busthorne/simp"
+	"github.com/busthorne/simp/config"
+	"github.com/google/go-cmp/cmp"
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestRoutes(t *testing.T) {
+	defer func(c *config.Config) { cfg = c }(cfg)
+	cfg = &config.Config{
+		Providers: []config.Provider{
+			{Driver: "openai", Name: "unpriced", APIKey: "-", Models: []config.Model{
+				{Name: "gpt-4o"},
+			}},
+			{Driver: "openai", Name: "dear", APIKey: "-", Models: []config.Model{
+				{Name: "gpt-4o", InputPrice: 2.5},
+			}},
+			{Driver: "openai", Name: "cheap", APIKey: "-", Models: []config.Model{
+				{Name: "gpt-4o", InputPrice: 2.5, BatchInputPrice: 1.25},
+			}},
+		},
+	}
+	var got []string
+	for _, r := range routes("gpt-4o") {
+		got = append(got, r.Provider.Name)
+	}
+	if diff := cmp.Diff([]string{"cheap", "dear", "unpriced"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+	if cost := routes("gpt-4o")[0].cost(2e6); cost == nil || *cost != 2.5 {
+		t.Errorf("unexpected cost: %v", cost)
+	}
+}
+
+func TestRoutesByAlias(t *testing.T) {
+	defer func(c *config.Config) { cfg = c }(cfg)
+	cfg = &config.Config{
+		Providers: []config.Provider{
+			{Driver: "anthropic", Name: "api", APIKey: "-", Models: []config.Model{
+				{Name: "claude-3-5-haiku-20241022", Alias: []string{"haiku"}, BatchInputPrice: 0.5},
+			}},
+			{Driver: "vertex", Name: "gcp", APIKey: "-", Batch: true, Models: []config.Model{
+				{Name: "claude-3-5-haiku@20241022", Alias: []string{"haiku"}, BatchInputPrice: 0.4},
+			}},
+		},
+	}
+	claims := func(model string) (got []string) {
+		for _, r := range routes(model) {
+			got = append(got, r.Provider.ID()+"/"+r.Model.Name)
+		}
+		return
+	}
+	want := []string{
+		"vertex:gcp/claude-3-5-haiku@20241022",
+		"anthropic:api/claude-3-5-haiku-20241022",
+	}
+	if diff := cmp.Diff(want, claims("haiku")); diff != "" {
+		t.Fatal(diff)
+	}
+	// the model by its own name is only ever routed to its own provider
+	if diff := cmp.Diff(want[1:], claims("claude-3-5-haiku-20241022")); diff != "" {
+		t.Fatal(diff)
+	}
+
+	inputs := []openai.BatchInput{{
+		CustomID:       "1",
+		ChatCompletion: &openai.ChatCompletionRequest{Model: "haiku"},
+	}}
+	for _, r := range routes("haiku") {
+		for input := range rename(simp.SliceInputs(inputs), r.Model.Name) {
+			if input.ChatCompletion.Model != r.Model.Name {
+				t.Errorf("%s: renamed to %q", r.Provider.ID(), input.ChatCompletion.Model)
+			}
+		}
+	}
+}
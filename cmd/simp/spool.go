@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/busthorne/simp"
+	"github.com/sashabaranov/go-openai"
+)
+
+// spoolDir is where the spools are written; the daemon keeps them along
+// with the books, as the native sub-batches are retried from them.
+var spoolDir = os.TempDir()
+
+// spool is a temporary JSONL file that the batch inputs of one model are
+// written to as they are decoded, so that the multi-gigabyte uploads would
+// not have to be held in memory.
+type spool struct {
+	f *os.File
+	w *bufio.Writer
+
+	// the number of inputs
+	n int
+	// the spool outlives Close, as the sub-batches refer to it
+	kept bool
+}
+
+// section is a contiguous run of inputs in the spool.
+type section struct {
+	off, size int64
+
+	// the number of inputs
+	n int
+	// the estimated input tokens
+	tokens int64
+	// the endpoint of the first input
+	url openai.BatchEndpoint
+}
+
+func newSpool() (*spool, error) {
+	f, err := os.CreateTemp(spoolDir, "simp-spool-*.jsonl")
+	if err != nil {
+		return nil, err
+	}
+	return &spool{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// openSpool reopens the spool that was kept, for reading.
+func openSpool(path string) (*spool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &spool{f: f, kept: true}, nil
+}
+
+// keep the spool past Close; it's up to the caller to remove it.
+func (s *spool) keep() string {
+	s.kept = true
+	return s.f.Name()
+}
+
+func (s *spool) Write(input openai.BatchInput) error {
+	b, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	if _, err := s.w.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	s.n++
+	return nil
+}
+
+// Close will remove the spool file altogether, unless it's kept.
+func (s *spool) Close() error {
+	if s.w != nil {
+		s.w.Flush()
+	}
+	s.f.Close()
+	if s.kept {
+		return nil
+	}
+	return os.Remove(s.f.Name())
+}
+
+// all is the section spanning the whole spool.
+func (s *spool) all() (section, error) {
+	if s.w != nil {
+		if err := s.w.Flush(); err != nil {
+			return section{}, err
+		}
+	}
+	fi, err := s.f.Stat()
+	if err != nil {
+		return section{}, err
+	}
+	return section{size: fi.Size(), n: s.n}, nil
+}
+
+// split partitions the spool into sections that would fit the limits.
+func (s *spool) split(limits simp.BatchLimits) ([]section, error) {
+	whole, err := s.all()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		sections []section
+		cur      section
+		r        = bufio.NewReader(io.NewSectionReader(s.f, 0, whole.size))
+	)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var input openai.BatchInput
+		if err := json.Unmarshal(line, &input); err != nil {
+			return nil, err
+		}
+		n, t := int64(len(line)), simp.EstimateTokens(input)
+		if cur.n > 0 && limits.Exceeds(cur.n+1, cur.size+n, cur.tokens+t) {
+			sections = append(sections, cur)
+			cur = section{off: cur.off + cur.size}
+		}
+		if cur.n == 0 {
+			cur.url = input.URL
+		}
+		cur.size += n
+		cur.n++
+		cur.tokens += t
+	}
+	if cur.n > 0 {
+		sections = append(sections, cur)
+	}
+	return sections, nil
+}
+
+// inputs iterates over the inputs in the section; it may be iterated over
+// as many times as necessary.
+func (s *spool) inputs(sect section) simp.BatchInputs {
+	return func(yield func(openai.BatchInput, error) bool) {
+		r := json.NewDecoder(io.NewSectionReader(s.f, sect.off, sect.size))
+		for {
+			var input openai.BatchInput
+			switch err := r.Decode(&input); err {
+			case nil:
+				if !yield(input, nil) {
+					return
+				}
+			case io.EOF:
+				return
+			default:
+				yield(input, err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/busthorne/simp"
+	"github.com/busthorne/simp/books"
+	"github.com/google/go-cmp/cmp"
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestSpool(t *testing.T) {
+	sp, err := newSpool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Close()
+
+	var want []string
+	for i := 0; i < 5; i++ {
+		id := fmt.Sprint(i)
+		err := sp.Write(openai.BatchInput{
+			CustomID: id,
+			Method:   "POST",
+			URL:      openai.BatchEndpointEmbeddings,
+			Embedding: &openai.EmbeddingRequest{
+				Model: "text-embedding-3-small",
+				Input: []openai.EmbeddingInput{{Text: "hello"}},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, id)
+	}
+	sections, err := sp.split(simp.BatchLimits{Requests: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		got  []string
+		lens []int
+	)
+	for _, sect := range sections {
+		lens = append(lens, sect.n)
+		if sect.url != openai.BatchEndpointEmbeddings {
+			t.Errorf("section url is %q", sect.url)
+		}
+		// "hello" is two tokens, give or take
+		if want := int64(2 * sect.n); sect.tokens != want {
+			t.Errorf("section tokens are %d, want %d", sect.tokens, want)
+		}
+		for input, err := range sp.inputs(sect) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, input.CustomID)
+		}
+	}
+	if diff := cmp.Diff([]int{2, 2, 1}, lens); diff != "" {
+		t.Error(diff)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error(diff)
+	}
+}
+
+// the spool is cut on whichever limit is hit first
+func TestSpoolSplit(t *testing.T) {
+	input := func(text string) openai.BatchInput {
+		return openai.BatchInput{
+			CustomID: "x",
+			Method:   "POST",
+			URL:      openai.BatchEndpointChatCompletions,
+			ChatCompletion: &openai.ChatCompletionRequest{
+				Model:    "gpt-4o",
+				Messages: []openai.ChatCompletionMessage{{Role: "user", Content: text}},
+			},
+		}
+	}
+	var (
+		short = input("hello")
+		long  = input(strings.Repeat("a", 4000))
+	)
+	var tests = []struct {
+		Name   string
+		Limits simp.BatchLimits
+		Inputs []openai.BatchInput
+		Want   []int
+	}{
+		{"unlimited", simp.BatchLimits{}, []openai.BatchInput{short, short, short}, []int{3}},
+		{"bytes", simp.BatchLimits{Bytes: 5000}, []openai.BatchInput{short, long, long, short}, []int{2, 2}},
+		{"tokens", simp.BatchLimits{Tokens: 1500}, []openai.BatchInput{long, long, short}, []int{1, 2}},
+		{"oversized", simp.BatchLimits{Tokens: 10}, []openai.BatchInput{long, short}, []int{1, 1}},
+		{"empty", simp.BatchLimits{Requests: 1}, nil, nil},
+	}
+	for _, test := range tests {
+		sp, err := newSpool()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, input := range test.Inputs {
+			if err := sp.Write(input); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sections, err := sp.split(test.Limits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int
+		for _, sect := range sections {
+			got = append(got, sect.n)
+		}
+		if diff := cmp.Diff(test.Want, got); diff != "" {
+			t.Errorf("%s: %s", test.Name, diff)
+		}
+		sp.Close()
+	}
+}
+
+func TestSpoolRetry(t *testing.T) {
+	if err := books.Open(":memory:"); err != nil {
+		t.Fatal(err)
+	}
+	defer func(dir string) { spoolDir = dir }(spoolDir)
+	spoolDir = t.TempDir()
+
+	sp, err := newSpool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"ok", "bad", "lost"} {
+		if err := sp.Write(openai.BatchInput{CustomID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	all, err := sp.all()
+	if err != nil {
+		t.Fatal(err)
+	}
+	book := books.Session()
+	super := "super"
+	for _, id := range []string{super, "sub"} {
+		p := books.InsertBatchParams{ID: id, Body: openai.Batch{ID: id}}
+		if id != super {
+			p.Super = &super
+		}
+		if err := book.InsertBatch(bg, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = book.InsertBatchSpool(bg, books.InsertBatchSpoolParams{
+		Batch: "sub",
+		Path:  sp.f.Name(),
+		Off:   all.off,
+		Size:  all.size,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keepReferred(bg, sp)
+	sp.Close()
+	path := sp.f.Name()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("referred spool is gone: %v", err)
+	}
+	for _, output := range []openai.BatchOutput{
+		{CustomID: "ok"},
+		{CustomID: "bad", Error: &openai.APIError{Message: "bad"}},
+	} {
+		err := book.InsertBatchOutput(bg, books.InsertBatchOutputParams{
+			Batch:    "sub",
+			CustomID: output.CustomID,
+			Request:  openai.BatchInput{CustomID: output.CustomID},
+			Response: output,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	retry, err := newSpool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer retry.Close()
+	sub, err := book.BatchById(bg, "sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := retryable(bg, book, sub, retry); err != nil {
+		t.Fatal(err)
+	}
+	all, err = retry.all()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for input, err := range retry.inputs(all) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, input.CustomID)
+	}
+	if diff := cmp.Diff([]string{"bad", "lost"}, got); diff != "" {
+		t.Error(diff)
+	}
+
+	if err := unspool(bg, "sub"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("unreferred spool is still there: %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"path"
+	"slices"
+	"sync"
+
+	"github.com/busthorne/simp/auth"
+	"github.com/busthorne/simp/config"
+	"github.com/gofiber/fiber/v2"
+)
+
+// the verifiers of the `jwt`, and `cloudflare` auth blocks of the config
+var sso struct {
+	sync.Mutex
+	cfg  *config.Config
+	list []*auth.JWT
+}
+
+// verifiers are made once per config, as they keep the fetched keys.
+func verifiers() []*auth.JWT {
+	sso.Lock()
+	defer sso.Unlock()
+	if sso.cfg == cfg {
+		return sso.list
+	}
+	sso.cfg, sso.list = cfg, nil
+	if cfg == nil {
+		return nil
+	}
+	for _, a := range cfg.Auth {
+		if !a.Keyring() {
+			sso.list = append(sso.list, auth.NewJWT(a))
+		}
+	}
+	return sso.list
+}
+
+// token is the JWT that the client has presented to the verifier, if any.
+func token(c *fiber.Ctx, j *auth.JWT, bearer string) string {
+	if j.Header == fiber.HeaderAuthorization {
+		return bearer
+	}
+	if t := c.Get(j.Header); t != "" {
+		return t
+	}
+	return bearer
+}
+
+// identity is whoever the client has proven to be, by its token, or its
+// certificate.
+type identity struct {
+	name    string
+	email   string
+	subject string
+	groups  []string
+}
+
+// claimGrant maps the claims to the roles of the auth; the identity is the
+// email, or the subject. No grant means no role has matched.
+func claimGrant(a config.Auth, claims auth.Claims) *grant {
+	id := identity{
+		name:    claims.String("email"),
+		email:   claims.String("email"),
+		subject: claims.String("sub"),
+	}
+	if id.name == "" {
+		id.name = id.subject
+	}
+	groupsClaim := a.GroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+	id.groups = claims.Strings(groupsClaim)
+	return roleGrant(a.Roles, id)
+}
+
+// roleGrant is what the roles that the identity has add up to; if there
+// are no roles, the identity may do anything.
+func roleGrant(roles []config.Role, id identity) *grant {
+	g := &grant{name: id.name}
+	if len(roles) == 0 {
+		return g
+	}
+	var matched []config.Role
+	for _, r := range roles {
+		if hasRole(r, id) {
+			matched = append(matched, r)
+		}
+	}
+	if len(matched) == 0 {
+		return nil
+	}
+	// the roles add up, so whichever is the most generous wins; no models,
+	// or no limit, is the most generous of all
+	g.rpm, g.tpm = matched[0].RPM, matched[0].TPM
+	for _, r := range matched {
+		if len(r.Models) == 0 {
+			g.scope = nil
+			break
+		}
+		g.scope = append(g.scope, r.Models...)
+	}
+	for _, r := range matched[1:] {
+		g.rpm, g.tpm = looser(g.rpm, r.RPM), looser(g.tpm, r.TPM)
+	}
+	return g
+}
+
+func looser(a, b int) int {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return max(a, b)
+}
+
+func hasRole(r config.Role, id identity) bool {
+	for _, e := range r.Emails {
+		if ok, _ := path.Match(e, id.email); ok && id.email != "" {
+			return true
+		}
+	}
+	for _, s := range r.Subjects {
+		if ok, _ := path.Match(s, id.subject); ok && id.subject != "" {
+			return true
+		}
+	}
+	for _, group := range r.Groups {
+		if slices.Contains(id.groups, group) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/busthorne/simp/auth"
+	"github.com/busthorne/simp/config"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestSSO(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding
+	jwks, _ := json.Marshal(map[string]any{"keys": []map[string]string{{
+		"kty": "EC", "kid": "k", "crv": "P-256",
+		"x": b64.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y": b64.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}}})
+	jwksPath := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(jwksPath, jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+	sign := func(claims map[string]any) string {
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+		if _, ok := claims["aud"]; !ok {
+			claims["aud"] = "simp"
+		}
+		h, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": "k"})
+		c, _ := json.Marshal(claims)
+		signed := b64.EncodeToString(h) + "." + b64.EncodeToString(c)
+		sum := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed + "." + b64.EncodeToString(append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...))
+	}
+
+	defer func(c *config.Config) { cfg = c }(cfg)
+	cfg = &config.Config{
+		Auth: []config.Auth{{
+			Type:     "jwt",
+			Name:     "corp",
+			JWKS:     jwksPath,
+			Audience: "simp",
+			Roles: []config.Role{
+				{Name: "staff", Emails: []string{"*@example.com"}, Models: []string{"4o"}, RPM: 10},
+				{Name: "ml", Groups: []string{"ml"}, RPM: 60},
+			},
+		}},
+		Providers: []config.Provider{
+			{Driver: "openai", Name: "api", Models: []config.Model{
+				{Name: "gpt-4o", Alias: []string{"4o"}},
+				{Name: "o1"},
+			}},
+		},
+	}
+	cfg.ClearCache()
+
+	f := fiber.New(fiber.Config{
+		ErrorHandler: func(c *fiber.Ctx, err error) error {
+			return c.SendString(err.Error())
+		},
+	})
+	f.Use(authorize)
+	f.Get("/v1/use/:model", func(c *fiber.Ctx) error {
+		if err := permit(c, c.Params("model")); err != nil {
+			return err
+		}
+		return c.SendString(who(c))
+	})
+	get := func(path, token string) (int, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := f.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	alice := sign(map[string]any{"email": "alice@example.com"})
+	bob := sign(map[string]any{"email": "bob@elsewhere.com", "groups": []string{"ml"}})
+	eve := sign(map[string]any{"email": "eve@elsewhere.com"})
+	// alice's token to some other app
+	other := sign(map[string]any{"email": "alice@example.com", "aud": "other"})
+	cases := []struct {
+		path, token string
+		code        int
+	}{
+		{"/v1/use/4o", "", fiber.StatusUnauthorized},
+		{"/v1/use/4o", "not.a.token", fiber.StatusUnauthorized},
+		{"/v1/use/4o", alice, fiber.StatusOK},
+		{"/v1/use/o1", alice, fiber.StatusForbidden},
+		{"/v1/use/o1", bob, fiber.StatusOK},
+		{"/v1/use/4o", eve, fiber.StatusForbidden},
+		{"/v1/use/4o", other, fiber.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		if code, body := get(c.path, c.token); code != c.code {
+			t.Errorf("%s %.16s: %d %s", c.path, c.token, code, body)
+		}
+	}
+	if _, body := get("/v1/use/4o", alice); body != "alice@example.com" {
+		t.Errorf("who: %s", body)
+	}
+
+	// the roles add up to the most generous of them
+	g := claimGrant(cfg.Auth[0], auth.Claims{
+		"email":  "carol@example.com",
+		"groups": []any{"ml"},
+	})
+	if g == nil || g.scope != nil || g.rpm != 60 {
+		t.Errorf("carol: %+v", g)
+	}
+	if r, ok := g.rate(); !ok || r.scope != "sso:carol@example.com" {
+		t.Errorf("carol's rate: %+v", r)
+	}
+}
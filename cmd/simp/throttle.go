@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/busthorne/simp"
+	"github.com/busthorne/simp/config"
+	"github.com/gofiber/fiber/v2"
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	// how long the requests are queued for by default, before giving up
+	queueTimeout = 30 * time.Second
+	// how often the requests waiting on concurrency check back
+	concurrencyPoll = 100 * time.Millisecond
+)
+
+// limits is where the requests to the providers are throttled.
+var limits = throttle{scopes: map[string]*limiter{}}
+
+// throttle enforces the rate limits of every scope, i.e. the provider, and
+// the model; the request must fit the limits of all of its scopes.
+type throttle struct {
+	sync.Mutex
+
+	// limiters by scope
+	scopes map[string]*limiter
+}
+
+// rate is the limits of the scope, as configured; zero means unlimited.
+type rate struct {
+	scope       string
+	rpm, tpm    int
+	concurrency int
+}
+
+// limiter is a pair of token buckets, one for requests and one for tokens,
+// and a semaphore.
+type limiter struct {
+	rpm, tpm bucket
+
+	concurrency, inflight int
+}
+
+// bucket fills up at the rate of so many per minute, up to as many.
+type bucket struct {
+	limit float64
+	level float64
+	last  time.Time
+}
+
+func (b *bucket) refill(limit int, now time.Time) {
+	if b.limit != float64(limit) || b.last.IsZero() {
+		b.limit, b.level = float64(limit), float64(limit)
+	} else {
+		b.level = min(b.limit, b.level+now.Sub(b.last).Minutes()*b.limit)
+	}
+	b.last = now
+}
+
+// wait is how long until n could be taken from the bucket; n greater than
+// the bucket would only have to wait for the full bucket.
+func (b *bucket) wait(n float64) time.Duration {
+	if b.limit == 0 || b.level >= n {
+		return 0
+	}
+	n = min(n, b.limit)
+	return time.Duration((n - b.level) / b.limit * float64(time.Minute))
+}
+
+func (b *bucket) take(n float64) {
+	if b.limit > 0 {
+		b.level -= n
+	}
+}
+
+// rateLimited is what the request gets if it would not fit the limits
+// before the deadline.
+type rateLimited struct {
+	scope string
+	after time.Duration
+}
+
+func (e rateLimited) Error() string {
+	return fmt.Sprintf("rate limit of %s exceeded, retry after %s", e.scope, e.after.Round(time.Second))
+}
+
+// ratesFor are the limits on the claim, i.e. the provider, and its model.
+func ratesFor(c config.Claim) []rate {
+	m, p := c.Model, c.Provider
+	return []rate{
+		{p.ID(), p.RPM, p.TPM, p.Concurrency},
+		{p.ID() + "/" + m.Name, m.RPM, m.TPM, m.Concurrency},
+	}
+}
+
+// acquire blocks until the request of so many tokens would fit the limits,
+// or returns rateLimited straight away if it wouldn't before the deadline;
+// the zero deadline means there's none.
+//
+// The release must be called once the request is done, with the actual
+// tokens spent, if known, so that the estimate could be made up for.
+func (t *throttle) acquire(ctx context.Context, rates []rate, tokens int64, deadline time.Time) (release func(spent int64), err error) {
+	for {
+		scope, wait := t.try(rates, tokens)
+		if wait == 0 {
+			return func(spent int64) { t.release(rates, tokens, spent) }, nil
+		}
+		if !deadline.IsZero() && time.Now().Add(wait).After(deadline) {
+			return nil, rateLimited{scope: scope, after: wait}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// try takes from the limiters if the request would fit all of them, or tells
+// how long to wait, and for which scope, otherwise.
+func (t *throttle) try(rates []rate, tokens int64) (scope string, wait time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+	now := time.Now()
+	for _, r := range rates {
+		l, ok := t.scopes[r.scope]
+		if !ok {
+			l = &limiter{}
+			t.scopes[r.scope] = l
+		}
+		l.rpm.refill(r.rpm, now)
+		l.tpm.refill(r.tpm, now)
+		l.concurrency = r.concurrency
+
+		w := max(l.rpm.wait(1), l.tpm.wait(float64(tokens)))
+		if l.concurrency > 0 && l.inflight >= l.concurrency {
+			w = max(w, concurrencyPoll)
+		}
+		if w > wait {
+			scope, wait = r.scope, w
+		}
+	}
+	if wait > 0 {
+		return
+	}
+	for _, r := range rates {
+		l := t.scopes[r.scope]
+		l.rpm.take(1)
+		l.tpm.take(float64(tokens))
+		l.inflight++
+	}
+	return
+}
+
+func (t *throttle) release(rates []rate, tokens, spent int64) {
+	t.Lock()
+	defer t.Unlock()
+	for _, r := range rates {
+		l := t.scopes[r.scope]
+		l.inflight--
+		if spent > 0 {
+			l.tpm.take(float64(spent - tokens))
+		}
+	}
+}
+
+// throttled will acquire the limits of the client's grant for the daemon
+// request, queueing it for up to the configured timeout; the limits of the
+// provider, and the model, are up to the gate of whichever claim is called,
+// by the same deadline, see queued.
+func throttled(c *fiber.Ctx, tokens int64) (ctx context.Context, release func(spent int64), err error) {
+	timeout := queueTimeout
+	if d := cfg.Daemon; d != nil && d.QueueTimeout != "" {
+		if t, err := time.ParseDuration(d.QueueTimeout); err == nil {
+			timeout = t
+		}
+	}
+	deadline := time.Now().Add(timeout)
+	ctx = queued(c.Context(), deadline)
+	release = func(int64) {}
+	if r, ok := grantOf(c).rate(); ok {
+		release, err = limits.acquire(ctx, []rate{r}, tokens, deadline)
+		if err != nil {
+			return ctx, nil, tooMany(c, err)
+		}
+	}
+	return ctx, release, nil
+}
+
+// tooMany tells the client to come back later, if the request would not fit
+// the limits in time.
+func tooMany(c *fiber.Ctx, err error) error {
+	var rl rateLimited
+	if !errors.As(err, &rl) {
+		return err
+	}
+	c.Status(fiber.StatusTooManyRequests)
+	c.Set(fiber.HeaderRetryAfter, fmt.Sprint(int(math.Ceil(rl.after.Seconds()))))
+	return &openai.APIError{
+		Type:           "rate_limit_error",
+		Message:        rl.Error(),
+		HTTPStatusCode: fiber.StatusTooManyRequests,
+	}
+}
+
+type queueKey struct{}
+
+// queued makes the context of the request that would rather fail than wait
+// for the limits past the deadline; otherwise, it waits as long as it takes.
+func queued(ctx context.Context, deadline time.Time) context.Context {
+	return context.WithValue(ctx, queueKey{}, deadline)
+}
+
+// gate is the driver of one claim, throttled by its limits; the balancer
+// members, and the fallback links all come down to gates, so that it's the
+// limits of the provider actually called that are acquired.
+type gate struct {
+	simp.Driver
+	claim config.Claim
+}
+
+func (g gate) acquire(ctx context.Context, tokens int64) (release func(spent int64), err error) {
+	deadline, _ := ctx.Value(queueKey{}).(time.Time)
+	return limits.acquire(ctx, ratesFor(g.claim), tokens, deadline)
+}
+
+func (g gate) Embed(ctx context.Context, req openai.EmbeddingRequest) (resp openai.EmbeddingResponse, err error) {
+	release, err := g.acquire(ctx, simp.EstimateTokens(openai.BatchInput{Embedding: &req}))
+	if err != nil {
+		return resp, err
+	}
+	resp, err = g.Driver.Embed(ctx, req)
+	release(int64(resp.Usage.TotalTokens))
+	return
+}
+
+func (g gate) Complete(ctx context.Context, req openai.CompletionRequest) (resp openai.CompletionResponse, err error) {
+	release, err := g.acquire(ctx, 0)
+	if err != nil {
+		return resp, err
+	}
+	resp, err = g.Driver.Complete(ctx, req)
+	release(int64(resp.Usage.TotalTokens))
+	return
+}
+
+// Chat holds on to the limits until the stream is over, if it's a stream;
+// the tokens spent are as the usage chunk would have it.
+func (g gate) Chat(ctx context.Context, req openai.ChatCompletionRequest) (resp openai.ChatCompletionResponse, err error) {
+	release, err := g.acquire(ctx, simp.EstimateTokens(openai.BatchInput{ChatCompletion: &req}))
+	if err != nil {
+		return resp, err
+	}
+	resp, err = g.Driver.Chat(ctx, req)
+	if err != nil || resp.Stream == nil {
+		release(int64(resp.Usage.TotalTokens))
+		return
+	}
+	stream := make(chan openai.ChatCompletionStreamResponse, 1)
+	go func(rest <-chan openai.ChatCompletionStreamResponse) {
+		var spent int64
+		defer close(stream)
+		defer func() { release(spent) }()
+		for chunk := range rest {
+			if chunk.Usage != nil {
+				spent = int64(chunk.Usage.TotalTokens)
+			}
+			stream <- chunk
+		}
+	}(resp.Stream)
+	resp.Stream = stream
+	return
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/busthorne/simp/config"
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestThrottle(t *testing.T) {
+	ctx := context.Background()
+	th := throttle{scopes: map[string]*limiter{}}
+	rates := []rate{
+		{scope: "p", rpm: 2},
+		{scope: "p/m", tpm: 1000, concurrency: 1},
+	}
+	soon := func() time.Time { return time.Now().Add(time.Second) }
+
+	release, err := th.acquire(ctx, rates, 100, soon())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the concurrency is taken up until the release
+	_, err = th.acquire(ctx, rates, 100, time.Now().Add(concurrencyPoll/2))
+	if rl, ok := err.(rateLimited); !ok || rl.scope != "p/m" {
+		t.Fatalf("expected concurrency limit, got %v", err)
+	}
+	// the estimate was short, so the tokens are made up for
+	release(600)
+	release, err = th.acquire(ctx, rates, 100, soon())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release(0)
+
+	// two requests per minute is all there is
+	_, err = th.acquire(ctx, rates, 100, soon())
+	rl, ok := err.(rateLimited)
+	if !ok || rl.scope != "p" {
+		t.Fatalf("expected rpm limit, got %v", err)
+	}
+	if rl.after < 25*time.Second || rl.after > 30*time.Second {
+		t.Errorf("retry after %s, want about 30s", rl.after)
+	}
+	// 1000 - 600 - 100 = 300 tokens left
+	_, err = th.acquire(ctx, rates[1:], 500, soon())
+	if rl, ok := err.(rateLimited); !ok || rl.scope != "p/m" {
+		t.Fatalf("expected tpm limit, got %v", err)
+	}
+	if _, err := th.acquire(ctx, rates[1:], 300, soon()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGate(t *testing.T) {
+	limits.Lock()
+	clear(limits.scopes)
+	limits.Unlock()
+	pool.Lock()
+	clear(pool.sticky)
+	pool.Unlock()
+
+	claim := func(name string) config.Claim {
+		return config.Claim{
+			Model:    config.Model{Name: "gpt-4o"},
+			Provider: config.Provider{Driver: "openai", Name: name, RPM: 1, Concurrency: 1},
+		}
+	}
+	a, b := claim("gate-a"), claim("gate-b")
+	bal := &balancer{alias: "4o", members: []member{
+		{gate{&canned{}, a}, a},
+		{gate{&canned{}, b}, b},
+	}}
+	req := openai.ChatCompletionRequest{Messages: []openai.ChatCompletionMessage{
+		{Role: "user", Content: "hello"},
+	}}
+	ctx, provider := serving(queued(context.Background(), time.Now().Add(10*time.Millisecond)))
+	if _, err := bal.Chat(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	// only the member that has answered is charged
+	limits.Lock()
+	for _, c := range []config.Claim{a, b} {
+		l, ok := limits.scopes[c.Provider.ID()]
+		if charged := ok && l.rpm.level < 1; charged != (c.Provider.ID() == *provider) {
+			t.Errorf("%s: charged is %v, served by %s", c.Provider.ID(), charged, *provider)
+		}
+	}
+	limits.Unlock()
+
+	// the stream holds on to the concurrency until it's over
+	c := claim("gate-stream")
+	c.Provider.RPM = 0
+	g := gate{&canned{}, c}
+	req.Stream = true
+	resp, err := g.Chat(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	soon := queued(context.Background(), time.Now().Add(concurrencyPoll/2))
+	if _, err := g.Chat(soon, req); !errors.As(err, new(rateLimited)) {
+		t.Fatalf("expected concurrency limit, got %v", err)
+	}
+	for range resp.Stream {
+	}
+	soon = queued(context.Background(), time.Now().Add(concurrencyPoll*2))
+	if _, err := g.Chat(soon, req); err != nil {
+		t.Fatal(err)
+	}
+}
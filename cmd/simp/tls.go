@@ -0,0 +1,535 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"os/user"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/busthorne/keyring"
+	"github.com/busthorne/simp/config"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+)
+
+// the keyring items of the daemon
+const (
+	tlsCert    = "tls_cert"
+	tlsKey     = "tls_key"
+	caCert     = "ca_cert"
+	caKey      = "ca_key"
+	clientCert = "client_cert"
+	clientKey  = "client_key"
+)
+
+const (
+	caValidity   = 10 * 365 * 24 * time.Hour
+	certValidity = 397 * 24 * time.Hour
+	// the certificate is issued again once it's this close to expiring
+	certRenewal = 30 * 24 * time.Hour
+)
+
+// daemonKeyring is the daemon's own view of the keyring, where its
+// certificates are kept.
+func daemonKeyring(c *config.Config) (keyring.Keyring, error) {
+	p := config.Provider{Driver: "daemon", Name: "simpd"}
+	if c != nil && c.Daemon != nil {
+		p.Keyring = c.Daemon.Keyring
+	}
+	return keyringFor(p, c)
+}
+
+// serverTLS is the TLS config of the daemon that listens on https; the
+// certificate is either put in the keyring by the wizard, or issued by
+// the local CA if the daemon has auto_tls. The certificate is looked at
+// on every handshake, so that the daemon that runs for longer than it's
+// valid for would renew it, or pick up the one put in the keyring since.
+func serverTLS(d config.Daemon) (*tls.Config, error) {
+	ring, err := daemonKeyring(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("daemon keyring: %w", err)
+	}
+	sc := &serverCert{ring: ring, auto: d.AutoTLS}
+	if d.AutoTLS {
+		sc.hosts = certHosts(d.ListenAddr)
+	}
+	sc.cert, err = sc.load()
+	sc.loaded = time.Now()
+	switch {
+	case err == nil:
+	case d.AutoTLS:
+		return nil, fmt.Errorf("auto_tls: %w", err)
+	case errors.Is(err, keyring.ErrKeyNotFound):
+		return nil, fmt.Errorf("no %s in the keyring: run simp -configure, or set auto_tls", tlsCert)
+	default:
+		return nil, err
+	}
+	c := &tls.Config{
+		GetCertificate: sc.get,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if d.ClientCA != "" {
+		c.ClientCAs, err = clientCAs(ring, d.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("client_ca: %w", err)
+		}
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return c, nil
+}
+
+// serverCert is the certificate of the daemon, as renewed once it's no
+// longer fresh.
+type serverCert struct {
+	sync.Mutex
+	ring  keyring.Keyring
+	auto  bool
+	hosts []string
+	cert  tls.Certificate
+	// when the certificate was last loaded, so that the stale one is not
+	// loaded on every handshake
+	loaded time.Time
+}
+
+// load the certificate from the keyring; the one with auto_tls is issued
+// again, if it's not fresh.
+func (sc *serverCert) load() (tls.Certificate, error) {
+	cert, err := loadCert(sc.ring)
+	if sc.auto && (err != nil || !fresh(cert, sc.hosts)) {
+		cert, err = issueCert(sc.ring, sc.hosts)
+	}
+	return cert, err
+}
+
+func (sc *serverCert) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	sc.Lock()
+	defer sc.Unlock()
+	if !fresh(sc.cert, sc.hosts) && time.Since(sc.loaded) > time.Minute {
+		sc.loaded = time.Now()
+		cert, err := sc.load()
+		if err != nil {
+			// the stale certificate is still better than none
+			log.Errorf("tls: %v\n", err)
+		} else {
+			sc.cert = cert
+		}
+	}
+	return &sc.cert, nil
+}
+
+// clientCAs are the CAs that the client certificates are verified by.
+func clientCAs(ring keyring.Keyring, ca string) (*x509.CertPool, error) {
+	var b []byte
+	if ca == "local" {
+		if _, _, err := localCA(ring); err != nil {
+			return nil, err
+		}
+		item, err := ring.Get(caCert)
+		if err != nil {
+			return nil, err
+		}
+		b = item.Data
+	} else {
+		var err error
+		if b, err = os.ReadFile(ca); err != nil {
+			return nil, err
+		}
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.New("no certificates")
+	}
+	return pool, nil
+}
+
+// certIdentity is whoever the client certificate, as verified by the
+// client_ca, says the client is: the common name is the subject, and the
+// organizational units are the groups.
+func certIdentity(c *fiber.Ctx) (identity, bool) {
+	state := c.Context().TLSConnectionState()
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return identity{}, false
+	}
+	leaf := state.VerifiedChains[0][0]
+	id := identity{
+		name:    leaf.Subject.CommonName,
+		subject: leaf.Subject.CommonName,
+		groups:  leaf.Subject.OrganizationalUnit,
+	}
+	if len(leaf.EmailAddresses) > 0 {
+		id.email = leaf.EmailAddresses[0]
+	}
+	return id, true
+}
+
+// clientTLS is the TLS config that the daemon is trusted with; the local
+// CA, if there is one in the keyring, is trusted on top of the system's,
+// and the client certificate is presented if there is one. The simp that
+// shares the keyring with the daemon that has the local client_ca would
+// issue its own.
+func clientTLS(d config.Daemon) *tls.Config {
+	if !strings.HasPrefix(d.BaseURL(), "https://") {
+		return nil
+	}
+	ring, err := daemonKeyring(cfg)
+	if err != nil {
+		return nil
+	}
+	var c *tls.Config
+	if item, err := ring.Get(caCert); err == nil {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if roots.AppendCertsFromPEM(item.Data) {
+			c = &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+		} else {
+			log.Warnf("daemon keyring: bad %s\n", caCert)
+		}
+	}
+	cert, err := loadClientCert(ring)
+	if errors.Is(err, keyring.ErrKeyNotFound) && d.ClientCA == "local" {
+		cert, err = issueLocalClient(ring)
+	}
+	switch {
+	case err == nil:
+		if c == nil {
+			c = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		c.Certificates = []tls.Certificate{cert}
+	case !errors.Is(err, keyring.ErrKeyNotFound):
+		log.Warnf("daemon keyring: %v\n", err)
+	}
+	return c
+}
+
+func loadClientCert(ring keyring.Keyring) (tls.Certificate, error) {
+	certPEM, err := ring.Get(clientCert)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := ring.Get(clientKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM.Data, keyPEM.Data)
+}
+
+// issueLocalClient issues the client certificate for whoever is running
+// simp on the host of the daemon.
+func issueLocalClient(ring keyring.Keyring) (tls.Certificate, error) {
+	name, _ := os.Hostname()
+	if u, err := user.Current(); err == nil {
+		name = u.Username + "@" + name
+	}
+	certPEM, keyPEM, err := issueClientCert(ring, name, nil)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := ring.Set(keyring.Item{Key: clientKey, Data: keyPEM}); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := ring.Set(keyring.Item{Key: clientCert, Data: certPEM}); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// issueClientCert issues the client certificate by the local CA; the
+// subject is the name, and the groups are its organizational units.
+func issueClientCert(ring keyring.Keyring, name string, groups []string) (certPEM, keyPEM []byte, err error) {
+	ca, caPriv, err := localCA(ring)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		Subject: pkix.Name{
+			Organization:       []string{"simp"},
+			OrganizationalUnit: groups,
+			CommonName:         name,
+		},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(certValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if strings.Contains(name, "@") {
+		tmpl.EmailAddresses = []string{name}
+	}
+	return sign(tmpl, ca, key, caPriv)
+}
+
+// clientCertCmd issues the client certificate for the name, and prints it
+// along with its key, and the CA, for the client to import:
+//
+//	simp -client-cert alice@laptop [group...] > alice.pem
+func clientCertCmd(name string, groups []string) error {
+	ring, err := daemonKeyring(cfg)
+	if err != nil {
+		return fmt.Errorf("daemon keyring: %w", err)
+	}
+	certPEM, keyPEM, err := issueClientCert(ring, name, groups)
+	if err != nil {
+		return err
+	}
+	ca, err := ring.Get(caCert)
+	if err != nil {
+		return err
+	}
+	for _, b := range [][]byte{certPEM, keyPEM, ca.Data} {
+		os.Stdout.Write(b)
+	}
+	return nil
+}
+
+// importBundle puts the client certificate, its key, and the CA as issued
+// by `simp -client-cert` into the keyring.
+func importBundle(ring keyring.Keyring, file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var certPEM, keyPEM, caPEM []byte
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		switch {
+		case block.Type == "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return err
+			}
+			if cert.IsCA {
+				caPEM = append(caPEM, pem.EncodeToMemory(block)...)
+			} else {
+				certPEM = pem.EncodeToMemory(block)
+			}
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			keyPEM = pem.EncodeToMemory(block)
+		}
+	}
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return err
+	}
+	items := []keyring.Item{{Key: clientCert, Data: certPEM}, {Key: clientKey, Data: keyPEM}}
+	if caPEM != nil {
+		items = append(items, keyring.Item{Key: caCert, Data: caPEM})
+	}
+	for _, item := range items {
+		if err := ring.Set(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadCert(ring keyring.Keyring) (tls.Certificate, error) {
+	certPEM, err := ring.Get(tlsCert)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := ring.Get(tlsKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert, err := tls.X509KeyPair(certPEM.Data, keyPEM.Data)
+	if err != nil {
+		return cert, fmt.Errorf("%s: %w", tlsCert, err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	return cert, err
+}
+
+// importCert puts the certificate, and its key from the files into the
+// keyring, so that they wouldn't have to be kept in plaintext.
+func importCert(ring keyring.Keyring, certFile, keyFile string) error {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return err
+	}
+	if err := ring.Set(keyring.Item{Key: tlsCert, Data: certPEM}); err != nil {
+		return err
+	}
+	return ring.Set(keyring.Item{Key: tlsKey, Data: keyPEM})
+}
+
+// fresh tells whether the certificate is good for a while, and for all of
+// the hosts.
+func fresh(cert tls.Certificate, hosts []string) bool {
+	leaf := cert.Leaf
+	if leaf == nil || time.Until(leaf.NotAfter) < certRenewal {
+		return false
+	}
+	for _, h := range hosts {
+		if leaf.VerifyHostname(h) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// certHosts are the names that the daemon may be reached by: the loopback,
+// the host, and whatever it listens on.
+func certHosts(listenAddr string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if name, err := os.Hostname(); err == nil {
+		hosts = append(hosts, name)
+	}
+	addr := listenAddr
+	if _, rest, ok := strings.Cut(addr, "://"); ok {
+		addr = rest
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if addr != "" && addr != "0.0.0.0" && addr != "::" && !slices.Contains(hosts, addr) {
+		hosts = append(hosts, addr)
+	}
+	return hosts
+}
+
+// localCA is the CA of the daemon, as generated the first time around.
+func localCA(ring keyring.Keyring) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certItem, err := ring.Get(caCert)
+	if err == nil {
+		keyItem, err := ring.Get(caKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		return parsePair(certItem.Data, keyItem.Data)
+	}
+	if !errors.Is(err, keyring.ErrKeyNotFound) {
+		return nil, nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	host, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		Subject:               pkix.Name{Organization: []string{"simp"}, CommonName: "simp local CA " + host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	certPEM, keyPEM, err := sign(tmpl, nil, key, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ring.Set(keyring.Item{Key: caKey, Data: keyPEM}); err != nil {
+		return nil, nil, err
+	}
+	if err := ring.Set(keyring.Item{Key: caCert, Data: certPEM}); err != nil {
+		return nil, nil, err
+	}
+	log.Infof("generated the local CA, to be trusted by the clients\n")
+	return parsePair(certPEM, keyPEM)
+}
+
+// issueCert issues the server certificate by the local CA.
+func issueCert(ring keyring.Keyring, hosts []string) (tls.Certificate, error) {
+	ca, caPriv, err := localCA(ring)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{Organization: []string{"simp"}, CommonName: hosts[0]},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(certValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	certPEM, keyPEM, err := sign(tmpl, ca, key, caPriv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := ring.Set(keyring.Item{Key: tlsKey, Data: keyPEM}); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := ring.Set(keyring.Item{Key: tlsCert, Data: certPEM}); err != nil {
+		return tls.Certificate{}, err
+	}
+	log.Infof("issued the certificate for %s\n", strings.Join(hosts, ", "))
+	return loadCert(ring)
+}
+
+// sign the certificate of the key by the parent; no parent is self-signed.
+func sign(tmpl, parent *x509.Certificate, key, by *ecdsa.PrivateKey) (certPEM, keyPEM []byte, err error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl.SerialNumber = serial
+	if parent == nil {
+		parent = tmpl
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, by)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+func parsePair(certPEM, keyPEM []byte) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	cb, _ := pem.Decode(certPEM)
+	kb, _ := pem.Decode(keyPEM)
+	if cb == nil || kb == nil {
+		return nil, nil, errors.New("bad pem")
+	}
+	cert, err := x509.ParseCertificate(cb.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParseECPrivateKey(kb.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
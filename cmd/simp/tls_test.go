@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/busthorne/keyring"
+	"github.com/busthorne/simp/auth"
+	"github.com/busthorne/simp/books"
+	"github.com/busthorne/simp/config"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestAutoTLS(t *testing.T) {
+	ring := keyring.NewArrayKeyring(nil)
+	hosts := certHosts("https://0.0.0.0:51015")
+	cert, err := issueCert(ring, hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fresh(cert, hosts) {
+		t.Error("the certificate is stale as soon as it's issued")
+	}
+	if fresh(cert, append(hosts, "elsewhere.lan")) {
+		t.Error("the certificate is good for the host it was not issued for")
+	}
+	ca, err := ring.Get(caCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the CA is generated once, and the certificates are issued by it since
+	if _, err := issueCert(ring, hosts); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := ring.Get(caCert); !bytes.Equal(ca.Data, again.Data) {
+		t.Error("the CA was generated again")
+	}
+
+	// the certificate that is about to expire is issued again as soon as
+	// the handshake finds it stale, but not on every handshake
+	sc := &serverCert{ring: ring, auto: true, hosts: hosts, cert: cert}
+	leaf := *cert.Leaf
+	leaf.NotAfter = time.Now().Add(time.Hour)
+	sc.cert.Leaf = &leaf
+	renewed, err := sc.get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fresh(*renewed, hosts) {
+		t.Error("the stale certificate was not renewed")
+	}
+	sc.cert.Leaf = &leaf
+	if again, _ := sc.get(nil); again.Leaf != &leaf {
+		t.Error("the certificate was loaded on every handshake")
+	}
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	s.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	s.StartTLS()
+	defer s.Close()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.Data)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+	resp, err := client.Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// the system roots alone would not do
+	if _, err := http.Get(s.URL); err == nil {
+		t.Error("the local CA is trusted without the keyring")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	defer func(c *config.Config) { cfg = c }(cfg)
+	cfg = &config.Config{
+		Daemon: &config.Daemon{
+			ListenAddr: "https://127.0.0.1:0",
+			AutoTLS:    true,
+			ClientCA:   "local",
+			Roles: []config.Role{
+				{Name: "laptops", Subjects: []string{"*@laptop"}, Models: []string{"4o"}},
+				{Name: "ml", Groups: []string{"ml"}},
+			},
+		},
+		Providers: []config.Provider{
+			{Driver: "openai", Name: "api", Models: []config.Model{
+				{Name: "gpt-4o", Alias: []string{"4o"}},
+				{Name: "o1"},
+			}},
+		},
+	}
+	cfg.ClearCache()
+
+	// the daemon keyring is kept in the books, by the master key from the
+	// in-memory backend
+	if err := books.Open(":memory:"); err != nil {
+		t.Fatal(err)
+	}
+	auth.ClearCache()
+	if err := auth.Mount("test", keyring.NewArrayKeyring(nil)); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Auth = []config.Auth{{Type: "keyring", Name: "test", Default: true}}
+	ring, err := daemonKeyring(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := serverTLS(*cfg.Daemon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := fiber.New(fiber.Config{
+		DisableStartupMessage: true,
+		ErrorHandler: func(c *fiber.Ctx, err error) error {
+			return c.SendString(err.Error())
+		},
+	})
+	f.Use(authorize)
+	f.Get("/v1/use/:model", func(c *fiber.Ctx) error {
+		if err := permit(c, c.Params("model")); err != nil {
+			return err
+		}
+		return c.SendString(who(c))
+	})
+	go f.Listener(ln)
+	defer f.Shutdown()
+
+	ca, _ := ring.Get(caCert)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.Data)
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	get := func(model string, cert *tls.Certificate) (int, string, error) {
+		c := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			c.Certificates = []tls.Certificate{*cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: c}}
+		resp, err := client.Get("https://localhost:" + port + "/v1/use/" + model)
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b), nil
+	}
+	issue := func(name string, groups ...string) *tls.Certificate {
+		certPEM, keyPEM, err := issueClientCert(ring, name, groups)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &cert
+	}
+
+	if _, _, err := get("4o", nil); err == nil {
+		t.Error("no certificate, and yet connected")
+	}
+	alice, bob, eve := issue("alice@laptop"), issue("bob@desk", "ml"), issue("eve@desk")
+	cases := []struct {
+		model string
+		cert  *tls.Certificate
+		code  int
+	}{
+		{"4o", alice, fiber.StatusOK},
+		{"o1", alice, fiber.StatusForbidden},
+		{"o1", bob, fiber.StatusOK},
+		{"4o", eve, fiber.StatusForbidden},
+	}
+	for _, c := range cases {
+		code, body, err := get(c.model, c.cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != c.code {
+			t.Errorf("%s %s: %d %s", c.cert.Leaf.Subject.CommonName, c.model, code, body)
+		}
+	}
+	if _, body, _ := get("4o", alice); body != "alice@laptop" {
+		t.Errorf("who: %s", body)
+	}
+
+	// the client imports what simp -client-cert had printed
+	certPEM, keyPEM, err := issueClientCert(ring, "carol@laptop", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := filepath.Join(t.TempDir(), "carol.pem")
+	if err := os.WriteFile(bundle, bytes.Join([][]byte{certPEM, keyPEM, ca.Data}, nil), 0600); err != nil {
+		t.Fatal(err)
+	}
+	laptop := keyring.NewArrayKeyring(nil)
+	if err := importBundle(laptop, bundle); err != nil {
+		t.Fatal(err)
+	}
+	carol, err := loadClientCert(laptop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported, _ := laptop.Get(caCert); !bytes.Equal(imported.Data, ca.Data) {
+		t.Error("the CA was not imported")
+	}
+	if code, body, err := get("4o", &carol); err != nil || code != fiber.StatusOK {
+		t.Errorf("carol: %d %s %v", code, body, err)
+	}
+}
@@ -4,17 +4,20 @@ import (
 	"fmt"
 
 	"github.com/busthorne/simp"
+	"github.com/busthorne/simp/books"
 	"github.com/busthorne/simp/config"
 	"github.com/busthorne/simp/driver"
 )
 
 // findWaldo will check if the daemon is configured, and will simply create a daemon driver;
 // if unsuccessful, it will search the configured models, cached models from provider lists,
-// and will try to refresh the outdated lists!
+// and will try to refresh the outdated lists! The models claimed by more than one provider
+// are balanced between them, and the models with fallbacks are driven by the fallback chain;
+// every claim is gated by its own limits.
 func findWaldo(alias string) (simp.Driver, config.Model, error) {
 	m := config.Model{Name: alias}
 	if d := cfg.Daemon; !*daemon && d != nil {
-		drv, err := driver.NewDaemon(*d)
+		drv, err := daemonDriver(*d)
 		if err != nil {
 			return nil, m, fmt.Errorf("daemon driver: %w", err)
 		}
@@ -29,7 +32,8 @@ func findWaldo(alias string) (simp.Driver, config.Model, error) {
 		if err != nil {
 			return nil, m, fmt.Errorf("provider %s: %w", p.Name, err)
 		}
-		return d, m, nil
+		d = gate{d, config.Claim{Model: m, Provider: p}}
+		return fallbackFor(balancerFor(alias, d, m, p), m), m, nil
 	}
 	// TODO: search cache for model list
 	return nil, m, simp.ErrNotFound
@@ -40,12 +44,45 @@ func findBaldo(alias string) (simp.BatchDriver, config.Model, error) {
 	if err != nil {
 		return nil, m, err
 	}
+	// the batches are never fallen back on, nor balanced, as they're routed
+	if f, ok := d.(*fallback); ok {
+		d = f.chain[0].Driver
+	}
+	if b, ok := d.(*balancer); ok {
+		d = b.members[0].Driver
+	}
+	if g, ok := d.(gate); ok {
+		d = g.Driver
+	}
 	if bd, ok := d.(simp.BatchDriver); ok {
 		return bd, m, nil
 	}
 	return nil, m, simp.ErrNotFound
 }
 
+// findBaldoFor finds the batch driver of the provider that the sub-batch has
+// been routed to; the sub-batches that predate routing go by model alone.
+func findBaldoFor(sub books.Batch) (simp.BatchDriver, config.Claim, error) {
+	c := config.Claim{Model: config.Model{Name: sub.Model}}
+	var ok bool
+	if sub.Provider != nil {
+		c.Model, c.Provider, ok = cfg.LookupClaim(sub.Model, *sub.Provider)
+	} else {
+		c.Model, c.Provider, ok = cfg.LookupModel(sub.Model)
+	}
+	if !ok {
+		return nil, c, simp.ErrNotFound
+	}
+	d, err := drive(c.Provider)
+	if err != nil {
+		return nil, c, fmt.Errorf("provider %s: %w", c.Provider.Name, err)
+	}
+	if bd, ok := d.(simp.BatchDriver); ok {
+		return bd, c, nil
+	}
+	return nil, c, simp.ErrNotFound
+}
+
 func drive(p config.Provider) (d simp.Driver, err error) {
 	if p.APIKey == "" {
 		ring, err := keyringFor(p, cfg)
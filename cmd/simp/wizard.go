@@ -68,10 +68,7 @@ func wizard() {
 		for {
 			listenAddr = w.prompt("Listen address", defaultAddr)
 			switch spl := strings.Split(listenAddr, "://"); spl[0] {
-			case "http":
-			case "https":
-				stderr("HTTPS is not supported yet.")
-				w.abort()
+			case "http", "https":
 			default:
 				stderr("Invalid listen address")
 				continue
@@ -81,6 +78,9 @@ func wizard() {
 		w.Daemon = &config.Daemon{
 			ListenAddr: listenAddr,
 		}
+		if strings.HasPrefix(listenAddr, "https://") {
+			w.Daemon.AutoTLS = w.confirm("Would you like the daemon to issue its own certificate from a local CA?")
+		}
 	} else if w.confirm("Would you like to use the existing daemon on your network?") {
 		w.Daemon = &config.Daemon{
 			DaemonAddr: w.prompt("Daemon address", ""),
@@ -88,6 +88,7 @@ func wizard() {
 	}
 	// then, ask them how they want their keys
 	w.configureKeyring()
+	w.configureTLS()
 	// setup providers
 	fmt.Println()
 	fmt.Println("Now, let's configure inference providers; use appropriate drivers for compatible apis.")
@@ -223,6 +224,58 @@ func (w *wizardState) configureKeyring() {
 	fmt.Println("Keyring configured.")
 }
 
+// configureTLS puts the certificate of the daemon in the keyring, unless
+// the daemon is to issue its own.
+func (w *wizardState) configureTLS() {
+	d := w.Daemon
+	if d != nil && strings.HasPrefix(d.DaemonAddr, "https://") {
+		w.configureClientCert()
+		return
+	}
+	if d == nil || !strings.HasPrefix(d.ListenAddr, "https://") {
+		return
+	}
+	ring, err := daemonKeyring(&w.Config)
+	if err != nil {
+		stderr("HTTPS requires a keyring for the certificate:", err)
+		w.abort()
+	}
+	if d.AutoTLS {
+		return
+	}
+	for {
+		certFile := expandPath(w.prompt("Certificate file (PEM)", ""))
+		keyFile := expandPath(w.prompt("Private key file (PEM)", ""))
+		if err := importCert(ring, certFile, keyFile); err != nil {
+			stderr("Failed to import the certificate:", err)
+			continue
+		}
+		break
+	}
+	fmt.Println("Certificate is in the keyring; the files may be removed.")
+}
+
+// configureClientCert puts the client certificate, as issued by the daemon
+// with `simp -client-cert`, in the keyring.
+func (w *wizardState) configureClientCert() {
+	ring, err := daemonKeyring(&w.Config)
+	if err != nil {
+		return
+	}
+	for {
+		file := w.prompt("Client certificate from simp -client-cert [leave blank to skip]", "")
+		if file == "" {
+			return
+		}
+		if err := importBundle(ring, expandPath(file)); err != nil {
+			stderr("Failed to import the certificate:", err)
+			continue
+		}
+		fmt.Println("Certificate is in the keyring; the file may be removed.")
+		return
+	}
+}
+
 func (w *wizardState) configureOpenAI() (p config.Provider) {
 	const openaiBaseURL = "https://api.openai.com/v1"
 	p.Driver = "openai"
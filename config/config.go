@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"net/netip"
 	"regexp"
 	"slices"
 	"strings"
@@ -20,15 +21,17 @@ type Config struct {
 	Diagnostics map[string]hcl.Diagnostics
 }
 
-type lookupOk struct {
+// Claim is the model as served by one particular provider; the same model
+// may be claimed by several providers.
+type Claim struct {
 	Model    Model
 	Provider Provider
 }
 
-var lookupCache = make(map[string]lookupOk)
+var lookupCache = make(map[string]Claim)
 
 func (c *Config) ClearCache() {
-	lookupCache = make(map[string]lookupOk)
+	lookupCache = make(map[string]Claim)
 }
 
 func (c *Config) LookupModel(alias string) (m Model, p Provider, ok bool) {
@@ -46,7 +49,7 @@ func (c *Config) LookupModel(alias string) (m Model, p Provider, ok bool) {
 				if m.Latest {
 					m.Name += "-latest"
 				}
-				lookupCache[alias] = lookupOk{Model: m, Provider: p}
+				lookupCache[alias] = Claim{Model: m, Provider: p}
 				return m, p, true
 			}
 		}
@@ -54,6 +57,36 @@ func (c *Config) LookupModel(alias string) (m Model, p Provider, ok bool) {
 	return
 }
 
+// LookupClaims returns the claims of all providers on the model, in the order
+// of configuration; LookupModel is the first claim.
+func (c *Config) LookupClaims(alias string) (claims []Claim) {
+	if suffix := "-latest"; strings.HasSuffix(alias, suffix) {
+		alias = strings.TrimSuffix(alias, suffix)
+	}
+	for _, p := range c.Providers {
+		for _, m := range p.Models {
+			if m.Name == alias || slices.Contains(m.Alias, alias) {
+				if m.Latest {
+					m.Name += "-latest"
+				}
+				claims = append(claims, Claim{Model: m, Provider: p})
+				break
+			}
+		}
+	}
+	return
+}
+
+// LookupClaim is the claim of the particular provider on the model.
+func (c *Config) LookupClaim(alias, provider string) (m Model, p Provider, ok bool) {
+	for _, claim := range c.LookupClaims(alias) {
+		if claim.Provider.ID() == provider {
+			return claim.Model, claim.Provider, true
+		}
+	}
+	return
+}
+
 type Default struct {
 	ModelDefault
 	Model string `hcl:"model"`
@@ -72,12 +105,44 @@ type ModelDefault struct {
 // Daemon is the simpd portion of the config, the key and cert files
 // are picked up from the keyring, and never in plaintext
 // as that would be bad taste.
+//
+// AutoTLS has the daemon issue its own certificate from the local CA,
+// that the clients sharing the keyring would trust.
 type Daemon struct {
 	DaemonAddr string   `hcl:"daemon_addr,optional"`
 	ListenAddr string   `hcl:"listen_addr,optional"`
 	AutoTLS    bool     `hcl:"auto_tls,optional"`
 	Keyring    string   `hcl:"keyring,optional"`
 	AllowedIPs []string `hcl:"allowed_ips,optional"`
+	// RequireKeys makes the daemon turn away the clients without a key, as
+	// issued by `simp -keys create`; APIKey is the key that the client would
+	// present to the daemon at daemon_addr, as put in the keyring by
+	// `simp -keys use`, and never in the config.
+	RequireKeys bool `hcl:"require_keys,optional"`
+	APIKey      string
+	// TrustedProxies are the addresses that X-Forwarded-For is taken from;
+	// the client is whoever the proxies say it is.
+	TrustedProxies []string `hcl:"trusted_proxies,optional"`
+	// QueueTimeout is how long the requests over the rate limits are queued
+	// for, before they are turned away with 429.
+	QueueTimeout string `hcl:"queue_timeout,optional"`
+	// ClientCA is the PEM file of the CA that the clients would have to
+	// present a certificate from, or "local" for the daemon's own; the
+	// roles map their subjects to the models.
+	ClientCA string `hcl:"client_ca,optional"`
+	Roles    []Role `hcl:"role,block"`
+}
+
+// ParsePrefix parses the CIDR, or the lone address as the prefix of itself.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if p, err := netip.ParsePrefix(s); err == nil {
+		return p.Masked(), nil
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%q is neither an address, nor CIDR", s)
+	}
+	return netip.PrefixFrom(a, a.BitLen()), nil
 }
 
 func (d Daemon) BaseURL() string {
@@ -115,14 +180,30 @@ type HistoryPath struct {
 // Auth doubles as secrets manager and auth manager.
 //
 // For example, `keyring` will use some kind of secrets manager to store
-// the API keys, and `cloudflare` will provide SSO and RBAC for
+// the API keys, and `jwt`, or `cloudflare` will provide SSO and RBAC for
 // simpd.
 type Auth struct {
 	Type    string `hcl:"type,label"`
 	Name    string `hcl:"name,label"`
-	Backend string `hcl:"backend"`
+	Backend string `hcl:"backend,optional"`
 	Default bool   `hcl:"default,optional"`
 
+	// JWKS is the URL, or the file of the keys that the tokens are signed
+	// with; Audience is checked, so that the tokens issued to other apps
+	// would not pass, and so is Issuer, if set.
+	JWKS     string `hcl:"jwks,optional"`
+	Issuer   string `hcl:"issuer,optional"`
+	Audience string `hcl:"audience,optional"`
+	// Team is the Cloudflare Access team, that the JWKS and Issuer are
+	// derived from.
+	Team string `hcl:"team,optional"`
+	// GroupsClaim is the claim that the groups are taken from, "groups"
+	// by default.
+	GroupsClaim string `hcl:"groups_claim,optional"`
+	// Roles map the claims to the models; if there are none, whoever has
+	// a valid token may use any model.
+	Roles []Role `hcl:"role,block"`
+
 	// MacOSKeychainNameKeychainName is the name of the macOS keychain that is used
 	KeychainName string `hcl:"keychain_name,optional"`
 	// KeychainSynchronizable is whether the item can be synchronized to iCloud
@@ -141,6 +222,21 @@ type Auth struct {
 	PassCmd string `hcl:"pass_cmd,optional"`
 }
 
+// Role is what the identities, as matched by email, group, or subject of
+// the client certificate, may do.
+//
+// The emails, and the subjects may be globs, such as "*@example.com".
+type Role struct {
+	Name     string   `hcl:"name,label"`
+	Emails   []string `hcl:"emails,optional"`
+	Groups   []string `hcl:"groups,optional"`
+	Subjects []string `hcl:"subjects,optional"`
+	// Models are the models, aliases, or tags; empty means any.
+	Models []string `hcl:"models,optional"`
+	RPM    int      `hcl:"rpm,optional"`
+	TPM    int      `hcl:"tpm,optional"`
+}
+
 // Provider is a provider of LLM services, such as OpenAI, Anthropic, etc.
 //
 // OpenAI-compatible providers are supported out of the box, because they
@@ -156,6 +252,28 @@ type Provider struct {
 	AllowedIPs []string `hcl:"allowed_ips,optional"`
 	Batch      bool     `hcl:"batch,optional"`
 
+	// BatchRequests, BatchBytes, and BatchTokens override the limits
+	// on a single batch that the driver would otherwise impose.
+	BatchRequests int   `hcl:"batch_requests,optional"`
+	BatchBytes    int64 `hcl:"batch_bytes,optional"`
+	BatchTokens   int64 `hcl:"batch_tokens,optional"`
+	// InlineInputs, and InlineTokens bound the embedding calls that the
+	// implicit batch ops are inlined into; one input means no inlining.
+	InlineInputs int   `hcl:"inline_inputs,optional"`
+	InlineTokens int64 `hcl:"inline_tokens,optional"`
+
+	// RPM, TPM, and Concurrency limit the requests to the provider, both
+	// from the daemon and the implicit batch ops; zero means unlimited.
+	RPM         int `hcl:"rpm,optional"`
+	TPM         int `hcl:"tpm,optional"`
+	Concurrency int `hcl:"concurrency,optional"`
+	// Retries is how many times the transient errors, i.e. rate limits,
+	// server errors, and timeouts, are retried; negative means never.
+	// RetryMin, and RetryMax are the bounds of the exponential backoff.
+	Retries  int    `hcl:"retries,optional"`
+	RetryMin string `hcl:"retry_min,optional"`
+	RetryMax string `hcl:"retry_max,optional"`
+
 	// Vertex AI
 	Project string `hcl:"project,optional"`
 	Region  string `hcl:"region,optional"`
@@ -163,6 +281,11 @@ type Provider struct {
 	Bucket  string `hcl:"bucket,optional"`
 }
 
+// ID is the identity of the provider, as the names are only unique per driver.
+func (p Provider) ID() string {
+	return p.Driver + ":" + p.Name
+}
+
 // Model is a set of overrides passed to driver so that it can better
 // integrate with a specific provider, use controls that would be
 // desirable.
@@ -184,10 +307,40 @@ type Model struct {
 	Batch         bool     `hcl:"batch,optional"`
 	// Region is relevant for providers with inconsistent availability.
 	Region string `hcl:"region,optional"`
+	// RPM, TPM, and Concurrency limit the requests to the model on top of
+	// the provider limits, both from the daemon and the implicit batch ops;
+	// zero means unlimited.
+	RPM         int `hcl:"rpm,optional"`
+	TPM         int `hcl:"tpm,optional"`
+	Concurrency int `hcl:"concurrency,optional"`
+	// Prices are per million tokens, in whatever currency so long as it's
+	// the same one throughout; the batch prices are used to route batches
+	// to the cheapest provider that claims the model.
+	InputPrice       float64 `hcl:"input_price,optional"`
+	OutputPrice      float64 `hcl:"output_price,optional"`
+	BatchInputPrice  float64 `hcl:"batch_input_price,optional"`
+	BatchOutputPrice float64 `hcl:"batch_output_price,optional"`
+	// Weight is the share of the requests to the model that this provider
+	// would get, if the model is claimed by more than one; zero means one,
+	// and the negative means none but the batches.
+	Weight int `hcl:"weight,optional"`
+	// Fallback are the models, by name or alias, that are tried in order
+	// if this one fails transiently, runs out of context, or is filtered;
+	// their own fallbacks are not followed.
+	Fallback []string `hcl:"fallback,optional"`
 
 	ModelDefault
 }
 
+// BatchPrice is the price of a million input tokens in a batch; the regular
+// price is assumed if the batch price is not set. Zero means unknown.
+func (m Model) BatchPrice() float64 {
+	if m.BatchInputPrice > 0 {
+		return m.BatchInputPrice
+	}
+	return m.InputPrice
+}
+
 func (m Model) ShortestAlias() (alias string) {
 	alias = m.Name
 	for _, a := range m.Alias {
@@ -79,3 +79,91 @@ func TestParsePath(t *testing.T) {
 		t.Errorf("-want +got\n%s", diff)
 	}
 }
+
+func TestLookupClaims(t *testing.T) {
+	c := Config{
+		Providers: []Provider{
+			{Driver: "anthropic", Name: "api", Models: []Model{
+				{Name: "claude-3-5-haiku-20241022", Alias: []string{"haiku"}},
+			}},
+			{Driver: "vertex", Name: "gcp", Project: "p", Region: "r", Models: []Model{
+				{Name: "claude-3-5-haiku@20241022", Alias: []string{"haiku"}},
+			}},
+		},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, claim := range c.LookupClaims("haiku") {
+		ids = append(ids, claim.Provider.ID()+"/"+claim.Model.Name)
+	}
+	want := []string{
+		"anthropic:api/claude-3-5-haiku-20241022",
+		"vertex:gcp/claude-3-5-haiku@20241022",
+	}
+	if diff := cmp.Diff(want, ids); diff != "" {
+		t.Error(diff)
+	}
+	m, _, ok := c.LookupClaim("haiku", "vertex:gcp")
+	if !ok || m.Name != "claude-3-5-haiku@20241022" {
+		t.Errorf("unexpected vertex claim: %+v", m)
+	}
+
+	// the names are still unique within the provider
+	p := &c.Providers[0]
+	p.Models = append(p.Models, Model{Name: "claude-3-5-sonnet", Alias: []string{"haiku"}})
+	if err := c.Validate(); err == nil {
+		t.Error("duplicate alias within the provider is valid")
+	}
+}
+
+func TestFallbackValidate(t *testing.T) {
+	c := Config{
+		Providers: []Provider{
+			{Driver: "anthropic", Name: "api", Models: []Model{
+				{Name: "claude-3-5-sonnet-latest", Alias: []string{"cs35"}, Fallback: []string{"flash"}},
+			}},
+			{Driver: "gemini", Name: "api", Models: []Model{
+				{Name: "gemini-2.0-flash", Alias: []string{"flash"}},
+			}},
+		},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	m := &c.Providers[0].Models[0]
+	for _, fallback := range [][]string{{"pro"}, {"cs35"}} {
+		m.Fallback = fallback
+		if err := c.Validate(); err == nil {
+			t.Errorf("fallback %v is valid", fallback)
+		}
+	}
+}
+
+func TestAuthValidate(t *testing.T) {
+	c := Config{
+		Auth: []Auth{
+			{Type: "jwt", Name: "corp", JWKS: "jwks.json", Audience: "simp", Roles: []Role{
+				{Name: "staff", Emails: []string{"*@example.com"}},
+			}},
+			{Type: "cloudflare", Name: "access", Team: "acme", Audience: "tag"},
+		},
+	}
+	// neither of them is a keyring, so there's no default to speak of
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range []Auth{
+		{Type: "jwt", Name: "corp"},
+		{Type: "jwt", Name: "corp", JWKS: "jwks.json"},
+		{Type: "cloudflare", Name: "access", Team: "acme"},
+		{Type: "jwt", Name: "corp", JWKS: "jwks.json", Audience: "simp", Roles: []Role{
+			{Name: "staff", Emails: []string{"[@example.com"}},
+		}},
+	} {
+		if err := a.Validate(); err == nil {
+			t.Errorf("%+v is valid", a)
+		}
+	}
+}
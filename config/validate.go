@@ -3,8 +3,11 @@ package config
 import (
 	"errors"
 	"fmt"
+	"path"
 	"regexp"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/busthorne/keyring"
 )
@@ -28,7 +31,6 @@ func (c *Config) Validate() error {
 	type duplicates map[string]count
 	auths := duplicates{}
 	providers := duplicates{}
-	models := duplicates{}
 	defaults := map[string]int{}
 	for i, a := range c.Auth {
 		if a.Name == "default" {
@@ -41,6 +43,9 @@ func (c *Config) Validate() error {
 			collect(ø("duplicate auth name %q", a.Name))
 		}
 		auths[a.Name] = count{}
+		if !a.Keyring() {
+			continue
+		}
 		if n, ok := defaults[a.Type]; ok {
 			defaults[a.Type] = n + 1
 		} else {
@@ -62,11 +67,14 @@ func (c *Config) Validate() error {
 	for _, p := range c.Providers {
 		collect(p.Validate(), ƒ("provider %q %q", p.Driver, p.Name))
 
-		id := p.Driver + ":" + p.Name
+		id := p.ID()
 		if _, ok := providers[id]; ok {
 			collect(ø("duplicate provider %q %q", p.Driver, p.Name))
 		}
 		providers[id] = count{}
+		// the same model may be claimed by more than one provider, but
+		// the names and aliases are unique within the provider
+		models := duplicates{}
 		for _, m := range p.Models {
 			if _, ok := models[m.Name]; ok {
 				collect(ø("model %s is already in use as name or alias", m.Name))
@@ -80,6 +88,27 @@ func (c *Config) Validate() error {
 			}
 		}
 	}
+	known := duplicates{}
+	for _, p := range c.Providers {
+		for _, m := range p.Models {
+			known[m.Name] = count{}
+			for _, a := range m.Alias {
+				known[a] = count{}
+			}
+		}
+	}
+	for _, p := range c.Providers {
+		for _, m := range p.Models {
+			for _, f := range m.Fallback {
+				if _, ok := known[strings.TrimSuffix(f, "-latest")]; !ok {
+					collect(ø("model %s: fallback %s is not configured", m.Name, f))
+				}
+				if f == m.Name || slices.Contains(m.Alias, f) {
+					collect(ø("model %s: falls back to itself", m.Name))
+				}
+			}
+		}
+	}
 	err.Title = ƒ("%d errors, 0 warnings", err.Count())
 	return err.Invalid()
 }
@@ -88,13 +117,53 @@ func (a *Auth) Validate() error {
 	if nonAlphanumeric.MatchString(a.Name) {
 		return ø("%s: %w", a.Name, errNonAlphanumeric)
 	}
-	backends := keyring.AvailableBackends()
-	for _, b := range backends {
-		if b == keyring.BackendType(a.Backend) {
-			return nil
+	switch a.Type {
+	case "jwt":
+		if a.JWKS == "" {
+			return ø("jwks is required for jwt auth")
+		}
+		// the tokens of the same SSO are issued to other apps, too
+		if a.Audience == "" {
+			return ø("audience is required for jwt auth")
+		}
+	case "cloudflare":
+		if a.Team == "" {
+			return ø("team is required for cloudflare auth")
+		}
+		if a.Audience == "" {
+			return ø("audience is required for cloudflare auth")
+		}
+	default:
+		backends := keyring.AvailableBackends()
+		for _, b := range backends {
+			if b == keyring.BackendType(a.Backend) {
+				return nil
+			}
 		}
+		return ø("available backends: %v", backends)
 	}
-	return ø("available backends: %v", backends)
+	return validRoles(a.Roles)
+}
+
+func validRoles(roles []Role) error {
+	for _, r := range roles {
+		for _, e := range r.Emails {
+			if _, err := path.Match(e, ""); err != nil {
+				return ø("role %q: bad email %q", r.Name, e)
+			}
+		}
+		for _, s := range r.Subjects {
+			if _, err := path.Match(s, ""); err != nil {
+				return ø("role %q: bad subject %q", r.Name, s)
+			}
+		}
+	}
+	return nil
+}
+
+// Keyring tells whether the auth is a secrets manager, rather than SSO.
+func (a Auth) Keyring() bool {
+	return a.Type != "jwt" && a.Type != "cloudflare"
 }
 
 func (p *Provider) Validate() error {
@@ -114,6 +183,19 @@ func (p *Provider) Validate() error {
 			collect(ø("biquery dataset is required for vertex batching"))
 		}
 	}
+	if err := validCIDRs(p.AllowedIPs); err != nil {
+		collect(ø("allowed_ips: %w", err))
+	}
+	if p.RetryMin != "" {
+		if _, err := time.ParseDuration(p.RetryMin); err != nil {
+			collect(ø("retry_min: %w", err))
+		}
+	}
+	if p.RetryMax != "" {
+		if _, err := time.ParseDuration(p.RetryMax); err != nil {
+			collect(ø("retry_max: %w", err))
+		}
+	}
 	for _, m := range p.Models {
 		collect(m.Validate(), ƒ("model %q %q", p.Name, m.Name))
 	}
@@ -122,7 +204,19 @@ func (p *Provider) Validate() error {
 }
 
 func (m *Model) Validate() error {
-	// TODO: validate
+	if err := validCIDRs(m.AllowedIPs); err != nil {
+		return ø("allowed_ips: %w", err)
+	}
+	return nil
+}
+
+// validCIDRs checks that the list is made of either prefixes, or addresses.
+func validCIDRs(cidrs []string) error {
+	for _, s := range cidrs {
+		if _, err := ParsePrefix(s); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -135,7 +229,24 @@ func (d *Daemon) Validate() error {
 	case d.DaemonAddr == "" && d.ListenAddr == "":
 		return errors.New("neither daemon_addr nor listen_addr is set")
 	}
-	return nil
+	if err := validCIDRs(d.AllowedIPs); err != nil {
+		return ø("allowed_ips: %w", err)
+	}
+	if err := validCIDRs(d.TrustedProxies); err != nil {
+		return ø("trusted_proxies: %w", err)
+	}
+	if d.QueueTimeout != "" {
+		if _, err := time.ParseDuration(d.QueueTimeout); err != nil {
+			return ø("queue_timeout: %w", err)
+		}
+	}
+	if d.ClientCA != "" && d.ListenAddr != "" && !strings.HasPrefix(d.ListenAddr, "https://") {
+		return errors.New("client_ca requires https listen_addr")
+	}
+	if d.ClientCA == "local" && d.ListenAddr != "" && !d.AutoTLS {
+		return errors.New("client_ca \"local\" requires auto_tls")
+	}
+	return validRoles(d.Roles)
 }
 
 // globToRegex converts a glob pattern to a regular expression
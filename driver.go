@@ -35,7 +35,8 @@ type Driver interface {
 
 	// Embed computes the vector embedding of a single, or multiple texts.
 	// The daemon is not aware of the provider's limits, so it will submit
-	// all requests as-is.
+	// all requests as-is; the implicit batch ops are only ever inlined up to
+	// the `inline_inputs` and `inline_tokens` set on the provider.
 	//
 	// If this operation is not supported, it will return `ErrNotImplemented`.
 	//
@@ -110,9 +111,21 @@ type BatchDriver interface {
 	//
 	// If the provider doesn't use uploads, like Anthropic, it should return
 	// ErrBatchDeferred to indicate that the batch must be deferred until
-	// send time. In that case, the backend will commit the batch to the
-	// database temporarily.
-	BatchUpload(context.Context, *openai.Batch, []openai.BatchInput) error
+	// send time. In that case, the backend will hand the inputs back
+	// from the database; see KeyBatchInputs.
+	//
+	// The inputs are streamed from disk; they may be iterated more than once,
+	// but every pass would read them anew, so the drivers had better not.
+	BatchUpload(context.Context, *openai.Batch, BatchInputs) error
+
+	// BatchCheck validates the inputs as BatchUpload would, but without
+	// side effects: nothing is to be uploaded, created, or written.
+	//
+	// The context contains model configuration: see KeyModel.
+	//
+	// It returns ErrNotImplemented, or ErrBatchDeferred, in the same cases
+	// as BatchUpload would; otherwise nil, if the inputs would be batched.
+	BatchCheck(context.Context, BatchInputs) error
 
 	// BatchSend submits the underlying batch for execution with the provider.
 	//
@@ -123,6 +136,10 @@ type BatchDriver interface {
 	// should be provided as third argument to `BatchSend`, however given
 	// that the majority of batching drivers will use uploads, the current
 	// design looks just fine.
+	//
+	// As soon as the provider has taken the job, and before anything else
+	// could go wrong, the driver should call Sent, so that the job would be
+	// on record even if the daemon died before BatchSend has returned.
 	BatchSend(context.Context, *openai.Batch) error
 
 	// BatchRefresh will inquire the most recent batch status from the provider.
@@ -139,6 +156,12 @@ type BatchDriver interface {
 	// It's recommended that `Usage` is set to reflect token spending.
 	BatchReceive(context.Context, *openai.Batch) ([]openai.BatchOutput, error)
 
+	// BatchLimits are the provider's constraints on a single batch.
+	//
+	// The daemon will split the inputs into as many sub-batches as necessary
+	// to stay within the limits; the provider config may override them.
+	BatchLimits() BatchLimits
+
 	// BatchCancel will cancel the batch, if it's possible.
 	//
 	// The backend will not call this if the batch is already in terminal
@@ -152,5 +175,28 @@ type Key string
 
 const (
 	KeyModel       Key = "config.Model"
-	KeyBatchInputs Key = "[]config.BatchInput"
+	KeyBatchInputs Key = "simp.BatchInputs"
+	KeySent        Key = "simp.Sent"
+)
+
+// Sent hands the batch to the backend the moment the provider has taken
+// the job, so that it would be kept straight away; see KeySent.
+func Sent(ctx context.Context, batch *openai.Batch) {
+	if keep, ok := ctx.Value(KeySent).(func(openai.Batch)); ok {
+		keep(*batch)
+	}
+}
+
+// MetaPrefix is the namespace for batch metadata keys internal to simp,
+// so that they would never collide with, or leak into, client metadata.
+const MetaPrefix = "simp:"
+
+// Batch metadata keys that the drivers and the daemon keep for themselves.
+const (
+	MetaRealID   = MetaPrefix + "real_id"
+	MetaJob      = MetaPrefix + "job"
+	MetaState    = MetaPrefix + "state"
+	MetaResults  = MetaPrefix + "results"
+	MetaTable    = MetaPrefix + "table"
+	MetaDeferred = MetaPrefix + "deferred"
 )
@@ -3,8 +3,11 @@ package driver
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"strings"
 
 	"github.com/anthropics/anthropic-sdk-go"
 	"github.com/anthropics/anthropic-sdk-go/option"
@@ -17,9 +20,11 @@ const anthropicBeta = "message-batches-2024-09-24"
 
 // NewAnthropic creates a new Anthropic client.
 func NewAnthropic(p config.Provider) (*Anthropic, error) {
+	// the retries are up to the daemon, so that they'd be paced, and counted
 	cli := anthropic.NewClient(
 		option.WithAPIKey(p.APIKey),
 		option.WithHeader("anthropic-beta", anthropicBeta),
+		option.WithMaxRetries(0),
 	)
 	return &Anthropic{Client: *cli, p: p}, nil
 }
@@ -139,7 +144,7 @@ func (a *Anthropic) Chat(ctx context.Context, req openai.ChatCompletionRequest)
 	if !req.Stream {
 		resp, err := a.Beta.Messages.New(ctx, params)
 		if err != nil {
-			return c, err
+			return c, a.retriable(err)
 		}
 		c.Usage = openai.Usage{
 			PromptTokens:     int(resp.Usage.InputTokens),
@@ -195,7 +200,7 @@ func (a *Anthropic) Chat(ctx context.Context, req openai.ChatCompletionRequest)
 				Choices: []openai.ChatCompletionStreamChoice{{
 					FinishReason: "error",
 				}},
-				Error: err,
+				Error: a.retriable(err),
 			}
 			return
 		} else {
@@ -211,17 +216,70 @@ func (a *Anthropic) Chat(ctx context.Context, req openai.ChatCompletionRequest)
 	return
 }
 
-func (a *Anthropic) BatchUpload(ctx context.Context, b *openai.Batch, inputs []openai.BatchInput) error {
+// retriable classifies the error by the status code of the response; the
+// prompt that is too long is the invalid request, told apart by message.
+func (a *Anthropic) retriable(err error) error {
+	var apiErr *anthropic.Error
+	if !errors.As(err, &apiErr) {
+		return retriable(err, 0, 0)
+	}
+	var body struct {
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal([]byte(apiErr.JSON.RawJSON()), &body) == nil &&
+		body.Error.Type == "invalid_request_error" &&
+		strings.HasPrefix(body.Error.Message, "prompt is too long") {
+		return refusal{simp.ErrContextLength, err}
+	}
+	var h http.Header
+	if apiErr.Response != nil {
+		h = apiErr.Response.Header
+	}
+	return retriable(err, apiErr.StatusCode, retryAfter(h))
+}
+
+func (a *Anthropic) BatchUpload(ctx context.Context, b *openai.Batch, inputs simp.BatchInputs) error {
 	return simp.ErrBatchDeferred
 }
 
+// BatchCheck translates the inputs as BatchSend would, since there's
+// nothing to upload; the batch is deferred all the same.
+func (a *Anthropic) BatchCheck(ctx context.Context, inputs simp.BatchInputs) error {
+	i := 0
+	for input, err := range inputs {
+		if err != nil {
+			return fmt.Errorf("input/%d: %w", i, err)
+		}
+		if input.ChatCompletion == nil {
+			return fmt.Errorf("input/%d: chat completion is nil", i)
+		}
+		if _, err := a.translate(ctx, *input.ChatCompletion); err != nil {
+			return fmt.Errorf("input/%d: %w", i, err)
+		}
+		i++
+	}
+	return simp.ErrBatchDeferred
+}
+
+// BatchLimits are 100,000 requests, or 256 MB per message batch.
+func (a *Anthropic) BatchLimits() simp.BatchLimits {
+	return simp.BatchLimits{Requests: 100000, Bytes: 256 << 20}
+}
+
 func (a *Anthropic) BatchSend(ctx context.Context, b *openai.Batch) error {
-	inputs, ok := ctx.Value(simp.KeyBatchInputs).([]openai.BatchInput)
+	inputs, ok := ctx.Value(simp.KeyBatchInputs).(simp.BatchInputs)
 	if !ok {
 		return fmt.Errorf("inputs are unknown at send time")
 	}
-	reqs := make([]anthropic.BetaMessageBatchNewParamsRequest, len(inputs))
-	for i, input := range inputs {
+	reqs := []anthropic.BetaMessageBatchNewParamsRequest{}
+	i := 0
+	for input, err := range inputs {
+		if err != nil {
+			return fmt.Errorf("input/%d: %w", i, err)
+		}
 		if input.ChatCompletion == nil {
 			return fmt.Errorf("input/%d: chat completion is nil", i)
 		}
@@ -230,14 +288,17 @@ func (a *Anthropic) BatchSend(ctx context.Context, b *openai.Batch) error {
 		if err != nil {
 			return fmt.Errorf("input/%d: %w", i, err)
 		}
-		reqs[i].Params = anthropic.F(anthropic.BetaMessageBatchNewParamsRequestsParams{
-			Model:       params.Model,
-			Messages:    params.Messages,
-			MaxTokens:   params.MaxTokens,
-			Temperature: params.Temperature,
-			TopP:        params.TopP,
+		reqs = append(reqs, anthropic.BetaMessageBatchNewParamsRequest{
+			Params: anthropic.F(anthropic.BetaMessageBatchNewParamsRequestsParams{
+				Model:       params.Model,
+				Messages:    params.Messages,
+				MaxTokens:   params.MaxTokens,
+				Temperature: params.Temperature,
+				TopP:        params.TopP,
+			}),
+			CustomID: anthropic.F(input.CustomID),
 		})
-		reqs[i].CustomID = anthropic.F(input.CustomID)
+		i++
 	}
 	batch, err := a.Beta.Messages.Batches.New(ctx, anthropic.BetaMessageBatchNewParams{
 		Requests: anthropic.F(reqs),
@@ -245,14 +306,15 @@ func (a *Anthropic) BatchSend(ctx context.Context, b *openai.Batch) error {
 	if err != nil {
 		return err
 	}
-	b.Metadata["job"] = batch.ID
-	b.Metadata["state"] = batch.ProcessingStatus
+	b.Metadata[simp.MetaJob] = batch.ID
+	b.Metadata[simp.MetaState] = batch.ProcessingStatus
 	b.Status = a.batchStatus(batch.ProcessingStatus)
+	simp.Sent(ctx, b)
 	return nil
 }
 
 func (a *Anthropic) BatchRefresh(ctx context.Context, b *openai.Batch) error {
-	job, ok := b.Metadata["job"].(string)
+	job, ok := b.Metadata[simp.MetaJob].(string)
 	if !ok {
 		return fmt.Errorf("job is unknown")
 	}
@@ -263,14 +325,17 @@ func (a *Anthropic) BatchRefresh(ctx context.Context, b *openai.Batch) error {
 	if err != nil {
 		return err
 	}
-	b.Metadata["state"] = batch.ProcessingStatus
-	b.Metadata["results"] = batch.ResultsURL
+	b.Metadata[simp.MetaState] = batch.ProcessingStatus
+	b.Metadata[simp.MetaResults] = batch.ResultsURL
 	b.Status = a.batchStatus(batch.ProcessingStatus)
+	counts := batch.RequestCounts
+	b.RequestCounts.Completed = int(counts.Succeeded)
+	b.RequestCounts.Failed = int(counts.Errored + counts.Canceled + counts.Expired)
 	return nil
 }
 
 func (a *Anthropic) BatchReceive(ctx context.Context, b *openai.Batch) (outputs []openai.BatchOutput, ret error) {
-	job, ok := b.Metadata["job"].(string)
+	job, ok := b.Metadata[simp.MetaJob].(string)
 	if !ok {
 		return nil, fmt.Errorf("job is unknown")
 	}
@@ -298,6 +363,11 @@ func (a *Anthropic) BatchReceive(ctx context.Context, b *openai.Batch) (outputs
 					Type:    string(err.Type),
 					Message: err.Message,
 				}
+			case result.Type != anthropic.BetaMessageBatchResultTypeSucceeded:
+				output.Error = &openai.APIError{
+					Type:    string(result.Type),
+					Message: "request was " + string(result.Type),
+				}
 			default:
 				cc := &openai.ChatCompletionResponse{
 					Choices: []openai.ChatCompletionChoice{{
@@ -325,7 +395,7 @@ func (a *Anthropic) BatchReceive(ctx context.Context, b *openai.Batch) (outputs
 }
 
 func (a *Anthropic) BatchCancel(ctx context.Context, b *openai.Batch) error {
-	job, ok := b.Metadata["job"].(string)
+	job, ok := b.Metadata[simp.MetaJob].(string)
 	if !ok {
 		return fmt.Errorf("job is unknown")
 	}
@@ -336,7 +406,7 @@ func (a *Anthropic) BatchCancel(ctx context.Context, b *openai.Batch) error {
 	if err != nil {
 		return fmt.Errorf("failed to cancel batch: %w", err)
 	}
-	b.Metadata["state"] = batch.ProcessingStatus
+	b.Metadata[simp.MetaState] = batch.ProcessingStatus
 	b.Status = a.batchStatus(batch.ProcessingStatus)
 	return nil
 }
@@ -1,26 +1,41 @@
 package driver
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/busthorne/simp/config"
+	"github.com/sashabaranov/go-openai"
 )
 
 const dialTimeout = time.Second
 
-// NewDaemon creates a daemon client for the simulating proxy.
-func NewDaemon(cfg config.Daemon) (*Daemon, error) {
+// NewDaemon creates a daemon client for the simulating proxy; the TLS
+// config, if any, is how the daemon is trusted over https.
+func NewDaemon(cfg config.Daemon, tlsConfig *tls.Config) (*Daemon, error) {
 	baseUrl := cfg.BaseURL()
-	d, err := NewOpenAI(config.Provider{BaseURL: baseUrl})
-	if err != nil {
-		return nil, err
+	c := openai.DefaultConfig(cfg.APIKey)
+	c.BaseURL = baseUrl
+	var transport http.RoundTripper
+	if tlsConfig != nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = tlsConfig
+		transport = t
 	}
+	c.HTTPClient = &http.Client{Transport: hinting{transport}}
 	return &Daemon{
-		OpenAI:  *d,
-		baseUrl: baseUrl,
+		OpenAI: OpenAI{
+			*openai.NewClientWithConfig(c),
+			config.Provider{BaseURL: baseUrl, APIKey: cfg.APIKey},
+		},
+		baseUrl:   baseUrl,
+		tlsConfig: tlsConfig,
 	}, nil
 }
 
@@ -30,13 +45,15 @@ func NewDaemon(cfg config.Daemon) (*Daemon, error) {
 type Daemon struct {
 	OpenAI
 
-	baseUrl string
+	baseUrl   string
+	tlsConfig *tls.Config
 }
 
 func (d *Daemon) Ping() error {
 	client := &http.Client{
 		Transport: &http.Transport{
-			DialContext: (&net.Dialer{Timeout: dialTimeout}).DialContext,
+			DialContext:     (&net.Dialer{Timeout: dialTimeout}).DialContext,
+			TLSClientConfig: d.tlsConfig,
 		},
 	}
 	resp, err := client.Get(d.baseUrl + "/ping") //nolint:noctx
@@ -49,3 +66,33 @@ func (d *Daemon) Ping() error {
 	}
 	return nil
 }
+
+// Usage fetches the usage report of the daemon, as the query has it, into v.
+func (d *Daemon) Usage(ctx context.Context, query url.Values, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", d.baseUrl+"/usage?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if d.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+d.APIKey)
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:     (&net.Dialer{Timeout: dialTimeout}).DialContext,
+			TLSClientConfig: d.tlsConfig,
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("daemon: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e openai.ErrorResponse
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error != nil {
+			return fmt.Errorf("daemon: %s", e.Error.Message)
+		}
+		return fmt.Errorf("daemon: %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -3,6 +3,7 @@ package driver
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 
@@ -75,7 +76,7 @@ func (g *Gemini) Embed(ctx context.Context, req openai.EmbeddingRequest) (e open
 	}
 	resp, err := model.BatchEmbedContents(ctx, batch)
 	if err != nil {
-		return e, err
+		return e, g.retriable(err)
 	}
 	for i, embedding := range resp.Embeddings {
 		e.Data = append(e.Data, openai.Embedding{
@@ -170,7 +171,7 @@ func (g *Gemini) Chat(ctx context.Context, req openai.ChatCompletionRequest) (c
 	} else {
 		resp, err := chat.SendMessage(ctx, prompt.Parts...)
 		if err != nil {
-			return c, err
+			return c, g.retriable(err)
 		}
 		// Convert Gemini response to OpenAI format
 		for i, s := range g.choose(resp.Candidates) {
@@ -196,7 +197,7 @@ func (g *Gemini) Chat(ctx context.Context, req openai.ChatCompletionRequest) (c
 			default:
 				c.Stream <- openai.ChatCompletionStreamResponse{
 					Choices: []openai.ChatCompletionStreamChoice{{FinishReason: "error"}},
-					Error:   err,
+					Error:   g.retriable(err),
 				}
 				return
 			}
@@ -214,6 +215,16 @@ func (g *Gemini) Chat(ctx context.Context, req openai.ChatCompletionRequest) (c
 	return c, nil
 }
 
+// retriable refuses the blocked prompts, or answers; the rest goes by the
+// gRPC status.
+func (g *Gemini) retriable(err error) error {
+	var blocked *genai.BlockedError
+	if errors.As(err, &blocked) {
+		return refusal{simp.ErrContentFilter, err}
+	}
+	return grpcRetriable(err)
+}
+
 func (g *Gemini) choose(cans []*genai.Candidate) (choices []string) {
 	for _, c := range cans {
 		var s strings.Builder
@@ -1,8 +1,14 @@
 package driver
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"os"
 
 	"github.com/busthorne/simp"
 	"github.com/busthorne/simp/config"
@@ -15,6 +21,7 @@ func NewOpenAI(p config.Provider) (*OpenAI, error) {
 	if p.BaseURL != "" {
 		c.BaseURL = p.BaseURL
 	}
+	c.HTTPClient = &http.Client{Transport: hinting{}}
 	client := openai.NewClientWithConfig(c)
 	return &OpenAI{*client, p}, nil
 }
@@ -36,22 +43,74 @@ func (o *OpenAI) List(ctx context.Context) ([]openai.Model, error) {
 }
 
 func (o *OpenAI) Embed(ctx context.Context, req openai.EmbeddingRequest) (e openai.EmbeddingResponse, err error) {
-	return o.CreateEmbeddings(ctx, req)
+	ctx, hint := hinted(ctx)
+	e, err = o.CreateEmbeddings(ctx, req)
+	return e, o.retriable(err, hint)
 }
 
 func (o *OpenAI) Complete(ctx context.Context, req openai.CompletionRequest) (c openai.CompletionResponse, err error) {
-	return o.CreateCompletion(ctx, req)
+	ctx, hint := hinted(ctx)
+	c, err = o.CreateCompletion(ctx, req)
+	return c, o.retriable(err, hint)
 }
 
 func (o *OpenAI) Chat(ctx context.Context, req openai.ChatCompletionRequest) (c openai.ChatCompletionResponse, err error) {
-	return o.CreateChatCompletion(ctx, req)
+	ctx, hint := hinted(ctx)
+	c, err = o.CreateChatCompletion(ctx, req)
+	return c, o.retriable(err, hint)
 }
 
-func (o *OpenAI) BatchUpload(ctx context.Context, batch *openai.Batch, inputs []openai.BatchInput) error {
+// retriable classifies the error by the status code that the client had
+// seen, or refuses it by the error code; the headers are not kept in the
+// errors, so they're hinted.
+func (o *OpenAI) retriable(err error, hint *retryHint) error {
+	var (
+		apiErr *openai.APIError
+		reqErr *openai.RequestError
+		code   int
+	)
+	switch {
+	case errors.As(err, &apiErr):
+		if kind, ok := openaiRefusals[fmt.Sprint(apiErr.Code)]; ok {
+			return refusal{kind, err}
+		}
+		code = apiErr.HTTPStatusCode
+	case errors.As(err, &reqErr):
+		code = reqErr.HTTPStatusCode
+	}
+	return retriable(err, code, hint.after)
+}
+
+func (o *OpenAI) BatchUpload(ctx context.Context, batch *openai.Batch, inputs simp.BatchInputs) error {
 	if o.BaseURL != "" && !o.Batch {
 		return simp.ErrNotImplemented
 	}
-	f, err := o.CreateFileBatch(ctx, inputs)
+	// the inputs are written to disk, so that the upload could pick them up
+	tmp, err := os.CreateTemp("", "simp-openai-*.jsonl")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for input, err := range inputs {
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(input); err != nil {
+			return fmt.Errorf("input %q: %w", input.CustomID, err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	f, err := o.CreateFile(ctx, openai.FileRequest{
+		FileName: batch.ID + ".jsonl",
+		FilePath: tmp.Name(),
+		Purpose:  string(openai.PurposeBatch),
+	})
 	if err != nil {
 		return fmt.Errorf("upstream: %w", err)
 	}
@@ -59,6 +118,19 @@ func (o *OpenAI) BatchUpload(ctx context.Context, batch *openai.Batch, inputs []
 	return nil
 }
 
+// BatchLimits are 50,000 requests, or 200 MB per input file.
+// BatchCheck has nothing to validate: the inputs are uploaded verbatim.
+func (o *OpenAI) BatchCheck(ctx context.Context, inputs simp.BatchInputs) error {
+	if o.BaseURL != "" && !o.Batch {
+		return simp.ErrNotImplemented
+	}
+	return nil
+}
+
+func (o *OpenAI) BatchLimits() simp.BatchLimits {
+	return simp.BatchLimits{Requests: 50000, Bytes: 200 << 20}
+}
+
 func (o *OpenAI) BatchSend(ctx context.Context, batch *openai.Batch) error {
 	if batch.InputFileID == "" {
 		panic("no input file id")
@@ -71,12 +143,13 @@ func (o *OpenAI) BatchSend(ctx context.Context, batch *openai.Batch) error {
 	if err != nil {
 		return fmt.Errorf("upstream: %w", err)
 	}
-	batch.Metadata["real_id"] = b.ID
+	batch.Metadata[simp.MetaRealID] = b.ID
+	simp.Sent(ctx, batch)
 	return nil
 }
 
 func (o *OpenAI) BatchRefresh(ctx context.Context, batch *openai.Batch) error {
-	id, ok := batch.Metadata["real_id"].(string)
+	id, ok := batch.Metadata[simp.MetaRealID].(string)
 	if !ok {
 		return fmt.Errorf("real_id is unknown")
 	}
@@ -85,20 +158,89 @@ func (o *OpenAI) BatchRefresh(ctx context.Context, batch *openai.Batch) error {
 		return fmt.Errorf("upstream: %w", err)
 	}
 	batch.OutputFileID = b.OutputFileID
+	batch.ErrorFileID = b.ErrorFileID
 	batch.Errors = b.Errors
 	batch.Status = b.Status
+	batch.RequestCounts.Completed = b.RequestCounts.Completed
+	batch.RequestCounts.Failed = b.RequestCounts.Failed
 	return nil
 }
 
 func (o *OpenAI) BatchReceive(ctx context.Context, batch *openai.Batch) (outputs []openai.BatchOutput, err error) {
-	if batch.OutputFileID == "" {
+	if batch.OutputFileID == "" && batch.ErrorFileID == "" {
 		return nil, simp.ErrBatchIncomplete
 	}
-	return o.GetBatchContent(ctx, batch.OutputFileID)
+	// the failed requests are written to a separate file
+	for _, id := range []string{batch.OutputFileID, batch.ErrorFileID} {
+		if id == "" {
+			continue
+		}
+		if id == batch.ErrorFileID {
+			failed, err := o.batchErrors(ctx, id)
+			if err != nil {
+				return nil, err
+			}
+			outputs = append(outputs, failed...)
+			continue
+		}
+		file, err := o.GetBatchContent(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, file...)
+	}
+	return outputs, nil
+}
+
+// batchErrors reads the error file, the lines of which would have the
+// status code, and the error in the body of the response, rather than the
+// error of the line itself.
+func (o *OpenAI) batchErrors(ctx context.Context, id string) (outputs []openai.BatchOutput, err error) {
+	file, err := o.GetFileContent(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	dec := json.NewDecoder(file)
+	for {
+		var line struct {
+			ID       string           `json:"id"`
+			CustomID string           `json:"custom_id"`
+			Error    *openai.APIError `json:"error"`
+			Response *struct {
+				StatusCode int `json:"status_code"`
+				Body       struct {
+					Error *openai.APIError `json:"error"`
+				} `json:"body"`
+			} `json:"response"`
+		}
+		switch err := dec.Decode(&line); err {
+		case nil:
+		case io.EOF:
+			return outputs, nil
+		default:
+			return nil, fmt.Errorf("error file: %w", err)
+		}
+		output := openai.BatchOutput{ID: line.ID, CustomID: line.CustomID, Error: line.Error}
+		if r := line.Response; output.Error == nil && r != nil && r.Body.Error != nil {
+			output.Error = r.Body.Error
+			output.Error.HTTPStatusCode = r.StatusCode
+		}
+		if output.Error == nil {
+			output.Error = &openai.APIError{
+				Type:    "batch_error",
+				Message: "request has failed upstream",
+			}
+			if line.Response != nil {
+				output.Error.HTTPStatusCode = line.Response.StatusCode
+			}
+		}
+		outputs = append(outputs, output)
+	}
 }
 
 func (o *OpenAI) BatchCancel(ctx context.Context, batch *openai.Batch) error {
-	id, ok := batch.Metadata["real_id"].(string)
+	id, ok := batch.Metadata[simp.MetaRealID].(string)
 	if !ok {
 		return fmt.Errorf("real_id is unknown")
 	}
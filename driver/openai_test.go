@@ -0,0 +1,65 @@
+package driver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/busthorne/simp"
+	"github.com/busthorne/simp/config"
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestBatchSent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "batch_up", "object": "batch", "status": "validating"}`))
+	}))
+	defer srv.Close()
+
+	o, err := NewOpenAI(config.Provider{Driver: "openai", BaseURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept openai.Batch
+	ctx := context.WithValue(context.Background(), simp.KeySent, func(b openai.Batch) {
+		kept = b
+	})
+	batch := openai.Batch{ID: "sub", InputFileID: "file", Metadata: map[string]any{}}
+	if err := o.BatchSend(ctx, &batch); err != nil {
+		t.Fatal(err)
+	}
+	if kept.Metadata[simp.MetaRealID] != "batch_up" {
+		t.Fatalf("the job is not kept: %+v", kept)
+	}
+}
+
+func TestBatchErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"batch_req_1","custom_id":"a","response":{"status_code":400,"body":{"error":{"message":"Invalid model","type":"invalid_request_error","code":"model_not_found"}}}}
+{"id":"batch_req_2","custom_id":"b","response":{"status_code":500,"body":{}}}
+`))
+	}))
+	defer srv.Close()
+
+	o, err := NewOpenAI(config.Provider{Driver: "openai", BaseURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs, err := o.BatchReceive(context.Background(), &openai.Batch{ErrorFileID: "file-err"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 2 {
+		t.Fatalf("outputs: %+v", outputs)
+	}
+	// the upstream error is passed through
+	if e := outputs[0].Error; e == nil || e.Code != "model_not_found" || e.Message != "Invalid model" || e.HTTPStatusCode != 400 {
+		t.Errorf("a: %+v", e)
+	}
+	// and the generic one is only for the want of it
+	if e := outputs[1].Error; e == nil || e.Type != "batch_error" || outputs[1].CustomID != "b" {
+		t.Errorf("b: %+v", e)
+	}
+}
@@ -0,0 +1,163 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/busthorne/simp"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// retriable wraps the upstream error as simp.RetryError if it's transient,
+// i.e. the rate limit, the server error, or a timeout, so that the caller
+// would know to try again after a while; the refusals are up to the drivers,
+// as only they would know the provider's error codes.
+func retriable(err error, code int, after time.Duration) error {
+	var ne net.Error
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, simp.ErrRetry):
+		return err
+	case transient(code):
+	case errors.As(err, &ne) && ne.Timeout():
+	default:
+		return err
+	}
+	return &simp.RetryError{Err: err, After: after}
+}
+
+// refusal is the error that the model would not answer on account of the
+// input, but another model might.
+type refusal struct {
+	kind, err error
+}
+
+func (r refusal) Error() string {
+	return r.err.Error()
+}
+
+func (r refusal) Unwrap() []error {
+	return []error{r.kind, r.err}
+}
+
+// openaiRefusals are the error codes that OpenAI, and the compatible APIs
+// including Azure, would refuse the input with.
+var openaiRefusals = map[string]error{
+	"context_length_exceeded":  simp.ErrContextLength,
+	"content_filter":           simp.ErrContentFilter,
+	"content_policy_violation": simp.ErrContentFilter,
+}
+
+// googleTooLong tells whether the invalid argument is the prompt that won't
+// fit the context window; Google has no code for it, only the message.
+func googleTooLong(msg string) bool {
+	return strings.Contains(msg, "input token count")
+}
+
+// transient tells whether the HTTP status is worth retrying; 529 is what
+// Anthropic responds with when it's overloaded.
+func transient(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+		529:
+		return true
+	}
+	return false
+}
+
+// retryAfter is the hint given by the upstream, either in seconds, or as the
+// date; OpenAI would also give it in milliseconds.
+func retryAfter(h http.Header) time.Duration {
+	if h == nil {
+		return 0
+	}
+	if ms, err := strconv.ParseFloat(h.Get("Retry-After-Ms"), 64); err == nil && ms > 0 {
+		return time.Duration(ms * float64(time.Millisecond))
+	}
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if s, err := strconv.ParseFloat(v, 64); err == nil && s > 0 {
+		return time.Duration(s * float64(time.Second))
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+// grpcRetriable is retriable for the gRPC clients, where the hint is in
+// the error details, if anywhere.
+func grpcRetriable(err error) error {
+	if err == nil {
+		return nil
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return retriable(err, 0, 0)
+	}
+	var after time.Duration
+	for _, d := range st.Details() {
+		if ri, ok := d.(*errdetails.RetryInfo); ok && ri.RetryDelay != nil {
+			after = ri.RetryDelay.AsDuration()
+		}
+	}
+	switch st.Code() {
+	case codes.InvalidArgument:
+		if googleTooLong(st.Message()) {
+			return refusal{simp.ErrContextLength, err}
+		}
+	case codes.ResourceExhausted:
+		return retriable(err, http.StatusTooManyRequests, after)
+	case codes.Unavailable:
+		return retriable(err, http.StatusServiceUnavailable, after)
+	case codes.DeadlineExceeded:
+		return retriable(err, http.StatusGatewayTimeout, after)
+	}
+	return retriable(err, 0, after)
+}
+
+type hintKey struct{}
+
+// retryHint is where the hinting transport leaves the Retry-After of the
+// response, as some clients wouldn't have the headers in their errors.
+type retryHint struct {
+	after time.Duration
+}
+
+// hinted makes the context that the hinting transport would report to.
+func hinted(ctx context.Context) (context.Context, *retryHint) {
+	hint := &retryHint{}
+	return context.WithValue(ctx, hintKey{}, hint), hint
+}
+
+// hinting is the transport that keeps track of the Retry-After headers.
+type hinting struct {
+	http.RoundTripper
+}
+
+func (h hinting) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt := h.RoundTripper
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	resp, err := rt.RoundTrip(req)
+	if hint, ok := req.Context().Value(hintKey{}).(*retryHint); ok && resp != nil {
+		hint.after = retryAfter(resp.Header)
+	}
+	return resp, err
+}
@@ -0,0 +1,141 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+	"github.com/busthorne/simp"
+	"github.com/busthorne/simp/config"
+	genaiold "github.com/google/generative-ai-go/genai"
+	"github.com/sashabaranov/go-openai"
+	"google.golang.org/genai"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetryAfter(t *testing.T) {
+	for v, want := range map[string]time.Duration{
+		"":    0,
+		"2":   2 * time.Second,
+		"0.5": 500 * time.Millisecond,
+		"bad": 0,
+	} {
+		h := http.Header{}
+		if v != "" {
+			h.Set("Retry-After", v)
+		}
+		if got := retryAfter(h); got != want {
+			t.Errorf("Retry-After %q: %v, want %v", v, got, want)
+		}
+	}
+	h := http.Header{}
+	h.Set("Retry-After", "1")
+	h.Set("Retry-After-Ms", "250")
+	if got := retryAfter(h); got != 250*time.Millisecond {
+		t.Errorf("Retry-After-Ms: %v", got)
+	}
+}
+
+func TestOpenAIRetriable(t *testing.T) {
+	var status int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(status)
+		w.Write([]byte(`{"error":{"message":"nope","type":"error"}}`))
+	}))
+	defer srv.Close()
+
+	o, err := NewOpenAI(config.Provider{BaseURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := openai.ChatCompletionRequest{
+		Model:    "gpt-4o",
+		Messages: []openai.ChatCompletionMessage{{Role: "user", Content: "hi"}},
+	}
+	for code, transient := range map[int]bool{
+		http.StatusTooManyRequests:    true,
+		http.StatusServiceUnavailable: true,
+		http.StatusBadRequest:         false,
+		http.StatusUnauthorized:       false,
+	} {
+		status = code
+		_, err := o.Chat(context.Background(), req)
+		if err == nil {
+			t.Fatalf("%d: no error", code)
+		}
+		if errors.Is(err, simp.ErrRetry) != transient {
+			t.Errorf("%d: retriable is %v", code, !transient)
+		}
+		var re *simp.RetryError
+		if errors.As(err, &re) && re.After != 7*time.Second {
+			t.Errorf("%d: retry after %v", code, re.After)
+		}
+	}
+}
+
+func TestRefused(t *testing.T) {
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	o, err := NewOpenAI(config.Provider{BaseURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Anthropic{Client: *anthropic.NewClient(
+		option.WithBaseURL(srv.URL),
+		option.WithAPIKey("-"),
+		option.WithMaxRetries(0),
+	)}
+	req := openai.ChatCompletionRequest{
+		Model:    "gpt-4o",
+		Messages: []openai.ChatCompletionMessage{{Role: "user", Content: "hi"}},
+	}
+	openaiErr := func(b string) error {
+		body = b
+		_, err := o.Chat(context.Background(), req)
+		return err
+	}
+	anthropicErr := func(b string) error {
+		body = b
+		_, err := a.Chat(context.Background(), req)
+		return err
+	}
+	for _, c := range []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"openai context", openaiErr(`{"error":{"code":"context_length_exceeded","message":"maximum context length","type":"invalid_request_error"}}`), simp.ErrContextLength},
+		{"azure filter", openaiErr(`{"error":{"code":"content_filter","message":"filtered","type":"invalid_request_error"}}`), simp.ErrContentFilter},
+		{"openai other", openaiErr(`{"error":{"code":"invalid_api_key","message":"the request was blocked","type":"invalid_request_error"}}`), nil},
+		{"anthropic context", anthropicErr(`{"type":"error","error":{"type":"invalid_request_error","message":"prompt is too long: 201000 tokens > 200000 maximum"}}`), simp.ErrContextLength},
+		{"anthropic other", anthropicErr(`{"type":"error","error":{"type":"invalid_request_error","message":"maximum number of tokens"}}`), nil},
+		{"vertex context", (&Vertex{}).retriable(genai.APIError{Code: 400, Status: "INVALID_ARGUMENT", Message: "The input token count (2000000) exceeds the maximum number of tokens allowed (1048576)."}, &retryHint{}), simp.ErrContextLength},
+		{"gemini blocked", (&Gemini{}).retriable(&genaiold.BlockedError{}), simp.ErrContentFilter},
+		{"gemini context", (&Gemini{}).retriable(status.Error(codes.InvalidArgument, "The input token count (2000000) exceeds the maximum")), simp.ErrContextLength},
+		{"message alone", retriable(errors.New("blocked: maximum number of tokens"), http.StatusBadRequest, 0), nil},
+	} {
+		var got error
+		for _, kind := range []error{simp.ErrContextLength, simp.ErrContentFilter, simp.ErrRetry} {
+			if errors.Is(c.err, kind) {
+				got = kind
+			}
+		}
+		if got != c.want {
+			t.Errorf("%s: %v, want %v (%v)", c.name, got, c.want, c.err)
+		}
+	}
+}
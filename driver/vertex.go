@@ -7,9 +7,11 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -22,6 +24,7 @@ import (
 	"cloud.google.com/go/storage"
 	"github.com/busthorne/simp"
 	"github.com/busthorne/simp/config"
+	"github.com/gofiber/fiber/v2/log"
 	"github.com/sashabaranov/go-openai"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
@@ -103,9 +106,10 @@ func (v *Vertex) Embed(ctx context.Context, req openai.EmbeddingRequest) (e open
 	if d := int32(req.Dimensions); d != 0 {
 		config.OutputDimensionality = &d
 	}
+	ctx, hint := hinted(ctx)
 	resp, err := client.Models.EmbedContent(ctx, req.Model, contents, config)
 	if err != nil {
-		return e, fmt.Errorf("cannot embed content: %w", err)
+		return e, v.retriable(fmt.Errorf("cannot embed content: %w", err), hint)
 	}
 	spending := 0
 	for i, m := range resp.Embeddings {
@@ -133,7 +137,10 @@ type vertexRequest struct {
 	Config   *genai.GenerateContentConfig
 }
 
-func (v *Vertex) encode(ctx context.Context, req openai.ChatCompletionRequest) (*vertexRequest, error) {
+// attachFunc resolves the file URI to a Cloud Storage URI, and its mimetype.
+type attachFunc func(ctx context.Context, fileUri string) (gs, mime string, err error)
+
+func (v *Vertex) encode(ctx context.Context, req openai.ChatCompletionRequest, attach attachFunc) (*vertexRequest, error) {
 	var (
 		contents = []*genai.Content{}
 		config   = &genai.GenerateContentConfig{}
@@ -166,7 +173,7 @@ func (v *Vertex) encode(ctx context.Context, req openai.ChatCompletionRequest) (
 		} else if len(msg.MultiContent) > 0 {
 			for _, content := range msg.MultiContent {
 				if content.ImageURL != nil && content.ImageURL.URL != "" {
-					gs, mime, err := v.fileUpload(ctx, content.ImageURL.URL)
+					gs, mime, err := attach(ctx, content.ImageURL.URL)
 					if err != nil {
 						return nil, fmt.Errorf("cannot upload image: %w", err)
 					}
@@ -358,7 +365,7 @@ func (v *Vertex) Chat(ctx context.Context, req openai.ChatCompletionRequest) (c
 	if err != nil {
 		return c, err
 	}
-	p, err := v.encode(ctx, req)
+	p, err := v.encode(ctx, req, v.fileUpload)
 	if err != nil {
 		return c, err
 	}
@@ -383,10 +390,11 @@ func (v *Vertex) Chat(ctx context.Context, req openai.ChatCompletionRequest) (c
 		}
 		return c, nil
 	}
+	ctx, hint := hinted(ctx)
 	if !req.Stream {
 		resp, err := client.Models.GenerateContent(ctx, req.Model, p.Contents, p.Config)
 		if err != nil {
-			return c, fmt.Errorf("vertex GenerateContent failed: %w", err)
+			return c, v.retriable(fmt.Errorf("vertex GenerateContent failed: %w", err), hint)
 		}
 		return v.decode(resp)
 	}
@@ -397,7 +405,7 @@ func (v *Vertex) Chat(ctx context.Context, req openai.ChatCompletionRequest) (c
 		var total openai.Usage
 		for chunk, err := range client.Models.GenerateContentStream(ctx, req.Model, p.Contents, p.Config) {
 			if err != nil {
-				c.Stream <- openai.ChatCompletionStreamResponse{Error: err}
+				c.Stream <- openai.ChatCompletionStreamResponse{Error: v.retriable(err, hint)}
 				return
 			}
 			resp, err := v.decode(chunk)
@@ -436,7 +444,20 @@ func (v *Vertex) Chat(ctx context.Context, req openai.ChatCompletionRequest) (c
 	return c, nil
 }
 
-func (v *Vertex) BatchUpload(ctx context.Context, batch *openai.Batch, inputs []openai.BatchInput) error {
+// retriable classifies the error by the status code of the response, or
+// refuses the prompt that is too long.
+func (v *Vertex) retriable(err error, hint *retryHint) error {
+	var apiErr genai.APIError
+	if !errors.As(err, &apiErr) {
+		return retriable(err, 0, hint.after)
+	}
+	if apiErr.Status == "INVALID_ARGUMENT" && googleTooLong(apiErr.Message) {
+		return refusal{simp.ErrContextLength, err}
+	}
+	return retriable(err, apiErr.Code, hint.after)
+}
+
+func (v *Vertex) BatchUpload(ctx context.Context, batch *openai.Batch, inputs simp.BatchInputs) (err error) {
 	if !v.Batch {
 		return simp.ErrNotImplemented
 	}
@@ -447,7 +468,6 @@ func (v *Vertex) BatchUpload(ctx context.Context, batch *openai.Batch, inputs []
 	if !model.Batch {
 		return fmt.Errorf("model %q does not support batching", model.Name)
 	}
-
 	client, err := v.bigqueryClient(ctx)
 	if err != nil {
 		return err
@@ -458,15 +478,50 @@ func (v *Vertex) BatchUpload(ctx context.Context, batch *openai.Batch, inputs []
 		ID      string `bigquery:"custom_id"`
 		Request string `bigquery:"request"`
 	}
-	var (
-		table = batch.ID
-		rows  = []vertexBatch{}
-	)
-	for _, input := range inputs {
+	table := batch.ID
+	tableRef := client.Dataset(v.Dataset).Table(table)
+	err = tableRef.Create(ctx, &bigquery.TableMetadata{
+		Name: table,
+		Schema: bigquery.Schema{
+			{Name: "custom_id", Type: bigquery.StringFieldType},
+			{Name: "request", Type: bigquery.StringFieldType},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create table: %w", err)
+	}
+	// the table that is only partly filled is of no use to anyone
+	defer func() {
+		if err == nil {
+			return
+		}
+		if err := tableRef.Delete(context.WithoutCancel(ctx)); err != nil {
+			log.Errorf("vertex: delete table %s: %v\n", table, err)
+		}
+	}()
+	inserter := tableRef.Inserter()
+
+	const chunkSize = 200
+	chunk := make([]vertexBatch, 0, chunkSize)
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		log.Debugf("vertex: inserting %d requests into %s.%s\n", len(chunk), v.Dataset, table)
+		if err := inserter.Put(ctx, chunk); err != nil {
+			return fmt.Errorf("failed to insert batch chunk: %w", err)
+		}
+		chunk = chunk[:0]
+		return nil
+	}
+	for input, err := range inputs {
+		if err != nil {
+			return err
+		}
 		if input.ChatCompletion == nil {
 			return fmt.Errorf("embeddings are not supported")
 		}
-		sect, err := v.encode(ctx, *input.ChatCompletion)
+		sect, err := v.encode(ctx, *input.ChatCompletion, v.fileUpload)
 		if err != nil {
 			return fmt.Errorf("cannot encode request: %w", err)
 		}
@@ -515,43 +570,47 @@ func (v *Vertex) BatchUpload(ctx context.Context, batch *openai.Batch, inputs []
 		if err != nil {
 			return fmt.Errorf("cannot marshal request: %w", err)
 		}
-		rows = append(rows, vertexBatch{
+		chunk = append(chunk, vertexBatch{
 			ID:      input.CustomID,
 			Request: string(b),
 		})
+		if len(chunk) == chunkSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
 	}
-	err = client.
-		Dataset(v.Dataset).
-		Table(table).
-		Create(ctx, &bigquery.TableMetadata{
-			Name: table,
-			Schema: bigquery.Schema{
-				{Name: "custom_id", Type: bigquery.StringFieldType},
-				{Name: "request", Type: bigquery.StringFieldType},
-			},
-		})
-	if err != nil {
-		return fmt.Errorf("failed to create table: %w", err)
+	if err := flush(); err != nil {
+		return err
 	}
-	inserter := client.
-		Dataset(v.Dataset).
-		Table(table).
-		Inserter()
+	batch.InputFileID = table
+	return nil
+}
 
-	const chunkSize = 200
-	for input := 0; input < len(rows); input += chunkSize {
-		end := input + chunkSize
-		if end > len(rows) {
-			end = len(rows)
+// BatchCheck encodes the inputs as BatchUpload would, except that the
+// files are only checked to be reachable by URI, and never uploaded.
+func (v *Vertex) BatchCheck(ctx context.Context, inputs simp.BatchInputs) error {
+	if !v.Batch {
+		return simp.ErrNotImplemented
+	}
+	model, ok := ctx.Value(simp.KeyModel).(config.Model)
+	if !ok {
+		return fmt.Errorf("model not found")
+	}
+	if !model.Batch {
+		return fmt.Errorf("model %q does not support batching", model.Name)
+	}
+	for input, err := range inputs {
+		if err != nil {
+			return err
 		}
-		chunk := rows[input:end]
-
-		fmt.Println("inserting chunk", len(chunk), "into", v.Dataset, table)
-		if err := inserter.Put(ctx, chunk); err != nil {
-			return fmt.Errorf("failed to insert batch chunk: %w", err)
+		if input.ChatCompletion == nil {
+			return fmt.Errorf("embeddings are not supported")
+		}
+		if _, err := v.encode(ctx, *input.ChatCompletion, v.fileCheck); err != nil {
+			return fmt.Errorf("cannot encode request: %w", err)
 		}
 	}
-	batch.InputFileID = table
 	return nil
 }
 
@@ -561,6 +620,12 @@ func (v *Vertex) googleModel(m string) string {
 	// 	v.Project, v.Region, m)
 }
 
+// BatchLimits are 200,000 requests per batch prediction job; the inputs are
+// in BigQuery, so the size doesn't matter as much.
+func (v *Vertex) BatchLimits() simp.BatchLimits {
+	return simp.BatchLimits{Requests: 200000}
+}
+
 func (v *Vertex) BatchSend(ctx context.Context, batch *openai.Batch) error {
 	m, ok := ctx.Value(simp.KeyModel).(config.Model)
 	if !ok {
@@ -607,10 +672,11 @@ func (v *Vertex) BatchSend(ctx context.Context, batch *openai.Batch) error {
 	if err != nil {
 		return fmt.Errorf("cannot create job: %w", err)
 	}
-	batch.Metadata["table"] = input
-	batch.Metadata["job"] = job.GetName()
-	batch.Metadata["state"] = job.GetState()
+	batch.Metadata[simp.MetaTable] = input
+	batch.Metadata[simp.MetaJob] = job.GetName()
+	batch.Metadata[simp.MetaState] = job.GetState()
 	v.updateStatus(batch, job.GetState())
+	simp.Sent(ctx, batch)
 	return nil
 }
 
@@ -621,7 +687,7 @@ func (v *Vertex) BatchRefresh(ctx context.Context, batch *openai.Batch) error {
 	}
 	defer client.Close()
 
-	jobName, ok := batch.Metadata["job"].(string)
+	jobName, ok := batch.Metadata[simp.MetaJob].(string)
 	if !ok {
 		return fmt.Errorf("job name not available in metadata: %v", batch.Metadata)
 	}
@@ -630,9 +696,12 @@ func (v *Vertex) BatchRefresh(ctx context.Context, batch *openai.Batch) error {
 	if err != nil {
 		return fmt.Errorf("cannot get job: %w", err)
 	}
-	batch.Metadata["state"] = job.GetState()
+	batch.Metadata[simp.MetaState] = job.GetState()
 	batch.OutputFileID = job.GetOutputInfo().GetGcsOutputDirectory()
 	v.updateStatus(batch, job.GetState())
+	stats := job.GetCompletionStats()
+	batch.RequestCounts.Completed = int(stats.GetSuccessfulCount())
+	batch.RequestCounts.Failed = int(stats.GetFailedCount())
 	return nil
 }
 
@@ -658,11 +727,19 @@ func (v *Vertex) BatchReceive(ctx context.Context, batch *openai.Batch) (outputs
 		var row struct {
 			ID       string `bigquery:"custom_id"`
 			Response string `bigquery:"response"`
+			Status   string `bigquery:"status"`
 		}
 		err := it.Next(&row)
 		switch err {
 		case nil:
 			if len(row.Response) == 0 {
+				outputs = append(outputs, openai.BatchOutput{
+					CustomID: row.ID,
+					Error: &openai.APIError{
+						Type:    "provider_error",
+						Message: row.Status,
+					},
+				})
 				continue
 			}
 		case iterator.Done:
@@ -692,7 +769,7 @@ func (v *Vertex) BatchCancel(ctx context.Context, batch *openai.Batch) error {
 		return err
 	}
 	defer client.Close()
-	jobName, ok := batch.Metadata["job"].(string)
+	jobName, ok := batch.Metadata[simp.MetaJob].(string)
 	if !ok {
 		return fmt.Errorf("job name not available in metadata: %v", batch.Metadata)
 	}
@@ -700,9 +777,29 @@ func (v *Vertex) BatchCancel(ctx context.Context, batch *openai.Batch) error {
 	return client.CancelBatchPredictionJob(ctx, req)
 }
 
-func (v *Vertex) fileUpload(ctx context.Context, fileUri string) (gs, mime string, ret error) {
-	var ext string
-	switch ext = strings.ToLower(filepath.Ext(fileUri)); ext {
+// fileCheck is the fileUpload that wouldn't: the URI must be something
+// that fileUpload could fetch, or that is already in Cloud Storage.
+func (v *Vertex) fileCheck(ctx context.Context, fileUri string) (gs, mime string, err error) {
+	u, err := url.Parse(fileUri)
+	if err != nil {
+		return gs, mime, err
+	}
+	switch u.Scheme {
+	case "gs":
+		return fileUri, mimeOf(fileUri), nil
+	case "http", "https":
+		if v.Bucket == "" {
+			return gs, mime, fmt.Errorf("no bucket to upload %q to", fileUri)
+		}
+		return fileUri, mimeOf(fileUri), nil
+	default:
+		return gs, mime, fmt.Errorf("unsupported file URI scheme: %q", u.Scheme)
+	}
+}
+
+// mimeOf guesses the mimetype by the file extension.
+func mimeOf(fileUri string) (mime string) {
+	switch ext := strings.ToLower(filepath.Ext(fileUri)); ext {
 	case ".pdf":
 		mime = "application/pdf"
 	case ".mp3", ".wav", ".mpeg":
@@ -716,6 +813,12 @@ func (v *Vertex) fileUpload(ctx context.Context, fileUri string) (gs, mime strin
 	default:
 		mime = "text/plain"
 	}
+	return mime
+}
+
+func (v *Vertex) fileUpload(ctx context.Context, fileUri string) (gs, mime string, ret error) {
+	ext := strings.ToLower(filepath.Ext(fileUri))
+	mime = mimeOf(fileUri)
 	if strings.HasPrefix(fileUri, "gs://") {
 		return fileUri, mime, nil
 	}
@@ -797,6 +900,7 @@ func (v *Vertex) genaiClient(ctx context.Context) (*genai.Client, error) {
 		return nil, fmt.Errorf("unable to parse credentials file: %w", err)
 	}
 	httpClient := oauth2.NewClient(ctx, creds.TokenSource)
+	httpClient.Transport = hinting{httpClient.Transport}
 	client, err := genai.NewClient(ctx, &genai.ClientConfig{
 		Backend:  genai.BackendVertexAI,
 		Project:  v.Project,
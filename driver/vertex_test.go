@@ -62,7 +62,7 @@ func TestVertexBatchUpload(t *testing.T) {
 		"Who is the president of Ukraine?",
 		"Хто президент України?",
 	)
-	if err := v.BatchUpload(context.Background(), &b, mag); err != nil {
+	if err := v.BatchUpload(context.Background(), &b, simp.SliceInputs(mag)); err != nil {
 		t.Fatal(err)
 	}
 	t.Log("batch id:", b.ID)
@@ -107,3 +107,34 @@ func TestVertexBatchReceive(t *testing.T) {
 		t.Log(u.ChatCompletion.Choices[0].Message.Content)
 	}
 }
+
+func TestVertexBatchCheck(t *testing.T) {
+	v := &Vertex{Provider: config.Provider{Batch: true, Bucket: "simp"}}
+	ctx := context.WithValue(context.Background(), simp.KeyModel,
+		config.Model{Name: vertexModel, Batch: true})
+	image := func(uri string) []openai.BatchInput {
+		mag := prompts("What's in the picture?")
+		msg := &mag[0].ChatCompletion.Messages[0]
+		msg.Content = ""
+		msg.MultiContent = []openai.ChatMessagePart{
+			{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{URL: uri}},
+		}
+		return mag
+	}
+	if err := v.BatchCheck(ctx, simp.SliceInputs(prompts("Hello."))); err != nil {
+		t.Fatal("text:", err)
+	}
+	if err := v.BatchCheck(ctx, simp.SliceInputs(image("https://example.com/cat.png"))); err != nil {
+		t.Fatal("image:", err)
+	}
+	if err := v.BatchCheck(ctx, simp.SliceInputs(image("data:image/png;base64,AAAA"))); err == nil {
+		t.Fatal("data URI would not upload")
+	}
+	embed := []openai.BatchInput{{CustomID: "1", Embedding: &openai.EmbeddingRequest{}}}
+	if err := v.BatchCheck(ctx, simp.SliceInputs(embed)); err == nil {
+		t.Fatal("embeddings are not batched")
+	}
+	if len(v.uploads) > 0 {
+		t.Fatal("check has uploaded:", v.uploads)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 var (
@@ -30,8 +31,29 @@ var (
 	ErrBookkeeping = errors.New("bookkeeping error")
 	// ErrRetry is returned by drivers to indicate that the error is transient in nature.
 	ErrRetry = errors.New("retry")
+	// ErrContextLength is returned by drivers when the input is too long for the model.
+	ErrContextLength = errors.New("context length exceeded")
+	// ErrContentFilter is returned by drivers when the input, or the output, was filtered.
+	ErrContentFilter = errors.New("content filtered")
 )
 
+// RetryError is the transient error, as classified by the driver, along
+// with however long the upstream had asked to hold off for, if at all.
+//
+// It is both ErrRetry, and the underlying error.
+type RetryError struct {
+	Err   error
+	After time.Duration
+}
+
+func (e *RetryError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RetryError) Unwrap() []error {
+	return []error{ErrRetry, e.Err}
+}
+
 func init() {
 	Path = os.Getenv("SIMPPATH")
 	if Path == "" {